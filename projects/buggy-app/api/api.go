@@ -2,19 +2,23 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/ratelimit"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/render"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 
 	httplogger "github.com/gleicon/go-httplogger"
 )
@@ -23,25 +27,84 @@ import (
 type DbClient interface {
 	QueryRow(context.Context, string, ...interface{}) pgx.Row
 	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
+	Begin(context.Context) (pgx.Tx, error)
+	Ping(context.Context) error
 	Close()
 }
 
 type Config struct {
-	Port           int
+	Port int
+	// Where to serve the /debug endpoints (see DebugHandler), e.g. localhost:6060. They aren't
+	// served on Port, because they're for operators, not clients. Empty means they aren't served.
+	DebugAddr      string
 	Log            *log.Logger
 	AuthServiceUrl string
 	DatabaseUrl    string
+	RateLimit      RateLimitConfig
+	Trash          TrashConfig
+	Attachments    AttachmentConfig
+	Webhooks       WebhookConfig
+	Pool           util.PoolConfig
+	// How long to keep trying the database when starting, before logging that it's unavailable
+	ConnectBackoff util.Backoff
+	// Postgres URLs of streaming replicas to send reads to
+	ReadReplicaUrls []string
+	Replicas        model.ReplicaConfig
+	// Requests are cancelled after this long, along with any queries they're making (0 for no
+	// limit). Streams, exports and imports aren't limited.
+	RequestTimeout time.Duration
 }
 
 type Service struct {
 	config     Config
 	authClient auth.Client
 	pool       DbClient
+	limiter    ratelimit.Store
+	renderer   *render.Renderer
+	events     *eventBroker
+	// For sending webhooks
+	webhookClient *http.Client
+	// Opens a connection that is LISTENing for note events. This is set by Run.
+	listen func(ctx context.Context) (notificationConn, error)
+	// Reports on the database pool. This is set by Run.
+	poolStats func() util.PoolStats
+	// Read replicas of the database, if there are any. This is set by Run.
+	replicas *model.Replicas
+}
+
+// Where to read the owner's data from: a read replica, unless they've written recently
+func (as *Service) reader(owner string) model.Conn {
+	return as.replicas.Read(as.pool, owner)
+}
+
+// Where to write the owner's data: the primary. Their reads go there too for a while afterwards,
+// so that they see what they wrote.
+func (as *Service) writer(owner string) DbClient {
+	as.replicas.Wrote(owner)
+	return as.pool
 }
 
 func New(config Config) *Service {
 	return &Service{
-		config: config,
+		config:        config,
+		limiter:       ratelimit.NewMemoryStore(),
+		renderer:      newRenderer(),
+		events:        newEventBroker(),
+		webhookClient: newWebhookClient(config.Webhooks),
+	}
+}
+
+// Use this to serve Handler() without calling Run, for example in tests. It supplies the
+// database pool and auth client that Run would otherwise create.
+func NewWithClients(config Config, pool DbClient, authClient auth.Client) *Service {
+	return &Service{
+		config:        config,
+		authClient:    authClient,
+		pool:          pool,
+		limiter:       ratelimit.NewMemoryStore(),
+		renderer:      newRenderer(),
+		events:        newEventBroker(),
+		webhookClient: newWebhookClient(config.Webhooks),
 	}
 }
 
@@ -55,95 +118,404 @@ func (as *Service) handleMyNotes(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 	}
 
+	// Use the "model" layer to stream the owner's notes back out as JSON
+	as.writeNotes(w, r, func(fn func(model.Note) error) error {
+		return model.ForEachNoteForOwner(ctx, as.reader(owner), owner, fn)
+	})
+}
+
+// HTTP handler for getting notes for a particular user
+func (as *Service) handleMyNoteById(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	// Get the authenticated user from the context -- this will have been written earlier
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// The URL.Path will be something like /1/my/notes/abc123.json.
+	// path.Base strips everything but "abc123.json". We then Replace out the ".json" to give us
+	// just the ID.
+	id := strings.Replace(path.Base(r.URL.Path), ".json", "", 1)
+	if id == "" {
+		fmt.Printf("api: no ID supplied: url path %v\n", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
 	// Use the "model" layer to get a list of the owner's notes
-	notes, err := model.GetNotesForOwner(ctx, as.pool, owner)
+	note, err := model.GetNoteById(ctx, as.reader(owner), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		fmt.Printf("api: GetNotesForOwner failed: %v\n", err)
+		fmt.Printf("api: GetNoteById failed: %v\n", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
-	response := struct {
-		Notes model.Notes `json:"notes"`
-	}{
-		Notes: notes,
+	// If the client already has this version, there's no need to send it again
+	w.Header().Set("ETag", noteETag(note))
+	if noneMatch(r, noteETag(note)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
-	// Convert the []Row into JSON
-	res, err := util.MarshalWithIndent(response, "")
+	// Write it back out!
+	as.writeNote(w, r, http.StatusOK, note)
+}
+
+// The largest request body we'll accept when creating or updating a note
+const maxNoteBodyBytes = 1 << 20
+
+// noteRequest is the JSON body accepted when creating or updating a note
+type noteRequest struct {
+	Content string `json:"content"`
+}
+
+// Route requests for /1/my/notes.json according to method
+func (as *Service) routeMyNotes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		as.handleMyNotes(w, r)
+	case http.MethodPost:
+		as.handleCreateMyNote(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Route requests for /1/my/note/:id.json according to method
+func (as *Service) routeMyNote(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(strings.TrimPrefix(r.URL.Path, "/1/my/note/"), "/") {
+		as.routeMyAttachments(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, ".html") {
+		as.routeMyNoteHTML(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		as.handleMyNoteById(w, r)
+	case http.MethodPut:
+		as.handleUpdateMyNote(w, r)
+	case http.MethodDelete:
+		as.handleDeleteMyNote(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// HTTP handler for creating a note owned by the authenticated user
+func (as *Service) handleCreateMyNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	body, err := readNoteRequest(w, r)
 	if err != nil {
-		fmt.Printf("api: response marshal failed: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	note, err := model.CreateNote(ctx, as.writer(owner), owner, body.Content)
+	if err != nil {
+		fmt.Printf("api: CreateNote failed: %v\n", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
-	// Write it back out!
-	w.Header().Add("Content-Type", "text/json")
-	w.Write(res)
+	w.Header().Set("Location", fmt.Sprintf("/1/my/note/%s.json", note.Id))
+	w.Header().Set("ETag", noteETag(note))
+	as.writeNote(w, r, http.StatusCreated, note)
 }
 
-// HTTP handler for getting notes for a particular user
-func (as *Service) handleMyNoteById(w http.ResponseWriter, r *http.Request) {
+// HTTP handler for replacing the content of a note owned by the authenticated user
+func (as *Service) handleUpdateMyNote(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	// Get the authenticated user from the context -- this will have been written earlier
-	_, ok := authuserctx.FromAuthenticatedContext(ctx)
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
 	if !ok {
 		as.config.Log.Printf("api: route handler reached with invalid auth context")
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
 	}
 
-	// The URL.Path will be something like /1/my/notes/abc123.json.
-	// path.Base strips everything but "abc123.json". We then Replace out the ".json" to give us
-	// just the ID.
-	id := strings.Replace(path.Base(r.URL.Path), ".json", "", 1)
+	id := noteIdFromPath(r.URL.Path)
 	if id == "" {
-		fmt.Printf("api: no ID supplied: url path %v\n", r.URL.Path)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 
-	// Use the "model" layer to get a list of the owner's notes
-	note, err := model.GetNoteById(ctx, as.pool, id)
+	// Updates must say which version they're replacing, so that two clients can't
+	// silently overwrite each other's changes
+	version, err := versionFromIfMatch(r, id)
 	if err != nil {
-		fmt.Printf("api: GetNoteById failed: %v\n", err)
+		preconditionError(w, err)
+		return
+	}
+
+	body, err := readNoteRequest(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	note, err := model.UpdateNote(ctx, as.writer(owner), owner, id, body.Content, version)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, model.ErrConflict) {
+		preconditionError(w, errPreconditionFailed)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: UpdateNote failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", noteETag(note))
+	as.writeNote(w, r, http.StatusOK, note)
+}
+
+// HTTP handler for deleting a note owned by the authenticated user
+func (as *Service) handleDeleteMyNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	id := noteIdFromPath(r.URL.Path)
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	version, err := versionFromIfMatch(r, id)
+	if err != nil {
+		preconditionError(w, err)
+		return
+	}
+
+	err = model.DeleteNote(ctx, as.writer(owner), owner, id, version)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, model.ErrConflict) {
+		preconditionError(w, errPreconditionFailed)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: DeleteNote failed: %v\n", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
-	response := struct {
-		Note model.Note `json:"note"`
-	}{
-		Note: note,
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler for searching the authenticated user's notes with ?q=text and/or ?tag=name
+func (as *Service) handleMySearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
 	}
 
-	// Convert the []Row into JSON
-	res, err := util.MarshalWithIndent(response, "")
+	query := r.URL.Query()
+	as.writeNotes(w, r, func(fn func(model.Note) error) error {
+		return model.ForEachSearchResult(ctx, as.reader(owner), owner, query.Get("q"), query.Get("tag"), fn)
+	})
+}
+
+// The URL.Path will be something like /1/my/note/abc123.json.
+// path.Base strips everything but "abc123.json". We then trim the ".json" to give us
+// just the ID.
+func noteIdFromPath(urlPath string) string {
+	id := strings.TrimSuffix(path.Base(urlPath), ".json")
+	if id == "/" || id == "." {
+		return ""
+	}
+	return id
+}
+
+// Decode the JSON body of a create or update request
+func readNoteRequest(w http.ResponseWriter, r *http.Request) (noteRequest, error) {
+	var body noteRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNoteBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		return body, fmt.Errorf("invalid note: %w", err)
+	}
+	return body, nil
+}
+
+// Write a single note back out as {"note": {...}}, with only the ?fields asked for
+func (as *Service) writeNote(w http.ResponseWriter, r *http.Request, status int, note model.Note) {
+	fields, err := parseFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	note, err = as.withRendered(fields, note)
+	if err != nil {
+		fmt.Printf("api: note render failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	noteJSON, err := fields.marshal(note)
+	if err != nil {
+		fmt.Printf("api: note marshal failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	as.writeJSON(w, r, status, struct {
+		Note json.RawMessage `json:"note"`
+	}{Note: noteJSON})
+}
+
+// Write data back out as JSON with the given status, pretty-printed if the client asked
+// for ?indent=N
+func (as *Service) writeJSON(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	res, err := util.MarshalWithIndent(data, r.URL.Query().Get("indent"))
 	if err != nil {
 		fmt.Printf("api: response marshal failed: %v\n", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
-	// Write it back out!
 	w.Header().Add("Content-Type", "text/json")
+	w.WriteHeader(status)
 	w.Write(res)
 }
 
+// Routes that stream for as long as the client wants, or work through every note, so they aren't
+// given Config.RequestTimeout
+var untimedRoutes = map[string]bool{
+	"/1/my/events": true,
+	"/1/my/export": true,
+	"/1/my/import": true,
+}
+
+// wrapTimeout cancels the request's context after Config.RequestTimeout. Everything the handler
+// does with the context, like querying the database or verifying with the auth service, is
+// cancelled with it, so a slow request gives back its connection rather than holding on to it.
+func (as *Service) wrapTimeout(route string, handler http.HandlerFunc) http.HandlerFunc {
+	if as.config.RequestTimeout <= 0 || untimedRoutes[route] {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), as.config.RequestTimeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
 // Set up routes -- this can be used in tests to set up simple HTTP handling
 // rather than running the whole server.
 func (as *Service) Handler() http.Handler {
 	mux := new(http.ServeMux)
-	mux.HandleFunc("/1/my/note/", as.wrapAuth(as.authClient, as.handleMyNoteById))
-	mux.HandleFunc("/1/my/notes.json", as.wrapAuth(as.authClient, as.handleMyNotes))
-	return httplogger.HTTPLogger(mux)
+	// Health checks are for the infrastructure, so they skip auth and rate limiting
+	mux.HandleFunc("/healthz", as.handleHealthz)
+	mux.HandleFunc("/readyz", as.handleReadyz)
+	mux.HandleFunc("/1/my/note/", as.wrapRoute("/1/my/note/", as.routeMyNote))
+	mux.HandleFunc("/1/my/notes.json", as.wrapRoute("/1/my/notes.json", as.routeMyNotes))
+	mux.HandleFunc("/1/my/search.json", as.wrapRoute("/1/my/search.json", as.handleMySearch))
+	mux.HandleFunc("/1/my/trash.json", as.wrapRoute("/1/my/trash.json", as.handleMyTrash))
+	mux.HandleFunc("/1/my/trash/", as.wrapRoute("/1/my/trash/", as.routeMyTrashItem))
+	mux.HandleFunc("/1/my/export", as.wrapRoute("/1/my/export", as.handleMyExport))
+	mux.HandleFunc("/1/my/import", as.wrapRoute("/1/my/import", as.handleMyImport))
+	mux.HandleFunc("/1/my/events", as.wrapRoute("/1/my/events", as.handleMyEvents))
+	mux.HandleFunc("/1/my/webhooks.json", as.wrapRoute("/1/my/webhooks.json", as.routeMyWebhooks))
+	mux.HandleFunc("/1/my/webhooks/", as.wrapRoute("/1/my/webhooks/", as.routeMyWebhook))
+	return httplogger.HTTPLogger(as.wrapCompression(mux))
+}
+
+// waitForDatabase logs when the database is ready, or why it isn't
+func (as *Service) waitForDatabase(ctx context.Context, pool DbClient) {
+	err := util.WaitForDatabase(ctx, pool, as.config.ConnectBackoff, as.config.Log.Printf)
+	switch {
+	case ctx.Err() != nil:
+	case err != nil:
+		as.config.Log.Printf("api: database unavailable: %v", err)
+	default:
+		as.config.Log.Printf("api: database ready")
+	}
 }
 
 func (as *Service) Run(ctx context.Context) error {
 	listen := fmt.Sprintf(":%d", as.config.Port)
 
 	// Connect to the database via a "pool" of connections, allowing concurrency
-	pool, err := pgxpool.New(ctx, as.config.DatabaseUrl)
+	pool, err := util.NewPool(ctx, as.config.DatabaseUrl, as.config.Pool)
 	if err != nil {
 		return fmt.Errorf("unable to create connection pool: %w", err)
 	}
 	defer pool.Close()
-	// Add the pool to the the service
-	as.pool = pool
+	// Serve straight away, rather than waiting for the database: /readyz says whether it's ready
+	go as.waitForDatabase(ctx, pool)
+	// Add the pool to the the service. Statements are run as the authenticated user, so that
+	// Postgres only lets them at that user's notes.
+	as.pool = model.RowSecurity(pool)
+	as.poolStats = func() util.PoolStats {
+		return util.StatsOf(pool)
+	}
+
+	// Spread reads over the replicas, if there are any. They aren't waited for: reads go to the
+	// primary until they're healthy.
+	if len(as.config.ReadReplicaUrls) > 0 {
+		replicas := []model.Conn{}
+		for _, replicaUrl := range as.config.ReadReplicaUrls {
+			replica, err := util.NewPool(ctx, replicaUrl, as.config.Pool)
+			if err != nil {
+				return fmt.Errorf("unable to create replica connection pool: %w", err)
+			}
+			defer replica.Close()
+			replicas = append(replicas, model.RowSecurity(replica))
+		}
+		as.replicas = model.NewReplicas(replicas, as.config.Replicas)
+	}
+
+	// Note events arrive on a connection of their own, which is taken out of the pool for good
+	as.listen = func(ctx context.Context) (notificationConn, error) {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		listener := conn.Hijack()
+		if _, err := listener.Exec(ctx, "LISTEN "+noteEventsChannel); err != nil {
+			listener.Close(context.Background())
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	// Share rate limits with other replicas via the database, if asked to
+	var sharedLimiter *ratelimit.PostgresStore
+	if as.config.RateLimit.Shared {
+		sharedLimiter = ratelimit.NewPostgresStore(pool)
+		as.limiter = sharedLimiter
+	}
 
 	// Connect to the Auth service via the AuthClient
 	client, err := auth.NewClient(ctx, as.config.AuthServiceUrl)
@@ -164,12 +536,68 @@ func (as *Service) Run(ctx context.Context) error {
 		runErr = server.ListenAndServe()
 	}()
 
+	// The debug endpoints have a listener of their own, which shouldn't be reachable by clients
+	var debugServer *http.Server
+	if as.config.DebugAddr != "" {
+		debugServer = &http.Server{Addr: as.config.DebugAddr, Handler: as.DebugHandler()}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				as.config.Log.Printf("api: debug server failed: %v", err)
+			}
+		}()
+		as.config.Log.Printf("api service: debug endpoints listening: %s", as.config.DebugAddr)
+	}
+
+	// Clear out the trash in the background
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		as.runPurger(ctx)
+	}()
+
+	// Forget shared rate limit buckets that have refilled, as the memory store does
+	if sharedLimiter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			as.runRateLimitSweeper(ctx, sharedLimiter)
+		}()
+	}
+
+	// Pass note events on to event streams
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		as.runEvents(ctx)
+	}()
+
+	// Keep track of which replicas are healthy enough to read from
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		as.replicas.Run(ctx, as.config.Log.Printf)
+	}()
+
+	// Send webhooks in the background
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		as.runWebhooks(ctx)
+	}()
+
 	as.config.Log.Printf("api service: listening: %s", listen)
 
 	// Wait for a signal to shut down...
 	<-ctx.Done()
-	// ... and then do it as gracefully as possible.
+	// ... and then do it as gracefully as possible. Event streams never finish by themselves,
+	// so they are ended first, otherwise Shutdown would wait for them forever.
+	as.events.shutdown()
 	server.Shutdown(context.TODO())
+	if debugServer != nil {
+		debugServer.Shutdown(context.TODO())
+	}
 
 	wg.Wait()
 	return runErr
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/archive"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Users can take all of their notes away with them, and bring them back, as an archive of
+// Markdown files (see the archive package for the format):
+//
+//	GET /1/my/export?format=tar
+//	POST /1/my/import
+//
+// The import reports what happened to each file in the archive:
+//
+//	{"results":[{"file":"JBmytGF3.md","status":"updated","id":"JBmytGF3"},{"file":"new.md","status":"created","id":"A2RPq6To"}]}
+//
+// A file whose id is one of the user's notes replaces that note's content. Anything else is
+// created as a new note. Files that can't be read are reported with status "error" and the
+// rest are still imported, but all of the changes are made in one transaction, so if the
+// database fails part way through nothing is changed.
+
+// The largest archive we'll accept for import
+const maxImportBytes = 32 << 20
+
+// What we'll read from an import archive, which compressed can be far smaller than its contents
+var importLimits = archive.Limits{
+	FileBytes:  maxNoteBodyBytes,
+	Files:      10000,
+	TotalBytes: 256 << 20,
+}
+
+// What happened to one file in an imported archive
+type importResult struct {
+	File   string `json:"file"`
+	Status string `json:"status"`
+	Id     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	importCreated = "created"
+	importUpdated = "updated"
+	importSkipped = "skipped"
+	importError   = "error"
+)
+
+// A file that has been read successfully and is waiting to be written to the database
+type importFile struct {
+	result  int
+	meta    archive.Meta
+	content string
+}
+
+// HTTP handler for downloading all of the authenticated user's notes as a zip or tar archive
+func (as *Service) handleMyExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = archive.Zip
+	}
+	aw, err := archive.NewWriter(format, w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", archive.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="notes.%s"`, format))
+
+	// The archive is streamed, so nothing is written until the first note
+	written := 0
+	err = model.ForEachNoteForOwner(ctx, as.reader(owner), owner, func(note model.Note) error {
+		data, err := archive.Marshal(archive.Meta{
+			Id:       note.Id,
+			Created:  note.Created,
+			Modified: note.Modified,
+			Tags:     note.Tags,
+		}, note.Content)
+		if err != nil {
+			return err
+		}
+		written += 1
+		return aw.Add(note.Id+".md", note.Modified, data)
+	})
+	if err != nil {
+		fmt.Printf("api: export failed: %v\n", err)
+		if written == 0 {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// As with lists, the only way to tell the client is to cut the response short
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := aw.Close(); err != nil {
+		fmt.Printf("api: export write failed: %v\n", err)
+	}
+}
+
+// HTTP handler for creating and updating notes from an archive made by handleMyExport
+func (as *Service) handleMyImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// Zip files have their index at the end, so we need the whole thing before we can start
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("archive must be at most %d bytes", maxImportBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	results := []importResult{}
+	files := []importFile{}
+	err = archive.Read(data, importLimits, func(f archive.File) error {
+		result := importResult{File: f.Name}
+		switch {
+		case path.Ext(f.Name) != ".md":
+			result.Status = importSkipped
+			result.Error = "not a Markdown file"
+		case f.Data == nil:
+			result.Status = importError
+			result.Error = fmt.Sprintf("file must be at most %d bytes", maxNoteBodyBytes)
+		default:
+			meta, content, err := archive.Unmarshal(f.Data)
+			if err != nil {
+				result.Status = importError
+				result.Error = err.Error()
+				break
+			}
+			files = append(files, importFile{result: len(results), meta: meta, content: content})
+		}
+		results = append(results, result)
+		return nil
+	})
+	if errors.Is(err, archive.ErrTooManyFiles) {
+		http.Error(w, fmt.Sprintf("archive must have at most %d files", importLimits.Files), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, archive.ErrTooLarge) {
+		http.Error(w, fmt.Sprintf("archive must contain at most %d bytes", importLimits.TotalBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(files) > 0 {
+		if err := as.importFiles(r, owner, files, results); err != nil {
+			fmt.Printf("api: import failed: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	as.writeJSON(w, r, http.StatusOK, struct {
+		Results []importResult `json:"results"`
+	}{Results: results})
+}
+
+// Write the files to the database in a single transaction, filling in their results
+func (as *Service) importFiles(r *http.Request, owner string, files []importFile, results []importResult) error {
+	ctx := r.Context()
+	tx, err := as.writer(owner).Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	// Does nothing if the transaction has been committed
+	defer tx.Rollback(ctx)
+
+	for _, f := range files {
+		note, created, err := model.ImportNote(ctx, tx, owner, f.meta.Id, f.content, f.meta.Created, f.meta.Modified)
+		if err != nil {
+			return fmt.Errorf("%s: %w", results[f.result].File, err)
+		}
+		results[f.result].Id = note.Id
+		results[f.result].Status = importUpdated
+		if created {
+			results[f.result].Status = importCreated
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,414 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/blob"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Files can be attached to notes:
+//
+//	POST /1/my/note/JBmytGF3/attachments (multipart/form-data, with the file in "file")
+//	GET /1/my/note/JBmytGF3/attachments
+//	GET /1/my/note/JBmytGF3/attachments/A7x0nRt2
+//	DELETE /1/my/note/JBmytGF3/attachments/A7x0nRt2
+//
+// The metadata is kept in the database, and the bytes in a BlobStore. The type of a file is
+// worked out from its content, not from what the client says it is, and only AllowedTypes
+// can be uploaded.
+
+// BlobStore keeps the bytes of attachments. blob.FileStore and blob.S3Store are BlobStores.
+type BlobStore interface {
+	Put(ctx context.Context, key string, contentType string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type AttachmentConfig struct {
+	// Where to keep the bytes. If this is nil, attachments are turned off.
+	Store BlobStore
+	// The largest file that can be uploaded. Defaults to 10MB.
+	MaxBytes int64
+	// Media types that can be uploaded, as detected by http.DetectContentType. Defaults to
+	// defaultAttachmentTypes.
+	AllowedTypes []string
+}
+
+const defaultMaxAttachmentBytes = 10 << 20
+
+// Images, PDFs and plain text. Notably not HTML, which could run script on our origin.
+var defaultAttachmentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"application/pdf",
+	"text/plain",
+}
+
+// The longest filename we keep, in bytes
+const maxFilenameBytes = 255
+
+func (c AttachmentConfig) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return defaultMaxAttachmentBytes
+}
+
+// Is the detected content type (like "text/plain; charset=utf-8") one we accept?
+func (c AttachmentConfig) allowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	allowed := c.AllowedTypes
+	if len(allowed) == 0 {
+		allowed = defaultAttachmentTypes
+	}
+	for _, t := range allowed {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Route requests for /1/my/note/:id/attachments and /1/my/note/:id/attachments/:attachment
+func (as *Service) routeMyAttachments(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/1/my/note/")
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] != "attachments" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if as.config.Attachments.Store == nil {
+		http.Error(w, "attachments are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	note := parts[0]
+
+	if len(parts) == 2 || parts[2] == "" {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			as.handleMyAttachments(w, r, note)
+		case http.MethodPost:
+			as.handleCreateMyAttachment(w, r, note)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id := parts[2]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		as.handleMyAttachment(w, r, note, id)
+	case http.MethodDelete:
+		as.handleDeleteMyAttachment(w, r, note, id)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// HTTP handler for listing the attachments on a note owned by the authenticated user
+func (as *Service) handleMyAttachments(w http.ResponseWriter, r *http.Request, note string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	attachments, err := model.GetAttachmentsForNote(ctx, as.reader(owner), owner, note)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: GetAttachmentsForNote failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	as.writeJSON(w, r, http.StatusOK, struct {
+		Attachments []model.Attachment `json:"attachments"`
+	}{Attachments: attachments})
+}
+
+// HTTP handler for uploading an attachment to a note owned by the authenticated user
+func (as *Service) handleCreateMyAttachment(w http.ResponseWriter, r *http.Request, note string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	filename, data, err := as.readUpload(w, r)
+	var tooBig *http.MaxBytesError
+	if errors.Is(err, errAttachmentTooLarge) || errors.As(err, &tooBig) {
+		http.Error(w, errAttachmentTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Trust the bytes, not the client
+	contentType := http.DetectContentType(data)
+	if !as.config.Attachments.allowed(contentType) {
+		http.Error(w, fmt.Sprintf("attachments of type %s are not allowed", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Check the note before storing anything, so that users can't fill the store with blobs
+	// for notes that aren't theirs. CreateAttachment checks again, in case the note is deleted
+	// in between.
+	exists, err := model.NoteExists(ctx, as.writer(owner), owner, note)
+	if err != nil {
+		fmt.Printf("api: NoteExists failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	key, err := newBlobKey(owner, note)
+	if err != nil {
+		fmt.Printf("api: blob key failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Store the bytes first, so that there's never a row without a blob. If the row can't be
+	// made, the blob is deleted again.
+	store := as.config.Attachments.Store
+	if err := store.Put(ctx, key, contentType, bytes.NewReader(data), int64(len(data))); err != nil {
+		fmt.Printf("api: blob Put failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	attachment, err := model.CreateAttachment(ctx, as.writer(owner), owner, model.Attachment{
+		Note:        note,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		BlobKey:     key,
+	})
+	if err != nil {
+		as.deleteBlobs([]string{key})
+	}
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: CreateAttachment failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", attachmentPath(attachment))
+	as.writeJSON(w, r, http.StatusCreated, struct {
+		Attachment model.Attachment `json:"attachment"`
+	}{Attachment: attachment})
+}
+
+var errAttachmentTooLarge = errors.New("attachment is too large")
+
+// Read the "file" part of a multipart upload, up to the size limit. Other parts are ignored.
+func (as *Service) readUpload(w http.ResponseWriter, r *http.Request) (string, []byte, error) {
+	maxBytes := as.config.Attachments.maxBytes()
+	// Leave room for the multipart boundaries and headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid upload: %w", err)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", nil, errors.New("invalid upload: no file part")
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid upload: %w", err)
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(part, maxBytes+1))
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid upload: %w", err)
+		}
+		if int64(len(data)) > maxBytes {
+			return "", nil, errAttachmentTooLarge
+		}
+		if len(data) == 0 {
+			return "", nil, errors.New("invalid upload: file is empty")
+		}
+		return cleanFilename(part.FileName()), data, nil
+	}
+}
+
+// Filenames are only used for Content-Disposition, but keep them tidy anyway
+func cleanFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	for len(name) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" {
+		return "attachment"
+	}
+	return name
+}
+
+// Keys start with the owner and note so that a store can be browsed by hand, and end with
+// something random so that they can't be guessed or collide
+func newBlobKey(owner string, note string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return owner + "/" + note + "/" + hex.EncodeToString(b), nil
+}
+
+func attachmentPath(attachment model.Attachment) string {
+	return fmt.Sprintf("/1/my/note/%s/attachments/%s", attachment.Note, attachment.Id)
+}
+
+// HTTP handler for downloading an attachment on a note owned by the authenticated user
+func (as *Service) handleMyAttachment(w http.ResponseWriter, r *http.Request, note string, id string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	attachment, err := model.GetAttachment(ctx, as.reader(owner), owner, note, id)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: GetAttachment failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Attachments never change, so the ID is as good a version as any
+	etag := strconv.Quote(attachment.Id)
+	w.Header().Set("ETag", etag)
+	if noneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := as.config.Attachments.Store.Get(ctx, attachment.BlobKey)
+	if errors.Is(err, blob.ErrNotFound) {
+		fmt.Printf("api: blob missing for attachment %s: %s\n", attachment.Id, attachment.BlobKey)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: blob Get failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	// Images can be shown in the browser. Anything else is downloaded, and nothing is
+	// allowed to run script or be sniffed as something more dangerous.
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// Too late to send an error, so make sure the client sees the response is incomplete
+		fmt.Printf("api: attachment download failed: %v\n", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// HTTP handler for deleting an attachment on a note owned by the authenticated user
+func (as *Service) handleDeleteMyAttachment(w http.ResponseWriter, r *http.Request, note string, id string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	key, err := model.DeleteAttachment(ctx, as.writer(owner), owner, note, id)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: DeleteAttachment failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	as.deleteBlobs([]string{key})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete blobs whose rows have gone. This is best effort: the rows are already deleted, so a
+// blob that can't be deleted is only wasted space, and is logged so it can be cleaned up.
+//
+// It doesn't use the request's context, because the blobs should go even if the client
+// has gone away.
+func (as *Service) deleteBlobs(keys []string) {
+	store := as.config.Attachments.Store
+	if store == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := store.Delete(context.Background(), key); err != nil {
+			as.config.Log.Printf("api: could not delete blob %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Responses are compressed with brotli or gzip if the client says it can handle them in
+// Accept-Encoding:
+//
+//	Accept-Encoding: gzip, br;q=0.9
+//
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Compression
+
+// Encoders we support, in order of preference when the client doesn't mind which
+var supportedEncodings = []string{"br", "gzip"}
+
+// Encoders allocate a lot of memory, so we reuse them rather than making one per response
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+type resettableEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// wrapCompression compresses everything written by handler, if the client accepts it
+func (as *Service) wrapCompression(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Whether or not we compress, the response depends on Accept-Encoding
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// Pick an encoding from an Accept-Encoding header: the supported one with the highest q value
+func negotiateEncoding(header string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = parsed
+			}
+		}
+		if name == "*" {
+			for _, encoding := range supportedEncodings {
+				if _, ok := weights[encoding]; !ok {
+					weights[encoding] = q
+				}
+			}
+			continue
+		}
+		weights[name] = q
+	}
+
+	candidates := []string{}
+	for _, encoding := range supportedEncodings {
+		if weights[encoding] > 0 {
+			candidates = append(candidates, encoding)
+		}
+	}
+	// Stable, so that ties are broken by our preference order
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return weights[candidates[i]] > weights[candidates[j]]
+	})
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0]
+}
+
+// Compressing things that are already compressed (like images) is a waste of time
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		mediaType == ndjsonContentType
+}
+
+// compressWriter decides whether to compress when the status and headers are written, and
+// then sends the body through an encoder.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	encoder     resettableEncoder
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	hasBody := status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+	// Streams (like Server-Sent Events) need each write to reach the client straight away
+	streaming := strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+	if hasBody && !streaming && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", cw.encoding)
+		// The length will change, and we don't know what to
+		header.Del("Content-Length")
+		cw.encoder = encoderPools[cw.encoding].Get().(resettableEncoder)
+		cw.encoder.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is needed by anything that takes over the connection (like websockets)
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Finish the compressed stream and put the encoder back in the pool
+func (cw *compressWriter) close() {
+	if cw.encoder == nil {
+		return
+	}
+	cw.encoder.Close()
+	cw.encoder.Reset(nil)
+	encoderPools[cw.encoding].Put(cw.encoder)
+	cw.encoder = nil
+}
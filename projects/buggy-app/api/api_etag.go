@@ -0,0 +1,97 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+)
+
+// ETags let clients make conditional requests:
+//
+//   - GET with If-None-Match: "I already have this version, only send it if it's changed" (304)
+//   - PUT/DELETE with If-Match: "only change it if nobody else has since I read it" (412)
+//
+// The ETag is built from the note ID and its version (the modified time, in microseconds), so
+// it changes every time the note is modified:
+//
+//	ETag: "JBmytGF3.1a2b3c4d5e"
+//
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/ETag
+
+var (
+	errPreconditionRequired = errors.New("If-Match header is required")
+	errPreconditionFailed   = errors.New("If-Match does not match this note")
+)
+
+func noteETag(note model.Note) string {
+	return fmt.Sprintf(`"%s.%s"`, note.Id, strconv.FormatInt(note.Version(), 36))
+}
+
+// Split a header like `"a", W/"b"` into its entity tags
+func splitETags(header string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// The HTML rendering of a note is a different representation, so it needs a different ETag
+func noteHTMLETag(note model.Note) string {
+	return fmt.Sprintf(`"%s.%s.html"`, note.Id, strconv.FormatInt(note.Version(), 36))
+}
+
+// Does If-None-Match match etag? Comparison is weak, so W/"x" matches "x".
+func noneMatch(r *http.Request, etag string) bool {
+	for _, tag := range splitETags(r.Header.Get("If-None-Match")) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Work out which version of note id the client expects from If-Match. It returns 0 for
+// "*" (any version will do).
+//
+// We don't have the note in hand at this point, so the version comes from parsing the ETag.
+// The check itself happens in the database, so that nothing can change the note in between.
+func versionFromIfMatch(r *http.Request, id string) (int64, error) {
+	tags := splitETags(r.Header.Get("If-Match"))
+	if len(tags) == 0 {
+		return 0, errPreconditionRequired
+	}
+
+	for _, tag := range tags {
+		if tag == "*" {
+			return 0, nil
+		}
+		// If-Match uses strong comparison, so weak tags never match
+		if strings.HasPrefix(tag, "W/") || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		tagId, encoded, ok := strings.Cut(tag[1:len(tag)-1], ".")
+		if !ok || tagId != id {
+			continue
+		}
+		if version, err := strconv.ParseInt(encoded, 36, 64); err == nil && version != 0 {
+			return version, nil
+		}
+	}
+	return 0, errPreconditionFailed
+}
+
+// Write the status for an If-Match problem
+func preconditionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPreconditionRequired) {
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusPreconditionFailed)
+}
@@ -0,0 +1,333 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Clients can hear about changes to their notes as they happen, rather than polling, with
+// Server-Sent Events (https://html.spec.whatwg.org/multipage/server-sent-events.html):
+//
+//	GET /1/my/events
+//
+//	id: 1665863299597524-JBmytGF3
+//	event: updated
+//	data: {"id":"JBmytGF3","modified":"2022-10-15T19:48:19.597524Z"}
+//
+// Events are "created", "updated" or "deleted" (moved to the trash). They say which note
+// changed, not what it says now, so clients fetch the note if they need it.
+//
+// A trigger on the note table sends a Postgres NOTIFY for every change. Each API replica
+// LISTENs on one connection and hands events to the streams of the note's owner.
+//
+// If a client reconnects with Last-Event-ID (which EventSource does by itself), it is first
+// sent an event for each note that has changed since. When the API can't keep up with a
+// client, or loses its LISTEN connection, it ends the stream, and the client catches up when
+// it reconnects. Catching up isn't exact: a note's modified time is when the transaction that
+// changed it started, so a change that commits after a later one has been sent sorts before
+// the client's position and is missed. Clients that can't miss anything should list their
+// notes again after reconnecting.
+
+// The channel the trigger notifies
+const noteEventsChannel = "note_events"
+
+const (
+	// How often to send a comment on an idle stream, so that proxies don't close it
+	eventKeepAlive = 30 * time.Second
+	// How long clients should wait before reconnecting
+	eventRetry = 5 * time.Second
+	// How many events can be waiting for a stream before it is ended
+	eventBuffer = 64
+	// How long to wait before trying to LISTEN again after losing the connection
+	eventRelisten = time.Second
+)
+
+type noteEvent struct {
+	Id       string    `json:"id"`
+	Owner    string    `json:"-"`
+	Type     string    `json:"-"`
+	Modified time.Time `json:"modified"`
+}
+
+// The event ID is the note's position in the list of changes (see
+// model.ForEachNoteChangedSince), so that a client can pick up from there
+func (e noteEvent) eventId() string {
+	return fmt.Sprintf("%d-%s", e.Modified.UnixMicro(), e.Id)
+}
+
+// Parse a Last-Event-ID back into a position
+func parseEventId(eventId string) (time.Time, string, bool) {
+	micros, id, ok := strings.Cut(eventId, "-")
+	if !ok || id == "" {
+		return time.Time{}, "", false
+	}
+	n, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.UnixMicro(n).UTC(), id, true
+}
+
+// The event for a change to a note, read from the database when catching a client up
+func noteEventFor(note model.Note) noteEvent {
+	event := noteEvent{Id: note.Id, Owner: note.Owner, Modified: note.Modified}
+	switch {
+	case note.Deleted != nil:
+		event.Type = "deleted"
+	case note.Created.Equal(note.Modified):
+		event.Type = "created"
+	default:
+		event.Type = "updated"
+	}
+	return event
+}
+
+// The payload the trigger sends. modified is a Postgres timestamp, which has no time zone,
+// and is UTC like every other time in the database.
+func parseNotification(payload string) (noteEvent, error) {
+	var n struct {
+		Id       string `json:"id"`
+		Owner    string `json:"owner"`
+		Type     string `json:"type"`
+		Modified string `json:"modified"`
+	}
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return noteEvent{}, fmt.Errorf("invalid notification: %w", err)
+	}
+	modified, err := time.Parse("2006-01-02T15:04:05.999999", n.Modified)
+	if err != nil {
+		return noteEvent{}, fmt.Errorf("invalid notification: %w", err)
+	}
+	if n.Id == "" || n.Owner == "" || n.Type == "" {
+		return noteEvent{}, fmt.Errorf("invalid notification: %q", payload)
+	}
+	return noteEvent{Id: n.Id, Owner: n.Owner, Type: n.Type, Modified: modified}, nil
+}
+
+// eventBroker hands events to the streams of the note's owner
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan noteEvent]struct{}
+	closed      bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: map[string]map[chan noteEvent]struct{}{}}
+}
+
+// subscribe returns a channel of events for the owner's notes, which is closed if the stream
+// should end, and a function to call when the stream has finished. The channel is nil if the
+// broker has shut down.
+func (b *eventBroker) subscribe(owner string) (chan noteEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, func() {}
+	}
+
+	ch := make(chan noteEvent, eventBuffer)
+	if b.subscribers[owner] == nil {
+		b.subscribers[owner] = map[chan noteEvent]struct{}{}
+	}
+	b.subscribers[owner][ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(owner, ch)
+	}
+}
+
+// Remove a subscriber and close its channel, if that hasn't been done already. b.mu must be held.
+func (b *eventBroker) remove(owner string, ch chan noteEvent) {
+	if _, ok := b.subscribers[owner][ch]; !ok {
+		return
+	}
+	delete(b.subscribers[owner], ch)
+	if len(b.subscribers[owner]) == 0 {
+		delete(b.subscribers, owner)
+	}
+	close(ch)
+}
+
+// publish sends the event to each of the owner's streams. A stream that has fallen too far
+// behind is ended rather than holding everything else up.
+func (b *eventBroker) publish(event noteEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.Owner] {
+		select {
+		case ch <- event:
+		default:
+			b.remove(event.Owner, ch)
+		}
+	}
+}
+
+// disconnect ends every stream. Clients will reconnect and catch up.
+func (b *eventBroker) disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for owner, chans := range b.subscribers {
+		for ch := range chans {
+			b.remove(owner, ch)
+		}
+	}
+}
+
+// shutdown ends every stream and stops new ones from starting
+func (b *eventBroker) shutdown() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.disconnect()
+}
+
+// notificationConn is a database connection that is LISTENing. *pgx.Conn is one.
+type notificationConn interface {
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	Close(ctx context.Context) error
+}
+
+// runEvents LISTENs for note events and publishes them until ctx is done. If the connection
+// is lost, streams are ended (because events may have been missed) and it LISTENs again.
+func (as *Service) runEvents(ctx context.Context) {
+	if as.listen == nil {
+		return
+	}
+	for {
+		err := as.listenForEvents(ctx)
+		as.events.disconnect()
+		if ctx.Err() != nil {
+			return
+		}
+		as.config.Log.Printf("api: listening for note events failed: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventRelisten):
+		}
+	}
+}
+
+func (as *Service) listenForEvents(ctx context.Context) error {
+	conn, err := as.listen(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		event, err := parseNotification(notification.Payload)
+		if err != nil {
+			as.config.Log.Printf("api: %v", err)
+			continue
+		}
+		as.events.publish(event)
+	}
+}
+
+// HTTP handler for streaming events about the authenticated user's notes
+func (as *Service) handleMyEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		fmt.Printf("api: event stream needs a http.Flusher\n")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before catching up, so that nothing that happens in between is missed. Events
+	// that were already sent while catching up are skipped. (Only those: changes aren't always
+	// committed in the order of their modified times, so a later event can have an earlier
+	// position.)
+	events, unsubscribe := as.events.subscribe(owner)
+	defer unsubscribe()
+	if events == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx (and similar) from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+
+	sent := map[string]bool{}
+	if modified, id, ok := parseEventId(r.Header.Get("Last-Event-ID")); ok {
+		err := model.ForEachNoteChangedSince(ctx, as.pool, owner, modified, id, func(note model.Note) error {
+			event := noteEventFor(note)
+			sent[event.eventId()] = true
+			return writeEvent(w, event)
+		})
+		if err != nil {
+			// The client will reconnect and try again
+			fmt.Printf("api: ForEachNoteChangedSince failed: %v\n", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if sent[event.eventId()] {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event noteEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.eventId(), event.Type, data)
+	return err
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+)
+
+// Clients can ask for just the parts of each note they need with ?fields, which makes
+// responses much smaller when they don't need the content:
+//
+//	GET /1/my/notes.json?fields=id,tags,modified
+//	{"notes":[{"id":"JBmytGF3","modified":"2022-10-15T19:48:19.597524Z","tags":["example"]}]}
+//
+// "rendered" (the content as HTML) is only included if it's asked for, because rendering
+// takes time.
+
+// The JSON field names of model.Note, in the order they appear in the struct
+var noteFields = jsonFieldNames(reflect.TypeOf(model.Note{}))
+
+func jsonFieldNames(t reflect.Type) []string {
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// fieldSet is the set of note fields to include in a response. An empty fieldSet means
+// every field except "rendered".
+type fieldSet map[string]bool
+
+func parseFields(r *http.Request) (fieldSet, error) {
+	fields := fieldSet{}
+	param := r.URL.Query().Get("fields")
+	if param == "" {
+		return fields, nil
+	}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !isNoteField(name) {
+			return nil, fmt.Errorf("unknown field %q, expected some of: %s", name, strings.Join(noteFields, ","))
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+func isNoteField(name string) bool {
+	for _, field := range noteFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// marshal a note to JSON, keeping only the fields in the set (in struct order)
+func (f fieldSet) marshal(note model.Note) ([]byte, error) {
+	b, err := json.Marshal(note)
+	if err != nil || len(f) == 0 {
+		return b, err
+	}
+
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	for _, name := range noteFields {
+		value, ok := all[name]
+		if !ok || !f[name] {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
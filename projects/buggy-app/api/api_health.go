@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/cache"
+)
+
+// The API has two health endpoints, for whatever is running it:
+//
+//	GET /healthz  the process is up and serving HTTP
+//	GET /readyz   the API can do its job: the database and auth service are reachable
+//
+// /readyz lists each dependency it checked, and responds 503 if any of them failed, so a load
+// balancer can stop sending requests to a replica that would only fail them. Why a check failed
+// is logged rather than sent, since errors can give away addresses and other internals.
+//
+// GET /debug/pool reports on the database connection pool (see util.PoolStats), and
+// GET /debug/auth-cache on the auth client's cache (see cache.Stats), for monitoring. They say
+// more about the service than clients need to know, so they're served by DebugHandler, on an
+// address of their own (Config.DebugAddr), rather than with the rest of the API.
+
+// How long each dependency has to respond
+const readyCheckTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Error     string `json:"-"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+const (
+	healthOk          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// HTTP handler for checking that the process is up
+func (as *Service) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	as.writeJSON(w, r, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{healthOk})
+}
+
+// HTTP handler for checking that the API's dependencies are reachable
+func (as *Service) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	checks := []healthCheck{{Name: "postgres"}, {Name: "auth"}}
+	fns := []func(context.Context) error{as.pool.Ping, as.authClient.Health}
+
+	// Check concurrently, so a slow dependency doesn't use up another's time
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(check *healthCheck, fn func(context.Context) error) {
+			defer wg.Done()
+			*check = runHealthCheck(r.Context(), check.Name, fn)
+		}(&checks[i], fns[i])
+	}
+	wg.Wait()
+
+	status, code := healthOk, http.StatusOK
+	for _, check := range checks {
+		if check.Status != healthOk {
+			as.config.Log.Printf("api: readiness check %s failed: %s", check.Name, check.Error)
+			status, code = healthUnavailable, http.StatusServiceUnavailable
+		}
+	}
+
+	as.writeJSON(w, r, code, struct {
+		Status string        `json:"status"`
+		Checks []healthCheck `json:"checks"`
+	}{status, checks})
+}
+
+func runHealthCheck(ctx context.Context, name string, fn func(context.Context) error) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := fn(ctx)
+	check := healthCheck{Name: name, Status: healthOk, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		check.Status = healthUnavailable
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// DebugHandler serves the /debug endpoints. They aren't authenticated or rate limited, so it
+// shouldn't be reachable from outside.
+func (as *Service) DebugHandler() http.Handler {
+	mux := new(http.ServeMux)
+	mux.HandleFunc("/debug/pool", as.handleDebugPool)
+	mux.HandleFunc("/debug/auth-cache", as.handleDebugAuthCache)
+	return mux
+}
+
+// HTTP handler for monitoring the database pool
+func (as *Service) handleDebugPool(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if as.poolStats == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	as.writeJSON(w, r, http.StatusOK, as.poolStats())
+}
+
+// HTTP handler for monitoring the auth client's cache of verified credentials
+func (as *Service) handleDebugAuthCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	// Only the real client has a cache
+	client, ok := as.authClient.(interface{ CacheStats() cache.Stats })
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	as.writeJSON(w, r, http.StatusOK, client.CacheStats())
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/ratelimit"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// RouteLimit is the rate limit for one route. IP applies to every request, before
+// authentication, and stops a single client from hammering the auth service. User applies
+// once we know who the authenticated user is. Zero values mean no limit.
+type RouteLimit struct {
+	IP   ratelimit.Limit
+	User ratelimit.Limit
+}
+
+type RateLimitConfig struct {
+	// Limits for routes, keyed by the pattern used in Handler (e.g. "/1/my/notes.json")
+	Routes map[string]RouteLimit
+	// Limits for any route not in Routes
+	Default RouteLimit
+	// Keep buckets in Postgres so that limits hold across all API replicas
+	Shared bool
+	// Use the first address in X-Forwarded-For as the client IP. Only turn this on when the
+	// API is behind a proxy that sets the header, otherwise clients can pick their own IP.
+	TrustForwardedFor bool
+}
+
+func (c RateLimitConfig) forRoute(route string) RouteLimit {
+	if limit, ok := c.Routes[route]; ok {
+		return limit
+	}
+	return c.Default
+}
+
+// How often buckets that have refilled are deleted from Postgres, when rate limits are shared
+const rateLimitSweepInterval = time.Minute
+
+// runRateLimitSweeper deletes buckets that have refilled from the shared store every
+// rateLimitSweepInterval until ctx is done. Every API replica runs one; that's harmless, because a
+// bucket can only be deleted once.
+func (as *Service) runRateLimitSweeper(ctx context.Context, store *ratelimit.PostgresStore) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := store.Sweep(ctx); err != nil && ctx.Err() == nil {
+			as.config.Log.Printf("api: sweeping rate limits failed: %v", err)
+		}
+	}
+}
+
+// wrapRoute applies the standard middleware for an authenticated route: a timeout, a rate limit by
+// client IP, authentication, then a rate limit by user.
+func (as *Service) wrapRoute(route string, handler http.HandlerFunc) http.HandlerFunc {
+	limit := as.config.RateLimit.forRoute(route)
+	return as.wrapTimeout(route, as.wrapRateLimit(limit.IP, func(r *http.Request) string {
+		return fmt.Sprintf("ip:%s:%s", route, as.clientIP(r))
+	}, as.wrapAuth(as.authClient, as.wrapRateLimit(limit.User, func(r *http.Request) string {
+		id, _ := authuserctx.FromAuthenticatedContext(r.Context())
+		return fmt.Sprintf("user:%s:%s", route, id)
+	}, handler))))
+}
+
+// wrapRateLimit takes a token from the bucket named by key before calling the inner handler.
+// If the bucket is empty it responds with 429 Too Many Requests and a Retry-After header.
+//
+// Either way, the X-RateLimit-* headers tell the client where they stand:
+//
+//	X-RateLimit-Limit: the size of the bucket
+//	X-RateLimit-Remaining: requests left before being limited
+//	X-RateLimit-Reset: seconds until the bucket is full again
+func (as *Service) wrapRateLimit(limit ratelimit.Limit, key func(*http.Request) string, handler http.HandlerFunc) http.HandlerFunc {
+	if limit.Unlimited() {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := as.limiter.Take(r.Context(), key(r), limit)
+		if err != nil {
+			// Better to let requests through than to take the API down with the rate limiter
+			as.config.Log.Printf("api: rate limit error: %v", err)
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+		if !res.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (as *Service) clientIP(r *http.Request) string {
+	if as.config.RateLimit.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Headers are in whole seconds, and rounding down would tell clients to come back too early
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/render"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+	"github.com/jackc/pgx/v5"
+)
+
+// Notes are written in Markdown. Clients can get them as sanitized HTML, either on their own:
+//
+//	GET /1/my/note/JBmytGF3.html
+//	<p>Example note content with tags <a href="/1/my/search.json?tag=example" class="tag" rel="nofollow">#example</a></p>
+//
+// or alongside the other fields by asking for ?fields=id,content,rendered.
+
+// Tags link to a search for other notes with the same tag
+func newRenderer() *render.Renderer {
+	return render.New(func(tag string) string {
+		return "/1/my/search.json?tag=" + url.QueryEscape(tag)
+	})
+}
+
+// Fill in note.Rendered, if the fields ask for it
+func (as *Service) withRendered(fields fieldSet, note model.Note) (model.Note, error) {
+	if !fields["rendered"] {
+		return note, nil
+	}
+	html, err := as.renderer.Render(note)
+	if err != nil {
+		return note, err
+	}
+	note.Rendered = html
+	return note, nil
+}
+
+// Route requests for /1/my/note/:id.html according to method. The HTML is read-only.
+func (as *Service) routeMyNoteHTML(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		as.handleMyNoteHTML(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// HTTP handler for getting a note owned by the authenticated user as HTML
+func (as *Service) handleMyNoteHTML(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimSuffix(path.Base(r.URL.Path), ".html")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	note, err := model.GetNoteById(ctx, as.reader(owner), id)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && note.Owner != owner) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: GetNoteById failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", noteHTMLETag(note))
+	if noneMatch(r, noteHTMLETag(note)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	html, err := as.renderer.Render(note)
+	if err != nil {
+		fmt.Printf("api: note render failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// The HTML has been sanitized, but in case anything slips through, don't let the browser
+	// run scripts or load anything other than images
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src * data:")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(html))
+}
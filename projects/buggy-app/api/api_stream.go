@@ -0,0 +1,281 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+// Lists of notes can be very long, so rather than building the whole response in memory we
+// encode each note to the ResponseWriter as it comes out of the database. The response is
+// either one JSON object:
+//
+//	{"notes":[{...},{...}],"next":100}
+//
+// or, if the client sends Accept: application/x-ndjson, one note per line:
+//
+//	{"id":"JBmytGF3",...}
+//	{"id":"A2RPq6To",...}
+//
+// http://ndjson.org/
+//
+// Both respect ?fields (see api_fields.go). The JSON object also respects ?indent=N, giving
+// exactly the same output as util.MarshalWithIndent would.
+
+const ndjsonContentType = "application/x-ndjson"
+
+// Returned by the pager to stop iterating once a page is full
+var errPageFull = errors.New("api: page full")
+
+// pager applies ?limit=N&offset=M to a stream of notes. If there are more notes after the
+// page, next is set to the offset of the following page.
+type pager struct {
+	limit  int
+	offset int
+	seen   int
+	next   int
+}
+
+func newPager(r *http.Request) (*pager, error) {
+	query := r.URL.Query()
+	p := &pager{}
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if p.limit, err = strconv.Atoi(v); err != nil || p.limit < 1 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if p.offset, err = strconv.Atoi(v); err != nil || p.offset < 0 {
+			return nil, errors.New("offset must be zero or a positive integer")
+		}
+	}
+	return p, nil
+}
+
+func (p *pager) paginated() bool {
+	return p.limit > 0 || p.offset > 0
+}
+
+// Wrap fn so that it only sees the notes on this page
+func (p *pager) wrap(fn func(model.Note) error) func(model.Note) error {
+	return func(note model.Note) error {
+		index := p.seen
+		p.seen += 1
+		if index < p.offset {
+			return nil
+		}
+		if p.limit > 0 && index >= p.offset+p.limit {
+			p.next = index
+			return errPageFull
+		}
+		return fn(note)
+	}
+}
+
+// notesEncoder writes a list of notes. Nothing is written until the first note (or finish),
+// so that errors before then can still get a proper error status.
+type notesEncoder interface {
+	encode(model.Note) error
+	finish(next int) error
+	started() bool
+}
+
+// writeNotes streams the notes produced by each to the client, in whichever format it asked
+// for. each should call its argument for every note, stopping if it returns an error.
+func (as *Service) writeNotes(w http.ResponseWriter, r *http.Request, each func(func(model.Note) error) error) {
+	p, err := newPager(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields, err := parseFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var enc notesEncoder
+	if acceptsNDJSON(r) {
+		enc = &ndjsonEncoder{w: w, fields: fields, paginated: p.paginated()}
+	} else {
+		enc = &jsonNotesEncoder{w: w, fields: fields, indent: util.Indent(r.URL.Query().Get("indent"))}
+	}
+
+	err = each(p.wrap(func(note model.Note) error {
+		note, err := as.withRendered(fields, note)
+		if err != nil {
+			return err
+		}
+		return enc.encode(note)
+	}))
+	if err != nil && !errors.Is(err, errPageFull) {
+		fmt.Printf("api: listing notes failed: %v\n", err)
+		if !enc.started() {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// We've already sent a 200 and some of the notes, so the only way to tell the client
+		// something went wrong is to cut the response short.
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := enc.finish(p.next); err != nil {
+		fmt.Printf("api: response write failed: %v\n", err)
+	}
+}
+
+// Does the Accept header ask for NDJSON?
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonNotesEncoder writes the same bytes as marshalling {"notes": [...], "next": N}, a note
+// at a time. With an indent, that's:
+//
+//	{
+//	  "notes": [
+//	    {
+//	      "id": "JBmytGF3",
+//	      ...
+//	    }
+//	  ],
+//	  "next": 100
+//	}
+type jsonNotesEncoder struct {
+	w      http.ResponseWriter
+	fields fieldSet
+	indent string
+	count  int
+	begun  bool
+}
+
+// The newline (if indenting) and the indent for a given nesting level
+func (e *jsonNotesEncoder) newline(level int) string {
+	if e.indent == "" {
+		return ""
+	}
+	return "\n" + strings.Repeat(e.indent, level)
+}
+
+// The space after a colon (if indenting)
+func (e *jsonNotesEncoder) space() string {
+	if e.indent == "" {
+		return ""
+	}
+	return " "
+}
+
+func (e *jsonNotesEncoder) begin() error {
+	if e.begun {
+		return nil
+	}
+	e.begun = true
+	e.w.Header().Add("Content-Type", "text/json")
+	_, err := fmt.Fprintf(e.w, `{%s"notes":%s[`, e.newline(1), e.space())
+	return err
+}
+
+func (e *jsonNotesEncoder) encode(note model.Note) error {
+	if err := e.begin(); err != nil {
+		return err
+	}
+	b, err := e.fields.marshal(note)
+	if err != nil {
+		return fmt.Errorf("could not marshal note: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if e.count > 0 {
+		buf.WriteByte(',')
+	}
+	buf.WriteString(e.newline(2))
+	if e.indent != "" {
+		// Notes are two levels deep: inside the object, inside the array
+		if err := json.Indent(&buf, b, strings.Repeat(e.indent, 2), e.indent); err != nil {
+			return fmt.Errorf("could not indent note: %w", err)
+		}
+	} else {
+		buf.Write(b)
+	}
+	e.count += 1
+	_, err = e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *jsonNotesEncoder) finish(next int) error {
+	if err := e.begin(); err != nil {
+		return err
+	}
+	end := "]"
+	if e.count > 0 {
+		end = e.newline(1) + end
+	}
+	if next > 0 {
+		end += fmt.Sprintf(`,%s"next":%s%d`, e.newline(1), e.space(), next)
+	}
+	end += e.newline(0) + "}"
+	_, err := e.w.Write([]byte(end))
+	return err
+}
+
+func (e *jsonNotesEncoder) started() bool {
+	return e.begun
+}
+
+// ndjsonEncoder writes a note per line. There's nowhere in the body to put "next", so when
+// paginating it goes in an X-Next-Offset trailer, which is sent after the body.
+type ndjsonEncoder struct {
+	w         http.ResponseWriter
+	fields    fieldSet
+	paginated bool
+	begun     bool
+}
+
+func (e *ndjsonEncoder) begin() {
+	if e.begun {
+		return
+	}
+	e.begun = true
+	e.w.Header().Set("Content-Type", ndjsonContentType)
+	if e.paginated {
+		e.w.Header().Set("Trailer", "X-Next-Offset")
+	}
+	e.w.WriteHeader(http.StatusOK)
+}
+
+func (e *ndjsonEncoder) encode(note model.Note) error {
+	e.begin()
+	b, err := e.fields.marshal(note)
+	if err != nil {
+		return fmt.Errorf("could not marshal note: %w", err)
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *ndjsonEncoder) finish(next int) error {
+	e.begin()
+	if e.paginated && next > 0 {
+		e.w.Header().Set("X-Next-Offset", strconv.Itoa(next))
+	}
+	return nil
+}
+
+func (e *ndjsonEncoder) started() bool {
+	return e.begun
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Deleted notes go to the trash, where they can be listed, restored or deleted for good:
+//
+//	GET /1/my/trash.json
+//	POST /1/my/trash/JBmytGF3/restore
+//	DELETE /1/my/trash/JBmytGF3
+//
+// While the service is running, a purger permanently deletes notes that have been in the
+// trash for longer than TrashConfig.Retention. Purging a note deletes its attachments too.
+
+type TrashConfig struct {
+	// How long deleted notes are kept before they are purged. Zero means forever.
+	Retention time.Duration
+	// How often to look for notes to purge. Defaults to an hour.
+	PurgeInterval time.Duration
+}
+
+const (
+	defaultPurgeInterval = time.Hour
+	// How many notes to purge in each statement
+	purgeBatchSize = 1000
+)
+
+// HTTP handler for listing the authenticated user's deleted notes
+func (as *Service) handleMyTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	as.writeNotes(w, r, func(fn func(model.Note) error) error {
+		return model.ForEachDeletedNoteForOwner(ctx, as.reader(owner), owner, fn)
+	})
+}
+
+// Route requests for /1/my/trash/:id and /1/my/trash/:id/restore
+func (as *Service) routeMyTrashItem(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/1/my/trash/")
+	id, action, _ := strings.Cut(rest, "/")
+	id = strings.TrimSuffix(id, ".json")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		as.handlePurgeMyNote(w, r, id)
+	case "restore":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		as.handleRestoreMyNote(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// HTTP handler for taking one of the authenticated user's notes out of the trash
+func (as *Service) handleRestoreMyNote(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	note, err := model.RestoreNote(ctx, as.writer(owner), owner, id)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: RestoreNote failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/1/my/note/%s.json", note.Id))
+	w.Header().Set("ETag", noteETag(note))
+	as.writeNote(w, r, http.StatusOK, note)
+}
+
+// HTTP handler for permanently deleting one of the authenticated user's notes from the trash
+func (as *Service) handlePurgeMyNote(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	blobKeys, err := model.PurgeNote(ctx, as.writer(owner), owner, id)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: PurgeNote failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	as.deleteBlobs(blobKeys)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runPurger purges old notes from the trash every PurgeInterval until ctx is done. Every API
+// replica runs one; that's harmless, because a note can only be purged once.
+func (as *Service) runPurger(ctx context.Context) {
+	retention := as.config.Trash.Retention
+	if retention <= 0 {
+		return
+	}
+	interval := as.config.Trash.PurgeInterval
+	if interval <= 0 {
+		interval = defaultPurgeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		as.purgeTrash(ctx, retention)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (as *Service) purgeTrash(ctx context.Context, retention time.Duration) {
+	// The trash is purged for everyone at once, by a function that row-level security doesn't
+	// apply to
+	purged, blobKeys, err := model.PurgeDeletedNotes(ctx, as.pool, retention, purgeBatchSize)
+	// Even if the purge stopped part way, the batches before that were purged
+	as.deleteBlobs(blobKeys)
+	if err != nil && ctx.Err() == nil {
+		as.config.Log.Printf("api: purging trash failed after %d notes: %v", purged, err)
+		return
+	}
+	if purged > 0 {
+		as.config.Log.Printf("api: purged %d notes from the trash", purged)
+	}
+}
@@ -0,0 +1,430 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Users can register webhooks, which are sent a POST whenever one of their notes is created,
+// updated or moved to the trash:
+//
+//	GET /1/my/webhooks.json
+//	POST /1/my/webhooks.json {"url": "https://example.com/hook"}
+//	DELETE /1/my/webhooks/W3bh00k1
+//	GET /1/my/webhooks/W3bh00k1/deliveries
+//
+// The body is JSON like {"event": "note.updated", "note": {...}}. Requests are signed with the
+// secret returned when the webhook was created, so that receivers can check they came from us:
+//
+//	X-Webhook-Id: the delivery ID, which is the same for every attempt at it
+//	X-Webhook-Event: note.created, note.updated or note.deleted
+//	X-Webhook-Timestamp: when the request was sent, in seconds since the Unix epoch
+//	X-Webhook-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Deliveries are queued in the database by a trigger, and sent by a pool of workers. A delivery
+// that fails (anything but a 2xx response) is retried with exponential backoff, and after
+// MaxAttempts it is marked dead.
+
+type WebhookConfig struct {
+	// How many deliveries to send at once. Zero turns delivery off.
+	Workers int
+	// How many times to try a delivery before giving up on it. Defaults to 10.
+	MaxAttempts int
+	// Let webhooks send requests to loopback and private network addresses. This is for
+	// development and tests: otherwise users could make us send requests inside our network.
+	AllowPrivateNetworks bool
+}
+
+const (
+	defaultWebhookAttempts = 10
+	// How long a receiver has to respond
+	webhookTimeout = 10 * time.Second
+	// How long a claimed delivery is left alone before another worker can try it, in case the
+	// worker that claimed it dies. This must be longer than webhookTimeout.
+	webhookLease = time.Minute
+	// How long workers wait before looking for more deliveries when there are none due
+	webhookPollInterval = time.Second
+	// The wait before the first retry. It doubles with every attempt, up to webhookMaxBackoff.
+	webhookBackoff    = 30 * time.Second
+	webhookMaxBackoff = 6 * time.Hour
+	// Deliveries that have been delivered or given up on are kept this long, so that their
+	// history can be seen
+	deliveryRetention     = 7 * 24 * time.Hour
+	deliveryPurgeInterval = time.Hour
+	// The most deliveries that are listed
+	maxDeliveriesListed = 100
+	// The most of a failed response that is kept, to show why it failed
+	maxDeliveryErrorBytes = 512
+)
+
+func (c WebhookConfig) maxAttempts() int {
+	if c.MaxAttempts > 0 {
+		return c.MaxAttempts
+	}
+	return defaultWebhookAttempts
+}
+
+// The client that sends webhooks. It doesn't follow redirects or use a proxy, and unless
+// AllowPrivateNetworks is set it refuses to connect to internal addresses. The check is made
+// on the address actually dialled, so a DNS name can't be pointed inside afterwards.
+func newWebhookClient(config WebhookConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !config.AllowPrivateNetworks {
+		dialer.Control = refusePrivateAddresses
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func refusePrivateAddresses(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("webhooks can't be sent to %s", host)
+	}
+	return nil
+}
+
+// Sign a webhook request body, as described above
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Route requests for /1/my/webhooks.json according to method
+func (as *Service) routeMyWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		as.handleMyWebhooks(w, r)
+	case http.MethodPost:
+		as.handleCreateMyWebhook(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Route requests for /1/my/webhooks/:id and /1/my/webhooks/:id/deliveries
+func (as *Service) routeMyWebhook(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/1/my/webhooks/")
+	id, action, _ := strings.Cut(rest, "/")
+	id = strings.TrimSuffix(id, ".json")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		as.handleDeleteMyWebhook(w, r, id)
+	case "deliveries", "deliveries.json":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		as.handleMyWebhookDeliveries(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// HTTP handler for listing the authenticated user's webhooks
+func (as *Service) handleMyWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	webhooks, err := model.GetWebhooksForOwner(ctx, as.reader(owner), owner)
+	if err != nil {
+		fmt.Printf("api: GetWebhooksForOwner failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	as.writeJSON(w, r, http.StatusOK, struct {
+		Webhooks []model.Webhook `json:"webhooks"`
+	}{Webhooks: webhooks})
+}
+
+// webhookRequest is the JSON body accepted when creating a webhook
+type webhookRequest struct {
+	Url string `json:"url"`
+}
+
+// HTTP handler for registering a webhook for the authenticated user. The response includes the
+// secret for checking signatures, which is never shown again.
+func (as *Service) handleCreateMyWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var body webhookRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNoteBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validWebhookUrl(body.Url); err != nil {
+		http.Error(w, fmt.Sprintf("invalid webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		fmt.Printf("api: webhook secret failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	webhook, err := model.CreateWebhook(ctx, as.writer(owner), owner, body.Url, hex.EncodeToString(secret))
+	if err != nil {
+		fmt.Printf("api: CreateWebhook failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/1/my/webhooks/%s", webhook.Id))
+	as.writeJSON(w, r, http.StatusCreated, struct {
+		Webhook model.Webhook `json:"webhook"`
+	}{Webhook: webhook})
+}
+
+func validWebhookUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("url must be http or https")
+	}
+	if u.Host == "" {
+		return errors.New("url must have a host")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	return nil
+}
+
+// HTTP handler for deleting one of the authenticated user's webhooks
+func (as *Service) handleDeleteMyWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	err := model.DeleteWebhook(ctx, as.writer(owner), owner, id)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: DeleteWebhook failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler for seeing what happened to the recent deliveries for one of the authenticated
+// user's webhooks
+func (as *Service) handleMyWebhookDeliveries(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		as.config.Log.Printf("api: route handler reached with invalid auth context")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	deliveries, err := model.GetDeliveriesForWebhook(ctx, as.reader(owner), owner, id, maxDeliveriesListed)
+	if errors.Is(err, model.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("api: GetDeliveriesForWebhook failed: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	as.writeJSON(w, r, http.StatusOK, struct {
+		Deliveries []model.Delivery `json:"deliveries"`
+	}{Deliveries: deliveries})
+}
+
+// runWebhooks sends webhook deliveries with a pool of workers until ctx is done, and clears
+// out old deliveries in the meantime. Every API replica runs workers; they never send the
+// same delivery at the same time, because claiming one locks it.
+func (as *Service) runWebhooks(ctx context.Context) {
+	workers := as.config.Webhooks.Workers
+	if workers <= 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			as.runWebhookWorker(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(deliveryPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := model.PurgeDeliveries(ctx, as.pool, deliveryRetention)
+		if err != nil && ctx.Err() == nil {
+			as.config.Log.Printf("api: purging webhook deliveries failed: %v", err)
+		}
+		if purged > 0 {
+			as.config.Log.Printf("api: purged %d webhook deliveries", purged)
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send deliveries one after another while there are any due, and check back every
+// webhookPollInterval when there aren't
+func (as *Service) runWebhookWorker(ctx context.Context) {
+	for {
+		err := as.deliverWebhook(ctx)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, model.ErrNoDelivery) && ctx.Err() == nil {
+			as.config.Log.Printf("api: webhook delivery failed: %v", err)
+		}
+
+		timer := time.NewTimer(webhookPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Claim a delivery that is due, try to send it and record what happened. model.ErrNoDelivery
+// is returned if nothing is due. A failure to send isn't an error here: it's recorded against
+// the delivery, which is retried later.
+func (as *Service) deliverWebhook(ctx context.Context) error {
+	delivery, err := model.ClaimDelivery(ctx, as.pool, webhookLease)
+	if err != nil {
+		return err
+	}
+
+	status, err := as.sendWebhook(ctx, delivery)
+	if err == nil {
+		return model.CompleteDelivery(ctx, as.pool, delivery.Id, status)
+	}
+
+	// Retry until it has had all its attempts, and then give up on it
+	retryAfter := time.Duration(0)
+	if delivery.Attempts < as.config.Webhooks.maxAttempts() {
+		retryAfter = backoff(delivery.Attempts)
+	}
+	// The error can include part of the response, which might not be valid text
+	reason := strings.ToValidUTF8(err.Error(), "\uFFFD")
+	return model.FailDelivery(ctx, as.pool, delivery.Id, status, reason, retryAfter)
+}
+
+// How long to wait before trying again after attempt number attempt (starting at 1) has failed:
+// exponential backoff with some jitter, so that lots of deliveries that failed together
+// (because a receiver was down) aren't all retried together.
+func backoff(attempt int) time.Duration {
+	delay := webhookMaxBackoff
+	if shift := attempt - 1; shift < 20 && webhookBackoff<<shift < webhookMaxBackoff {
+		delay = webhookBackoff << shift
+	}
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+}
+
+// Send a delivery to its webhook, returning the status of the response (0 if there wasn't
+// one) and an error unless it was a 2xx
+func (as *Service) sendWebhook(ctx context.Context, delivery model.ClaimedDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "buggy-app-webhooks")
+	req.Header.Set("X-Webhook-Id", delivery.Id)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", webhookSignature(delivery.Secret, timestamp, delivery.Payload))
+
+	res, err := as.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxDeliveryErrorBytes))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,320 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Notes are exported as a zip or tar archive with one Markdown file per note. Each file starts
+// with YAML "front matter" describing the note, followed by the note's content exactly as it
+// is stored:
+//
+//	---
+//	id: JBmytGF3
+//	created: 2022-10-15T19:48:19.597524Z
+//	modified: 2022-10-15T19:48:19.597524Z
+//	tags:
+//	    - example
+//	---
+//	Example note content with tags #example
+//
+// This is the same format that static site generators and note-taking apps like Obsidian use,
+// so exports can be read (and edited) with other tools and imported again.
+// https://jekyllrb.com/docs/front-matter/
+
+const (
+	Zip = "zip"
+	Tar = "tar"
+)
+
+var ErrUnknownFormat = errors.New("archive: unknown format, expected zip or tar")
+
+// The line that starts and ends the front matter
+const delimiter = "---"
+
+// Meta is the front matter of a note file. Everything is optional when importing.
+type Meta struct {
+	Id       string    `yaml:"id,omitempty"`
+	Created  time.Time `yaml:"created,omitempty"`
+	Modified time.Time `yaml:"modified,omitempty"`
+	Tags     []string  `yaml:"tags,omitempty"`
+}
+
+// Marshal a note to a Markdown file with front matter
+func Marshal(meta Meta, content string) ([]byte, error) {
+	front, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("archive: could not marshal front matter: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(delimiter + "\n")
+	buf.Write(front)
+	buf.WriteString(delimiter + "\n")
+	buf.WriteString(content)
+	return buf.Bytes(), nil
+}
+
+// Unmarshal a Markdown file into its front matter and content. A file without front matter
+// is all content.
+func Unmarshal(data []byte) (Meta, string, error) {
+	var meta Meta
+	// Some editors on Windows start files with a byte order mark
+	text := strings.TrimPrefix(string(data), "\ufeff")
+
+	first, rest, _ := strings.Cut(text, "\n")
+	if strings.TrimRight(first, "\r") != delimiter {
+		return meta, text, nil
+	}
+
+	var front strings.Builder
+	for {
+		line, after, found := strings.Cut(rest, "\n")
+		if strings.TrimRight(line, "\r") == delimiter {
+			rest = after
+			break
+		}
+		if !found {
+			return meta, "", errors.New("archive: front matter is not closed with ---")
+		}
+		front.WriteString(line + "\n")
+		rest = after
+	}
+
+	if err := yaml.Unmarshal([]byte(front.String()), &meta); err != nil {
+		return meta, "", fmt.Errorf("archive: invalid front matter: %w", err)
+	}
+	return meta, rest, nil
+}
+
+// ContentType is the media type of an archive format
+func ContentType(format string) string {
+	if format == Tar {
+		return "application/x-tar"
+	}
+	return "application/zip"
+}
+
+// Writer writes files to a zip or tar archive as they are added, so the archive never has to
+// be in memory all at once.
+type Writer struct {
+	zip *zip.Writer
+	tar *tar.Writer
+}
+
+func NewWriter(format string, w io.Writer) (*Writer, error) {
+	switch format {
+	case Zip:
+		return &Writer{zip: zip.NewWriter(w)}, nil
+	case Tar:
+		return &Writer{tar: tar.NewWriter(w)}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Add a file to the archive
+func (aw *Writer) Add(name string, modified time.Time, data []byte) error {
+	if aw.zip != nil {
+		f, err := aw.zip.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: modified,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	err := aw.tar.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = aw.tar.Write(data)
+	return err
+}
+
+// Close finishes the archive. It does not close the underlying writer.
+func (aw *Writer) Close() error {
+	if aw.zip != nil {
+		return aw.zip.Close()
+	}
+	return aw.tar.Close()
+}
+
+// File is a regular file read from an archive
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Detect the format of an archive from its first few bytes, returning "" if it is neither
+// zip nor tar.
+func Detect(data []byte) string {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")) {
+		return Zip
+	}
+	// The "ustar" magic is at offset 257 of the first header
+	if len(data) >= 262 && string(data[257:262]) == "ustar" {
+		return Tar
+	}
+	return ""
+}
+
+var (
+	ErrTooManyFiles = errors.New("archive: too many files")
+	ErrTooLarge     = errors.New("archive: files are too large in total")
+)
+
+// Limits bounds how much Read will decompress, since a small archive can expand into far more
+// data than it takes up (a "zip bomb")
+type Limits struct {
+	// Files bigger than this are passed to fn with nil Data, so that the caller can report them
+	FileBytes int64
+	// Read fails with ErrTooManyFiles if the archive has more entries than this, counting the
+	// directories and hidden files it skips
+	Files int
+	// Read fails with ErrTooLarge if the files it reads add up to more than this
+	TotalBytes int64
+}
+
+// Read calls fn with each regular file in a zip or tar archive, in the order they appear.
+// Directories and hidden files (like the ._ files macOS adds) are skipped.
+func Read(data []byte, limits Limits, fn func(File) error) error {
+	switch Detect(data) {
+	case Zip:
+		return readZip(data, limits, fn)
+	case Tar:
+		return readTar(data, limits, fn)
+	}
+	return ErrUnknownFormat
+}
+
+// counter keeps track of how much of the limits have been used
+type counter struct {
+	limits Limits
+	files  int
+	bytes  int64
+}
+
+func (c *counter) entry() error {
+	c.files++
+	if c.files > c.limits.Files {
+		return ErrTooManyFiles
+	}
+	return nil
+}
+
+func (c *counter) read(n int64) error {
+	c.bytes += n
+	if c.bytes > c.limits.TotalBytes {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+func readZip(data []byte, limits Limits, fn func(File) error) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("archive: invalid zip: %w", err)
+	}
+	// The central directory lists every entry, so too many can be rejected before reading any
+	if len(zr.File) > limits.Files {
+		return ErrTooManyFiles
+	}
+	c := counter{limits: limits}
+	for _, f := range zr.File {
+		if err := c.entry(); err != nil {
+			return err
+		}
+		if !f.Mode().IsRegular() || hidden(f.Name) {
+			continue
+		}
+		file := File{Name: f.Name}
+		if f.UncompressedSize64 <= uint64(limits.FileBytes) {
+			if file.Data, err = readZipFile(f, limits.FileBytes); err != nil {
+				return err
+			}
+			if err := c.read(int64(len(file.Data))); err != nil {
+				return err
+			}
+		}
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File, maxFileBytes int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("archive: could not open %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+	// The size in the header could be a lie, so don't trust it
+	data, err := io.ReadAll(io.LimitReader(rc, maxFileBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("archive: could not read %s: %w", f.Name, err)
+	}
+	if int64(len(data)) > maxFileBytes {
+		return nil, nil
+	}
+	return data, nil
+}
+
+func readTar(data []byte, limits Limits, fn func(File) error) error {
+	tr := tar.NewReader(bytes.NewReader(data))
+	c := counter{limits: limits}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("archive: invalid tar: %w", err)
+		}
+		if err := c.entry(); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || hidden(header.Name) {
+			continue
+		}
+		file := File{Name: header.Name}
+		if header.Size <= limits.FileBytes {
+			if file.Data, err = io.ReadAll(tr); err != nil {
+				return fmt.Errorf("archive: could not read %s: %w", header.Name, err)
+			}
+			if err := c.read(int64(len(file.Data))); err != nil {
+				return err
+			}
+		}
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+}
+
+func hidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == "__MACOSX" || (strings.HasPrefix(part, ".") && part != "." && part != "..") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package archive
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	created := time.Date(2022, 10, 15, 19, 48, 19, 597524000, time.UTC)
+	meta := Meta{Id: "JBmytGF3", Created: created, Modified: created, Tags: []string{"example"}}
+	content := "Example note content with tags #example\n---\nand a line that looks like a delimiter"
+
+	data, err := Marshal(meta, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStart := "---\nid: JBmytGF3\ncreated: 2022-10-15T19:48:19.597524Z\n"
+	if !bytes.HasPrefix(data, []byte(expectedStart)) {
+		t.Fatalf("expected file to start with %q, got %q", expectedStart, data)
+	}
+
+	gotMeta, gotContent, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, gotMeta) {
+		t.Fatalf("expected %v, got %v", meta, gotMeta)
+	}
+	if content != gotContent {
+		t.Fatalf("expected %q, got %q", content, gotContent)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		meta    Meta
+		content string
+		err     bool
+	}{
+		{"no front matter", "Just a note", Meta{}, "Just a note", false},
+		{"windows line endings", "---\r\nid: abc\r\n---\r\nNote", Meta{Id: "abc"}, "Note", false},
+		{"byte order mark", "\ufeff---\nid: abc\n---\nNote", Meta{Id: "abc"}, "Note", false},
+		{"unknown fields", "---\ntitle: Hello\n---\nNote", Meta{}, "Note", false},
+		{"not closed", "---\nid: abc\nNote", Meta{}, "", true},
+		{"invalid yaml", "---\nid: [abc\n---\nNote", Meta{}, "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			meta, content, err := Unmarshal([]byte(tc.data))
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.meta, meta) {
+				t.Fatalf("expected %v, got %v", tc.meta, meta)
+			}
+			if tc.content != content {
+				t.Fatalf("expected %q, got %q", tc.content, content)
+			}
+		})
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, format := range []string{Zip, Tar} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			aw, err := NewWriter(format, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := []File{
+				{Name: "one.md", Data: []byte("One")},
+				{Name: ".hidden.md", Data: []byte("Hidden")},
+				{Name: "big.md", Data: []byte("This one is too big")},
+				{Name: "two.md", Data: []byte("Two")},
+			}
+			for _, f := range files {
+				if err := aw.Add(f.Name, time.Now(), f.Data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := aw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if detected := Detect(buf.Bytes()); detected != format {
+				t.Fatalf("expected %s, detected %q", format, detected)
+			}
+
+			read := []File{}
+			err = Read(buf.Bytes(), Limits{FileBytes: 10, Files: 10, TotalBytes: 100}, func(f File) error {
+				read = append(read, f)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []File{
+				{Name: "one.md", Data: []byte("One")},
+				{Name: "big.md"},
+				{Name: "two.md", Data: []byte("Two")},
+			}
+			if !reflect.DeepEqual(expected, read) {
+				t.Fatalf("expected %v, got %v", expected, read)
+			}
+		})
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	for _, format := range []string{Zip, Tar} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			aw, err := NewWriter(format, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"one.md", ".hidden.md", "two.md"} {
+				if err := aw.Add(name, time.Now(), []byte("12345")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := aw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				limits   Limits
+				expected error
+			}{
+				{Limits{FileBytes: 10, Files: 3, TotalBytes: 10}, nil},
+				{Limits{FileBytes: 10, Files: 2, TotalBytes: 10}, ErrTooManyFiles},
+				{Limits{FileBytes: 10, Files: 3, TotalBytes: 9}, ErrTooLarge},
+				// Files that are too big to read don't count towards the total
+				{Limits{FileBytes: 4, Files: 3, TotalBytes: 1}, nil},
+			}
+			for _, test := range tests {
+				err := Read(buf.Bytes(), test.limits, func(f File) error { return nil })
+				if err != test.expected {
+					t.Errorf("%+v: expected %v, got %v", test.limits, test.expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadUnknownFormat(t *testing.T) {
+	err := Read([]byte("not an archive"), Limits{}, func(f File) error { return nil })
+	if err != ErrUnknownFormat {
+		t.Fatalf("expected ErrUnknownFormat, got %v", err)
+	}
+}
+
+func TestNewWriterUnknownFormat(t *testing.T) {
+	if _, err := NewWriter("rar", &bytes.Buffer{}); err != ErrUnknownFormat {
+		t.Fatalf("expected ErrUnknownFormat, got %v", err)
+	}
+}
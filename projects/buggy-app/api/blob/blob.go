@@ -0,0 +1,34 @@
+package blob
+
+import (
+	"errors"
+	"strings"
+)
+
+// This package stores the bytes of attachments. There are two stores, which do the same thing:
+//
+//   - FileStore keeps blobs as files in a directory, which is all you need for one API replica
+//   - S3Store keeps them in an S3 bucket (or anything that speaks the S3 API, like MinIO), which
+//     every replica can share
+//
+// Keys are paths like "A2RPq6To/JBmytGF3/0f8fad5bd9cb469f". They are made by the API, never
+// by users, but are checked anyway so that a bad key can't escape the store.
+
+var (
+	// ErrNotFound is returned by Get when there is no blob with the key
+	ErrNotFound = errors.New("blob: not found")
+	// ErrInvalidKey is returned for keys that are empty or could escape the store
+	ErrInvalidKey = errors.New("blob: invalid key")
+)
+
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileStore keeps blobs as files under a directory
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (fs *FileStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(fs.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file and then renames it into place, so that readers
+// never see half a blob.
+func (fs *FileStore) Put(ctx context.Context, key string, contentType string, r io.Reader, size int64) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("blob: could not create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("blob: could not create file: %w", err)
+	}
+	// Does nothing once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("blob: could not write %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("blob: could not write %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("blob: could not write %s: %w", key, err)
+	}
+	return nil
+}
+
+func (fs *FileStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("blob: could not read %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// Delete removes the blob. Deleting a blob that doesn't exist is not an error.
+func (fs *FileStore) Delete(ctx context.Context, key string) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("blob: could not delete %s: %w", key, err)
+	}
+	return nil
+}
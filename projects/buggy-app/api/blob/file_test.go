@@ -0,0 +1,58 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStore(t.TempDir())
+
+	err := store.Put(ctx, "owner/note/abc", "text/plain", strings.NewReader("hello"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := store.Get(ctx, "owner/note/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected hello, got %q", data)
+	}
+
+	if err := store.Delete(ctx, "owner/note/abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "owner/note/abc"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	// Deleting again is fine
+	if err := store.Delete(ctx, "owner/note/abc"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreInvalidKey(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStore(t.TempDir())
+
+	for _, key := range []string{"", "/etc/passwd", "../escape", "a/../../escape", "a//b", `a\b`} {
+		err := store.Put(ctx, key, "text/plain", strings.NewReader("x"), 1)
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+		if _, err := store.Get(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+}
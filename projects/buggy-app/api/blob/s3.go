@@ -0,0 +1,277 @@
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store keeps blobs in an S3 bucket. It only needs three operations (PUT, GET and DELETE an
+// object), so rather than pulling in a whole SDK it signs requests itself with AWS Signature
+// Version 4:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+//
+// It works with AWS and with S3-compatible servers like MinIO, which usually need PathStyle.
+
+type S3Config struct {
+	// For example https://s3.eu-west-2.amazonaws.com or http://minio:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Credentials for signing requests
+	AccessKeyId     string
+	SecretAccessKey string
+	// Put the bucket in the path (http://minio:9000/bucket/key) rather than the host name
+	// (https://bucket.s3.eu-west-2.amazonaws.com/key)
+	PathStyle bool
+	// Defaults to http.DefaultClient
+	HttpClient *http.Client
+}
+
+type S3Store struct {
+	config S3Config
+	http   *http.Client
+	// For tests
+	now func() time.Time
+}
+
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("blob: S3 endpoint and bucket are required")
+	}
+	if _, err := url.Parse(config.Endpoint); err != nil {
+		return nil, fmt.Errorf("blob: invalid S3 endpoint: %w", err)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.HttpClient == nil {
+		config.HttpClient = http.DefaultClient
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &S3Store{config: config, http: config.HttpClient, now: time.Now}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, contentType string, r io.Reader, size int64) error {
+	res, err := s.do(ctx, http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(http.MethodPut, key, res)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s3Error(http.MethodGet, key, res)
+	}
+	return res.Body, nil
+}
+
+// Delete removes the blob. S3 doesn't mind deleting something that doesn't exist.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(http.MethodDelete, key, res)
+	}
+	return nil
+}
+
+// S3 errors are XML, but the status and the start of the body are enough to debug with
+func s3Error(method string, key string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("blob: S3 %s %s failed: %d %s", method, key, res.StatusCode, strings.TrimSpace(string(body)))
+}
+
+func (s *S3Store) do(ctx context.Context, method string, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("blob: could not make request: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, s.now())
+
+	res, err := s.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("blob: S3 %s %s failed: %w", method, key, err)
+	}
+	return res, nil
+}
+
+func (s *S3Store) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("blob: invalid S3 endpoint: %w", err)
+	}
+	if s.config.PathStyle {
+		u.Path += "/" + s.config.Bucket + "/" + key
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path += "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	return u, nil
+}
+
+// The payload isn't signed, so that blobs can be streamed without reading them twice. Requests
+// are still protected by TLS (when the endpoint is https) and the rest of the signature.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds the headers for AWS Signature Version 4. The payload isn't signed unless the request
+// already has its hash in X-Amz-Content-Sha256.
+func (s *S3Store) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		encodePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.config.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := signingKey(s.config.SecretAccessKey, date, s.config.Region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.config.AccessKeyId, scope, signedHeaders, signature,
+	))
+}
+
+// The headers we sign: host, plus content-type, range and the x-amz-* headers if they're set
+func canonicalHeaders(req *http.Request) (signed string, canonical string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Encode each segment of a path, leaving the slashes alone
+func encodePath(p string) string {
+	return uriEncode(p, false)
+}
+
+// URI-encode the way AWS wants: everything except A-Z a-z 0-9 - _ . ~ (and / in paths)
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte(service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
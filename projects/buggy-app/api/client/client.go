@@ -0,0 +1,383 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+// This package is a typed client for the notes API, for use by other Go services. It takes care
+// of authentication, paging through long lists, retrying requests that failed for temporary
+// reasons and turning error responses into Go errors:
+//
+//	c := client.New(client.Config{
+//		BaseUrl:  "http://api:80",
+//		Id:       "A2RPq6To",
+//		Password: "banana",
+//	})
+//	notes, err := c.List(ctx)
+//	...
+//	note, err := c.Get(ctx, "JBmytGF3")
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+//
+// Updates and deletes must pass the ETag of the version being changed. If someone else has
+// changed the note since, the error will be ErrConflict:
+//
+//	note, err = c.Update(ctx, note.Id, note.ETag, "New content")
+//	if errors.Is(err, client.ErrConflict) {
+//		// Get the note again and decide what to do
+//	}
+//
+// Updates with an ETag and deletes aren't retried once they might have reached the API: if the
+// first attempt worked, a retry would fail with ErrConflict or ErrNotFound.
+
+var (
+	ErrUnauthorized = errors.New("client: unauthorized")
+	ErrNotFound     = errors.New("client: not found")
+	ErrConflict     = errors.New("client: note has been modified")
+)
+
+// Error is returned when the API responds with a non-2xx status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: api error: %d %s", e.StatusCode, e.Message)
+}
+
+// Unwrap allows errors.Is(err, ErrNotFound) and friends to work
+func (e *Error) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusPreconditionFailed:
+		return ErrConflict
+	}
+	return nil
+}
+
+type Config struct {
+	// Where the API is, for example http://localhost:8090
+	BaseUrl string
+	// Credentials sent with every request using basic auth
+	Id       string
+	Password string
+	// Defaults to http.DefaultClient
+	HttpClient *http.Client
+	// How many times to retry a failed request (0 means use the default, -1 means never retry)
+	MaxRetries int
+	// The wait before the first retry, which doubles for each retry after that
+	RetryWait time.Duration
+	// How many notes to ask for at once when listing
+	PageSize int
+}
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryWait  = 100 * time.Millisecond
+	defaultPageSize   = 100
+)
+
+type NotesClient struct {
+	config Config
+	http   *http.Client
+}
+
+func New(config Config) *NotesClient {
+	if config.HttpClient == nil {
+		config.HttpClient = http.DefaultClient
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	if config.RetryWait == 0 {
+		config.RetryWait = defaultRetryWait
+	}
+	if config.PageSize == 0 {
+		config.PageSize = defaultPageSize
+	}
+	config.BaseUrl = strings.TrimSuffix(config.BaseUrl, "/")
+	return &NotesClient{
+		config: config,
+		http:   config.HttpClient,
+	}
+}
+
+// Note is a note along with its ETag, which is needed to update or delete it
+type Note struct {
+	model.Note
+	ETag string
+}
+
+type noteResponse struct {
+	Note model.Note `json:"note"`
+}
+
+type notesResponse struct {
+	Notes model.Notes `json:"notes"`
+	Next  int         `json:"next,omitempty"`
+}
+
+type noteRequest struct {
+	Content string `json:"content"`
+}
+
+// List fetches all of the authenticated user's notes, a page at a time
+func (c *NotesClient) List(ctx context.Context) (model.Notes, error) {
+	return c.all(ctx, "/1/my/notes.json", url.Values{})
+}
+
+// ListPage fetches a single page of notes starting at offset. next is the offset of the
+// following page, or 0 if this was the last one. Notes are listed oldest first, so notes
+// created while paging turn up on a later page, but deleting one moves the rest back a place.
+func (c *NotesClient) ListPage(ctx context.Context, offset int) (notes model.Notes, next int, err error) {
+	return c.page(ctx, "/1/my/notes.json", url.Values{}, offset)
+}
+
+// Search fetches all notes that contain query and/or are tagged with tag
+func (c *NotesClient) Search(ctx context.Context, query string, tag string) (model.Notes, error) {
+	params := url.Values{}
+	if query != "" {
+		params.Set("q", query)
+	}
+	if tag != "" {
+		params.Set("tag", tag)
+	}
+	return c.all(ctx, "/1/my/search.json", params)
+}
+
+func (c *NotesClient) Get(ctx context.Context, id string) (Note, error) {
+	var res noteResponse
+	header, err := c.do(ctx, http.MethodGet, notePath(id), nil, nil, &res)
+	return Note{Note: res.Note, ETag: header.Get("ETag")}, err
+}
+
+func (c *NotesClient) Create(ctx context.Context, content string) (Note, error) {
+	var res noteResponse
+	header, err := c.do(ctx, http.MethodPost, "/1/my/notes.json", nil, noteRequest{Content: content}, &res)
+	return Note{Note: res.Note, ETag: header.Get("ETag")}, err
+}
+
+// Update replaces the content of a note. etag is the ETag of the version being replaced, or "*"
+// to replace whatever is there.
+func (c *NotesClient) Update(ctx context.Context, id string, etag string, content string) (Note, error) {
+	var res noteResponse
+	header, err := c.do(ctx, http.MethodPut, notePath(id), ifMatch(etag), noteRequest{Content: content}, &res)
+	return Note{Note: res.Note, ETag: header.Get("ETag")}, err
+}
+
+// Delete moves a note to the trash. etag is the ETag of the version being deleted, or "*" to delete
+// whatever is there.
+func (c *NotesClient) Delete(ctx context.Context, id string, etag string) error {
+	_, err := c.do(ctx, http.MethodDelete, notePath(id), ifMatch(etag), nil, nil)
+	return err
+}
+
+// Trash fetches all of the authenticated user's deleted notes, most recently deleted first
+func (c *NotesClient) Trash(ctx context.Context) (model.Notes, error) {
+	return c.all(ctx, "/1/my/trash.json", url.Values{})
+}
+
+// Restore takes a deleted note out of the trash
+func (c *NotesClient) Restore(ctx context.Context, id string) (Note, error) {
+	var res noteResponse
+	header, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/1/my/trash/%s/restore", url.PathEscape(id)), nil, nil, &res)
+	return Note{Note: res.Note, ETag: header.Get("ETag")}, err
+}
+
+// Purge permanently deletes a note that is in the trash
+func (c *NotesClient) Purge(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, fmt.Sprintf("/1/my/trash/%s", url.PathEscape(id)), nil, nil, nil)
+	return err
+}
+
+func ifMatch(etag string) http.Header {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	return header
+}
+
+func notePath(id string) string {
+	return fmt.Sprintf("/1/my/note/%s.json", url.PathEscape(id))
+}
+
+// Follow "next" until we run out of pages
+func (c *NotesClient) all(ctx context.Context, path string, params url.Values) (model.Notes, error) {
+	notes := model.Notes{}
+	offset := 0
+	for {
+		page, next, err := c.page(ctx, path, params, offset)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, page...)
+		if next == 0 {
+			return notes, nil
+		}
+		offset = next
+	}
+}
+
+func (c *NotesClient) page(ctx context.Context, path string, params url.Values, offset int) (model.Notes, int, error) {
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("limit", strconv.Itoa(c.config.PageSize))
+	query.Set("offset", strconv.Itoa(offset))
+
+	var res notesResponse
+	if _, err := c.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, nil, &res); err != nil {
+		return nil, 0, err
+	}
+	return res.Notes, res.Next, nil
+}
+
+// do sends a request, retrying if it fails in a way that might work next time, and decodes
+// the JSON response into out (if out is not nil). It returns the response headers.
+func (c *NotesClient) do(ctx context.Context, method string, path string, header http.Header, in interface{}, out interface{}) (http.Header, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, fmt.Errorf("client: could not encode request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, method, path, header, body)
+		retry := attempt < c.config.MaxRetries
+		if err != nil {
+			// If the network failed we don't know if the server saw the request, so only
+			// retry if doing it twice would be harmless
+			if !retry || !idempotent(method, header) || ctx.Err() != nil {
+				return nil, fmt.Errorf("client: %s %s failed: %w", method, path, err)
+			}
+			if err := c.wait(ctx, attempt, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			defer res.Body.Close()
+			if out == nil || res.StatusCode == http.StatusNoContent {
+				return res.Header, nil
+			}
+			if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+				return nil, fmt.Errorf("client: could not decode response: %w", err)
+			}
+			return res.Header, nil
+		}
+
+		apiErr := decodeError(res)
+		if !retry || !retryable(method, header, res.StatusCode) {
+			return nil, apiErr
+		}
+		if err := c.wait(ctx, attempt, res.Header.Get("Retry-After")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *NotesClient) send(ctx context.Context, method string, path string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.config.BaseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", util.BasicAuthHeaderValue(c.config.Id, c.config.Password))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.http.Do(req)
+}
+
+// Sleep before the next attempt: either what the server asked for in Retry-After, or
+// exponential backoff with some jitter so that lots of clients don't retry in lockstep.
+func (c *NotesClient) wait(ctx context.Context, attempt int, retryAfter string) error {
+	delay := c.config.RetryWait << attempt
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Sending these twice has the same effect as sending them once, and gets the same response.
+// A PUT with If-Match doesn't: if the first one got through, the note's ETag has changed, so
+// the second fails with 412. Nor does DELETE, since the note is no longer there to delete and
+// the second gets 404.
+func idempotent(method string, header http.Header) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPut:
+		return header.Get("If-Match") == ""
+	}
+	return false
+}
+
+func retryable(method string, header http.Header, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		// The request was turned away before it did anything, so it's always safe to retry
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(method, header)
+	}
+	return false
+}
+
+// Turn an error response into an *Error. The API mostly responds with plain text, but we
+// also understand {"error": "..."}.
+func decodeError(res *http.Response) *Error {
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+
+	apiErr := &Error{
+		StatusCode: res.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+	var jsonErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &jsonErr) == nil && jsonErr.Error != "" {
+		apiErr.Message = jsonErr.Error
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(res.StatusCode)
+	}
+	return apiErr
+}
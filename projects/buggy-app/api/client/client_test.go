@@ -0,0 +1,328 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+var defaultConfig api.Config = api.Config{
+	Log: log.Default(),
+}
+
+// Start an httptest server running the real API handler, backed by a mock database
+func newTestServer(t *testing.T, state string) (*httptest.Server, pgxmock.PgxPoolIface) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	as := api.NewWithClients(defaultConfig, mock, auth.NewMockClient(&auth.VerifyResult{
+		State: state,
+	}))
+	server := httptest.NewServer(as.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		mock.Close()
+	})
+	return server, mock
+}
+
+func newTestClient(url string) *NotesClient {
+	return New(Config{
+		BaseUrl:   url,
+		Id:        "abc123",
+		Password:  "password",
+		RetryWait: time.Millisecond,
+	})
+}
+
+func TestGet(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	created, modified := time.Now().UTC(), time.Now().UTC()
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+		AddRow("xyz789", "abc123", "Note content #tag1", created, modified)
+	mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE id = (.+)$").WithArgs("xyz789").WillReturnRows(rows)
+
+	note, err := newTestClient(server.URL).Get(context.Background(), "xyz789")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := model.Note{Id: "xyz789", Owner: "abc123", Content: "Note content #tag1", Created: created, Modified: modified, Tags: []string{"tag1"}}
+	if !reflect.DeepEqual(expected, note.Note) {
+		t.Fatalf("expected %v, got %v", expected, note.Note)
+	}
+	if note.ETag == "" {
+		t.Fatal("expected an ETag")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+		AddRow("xyz789", "abc123", "New note", time.Now(), time.Now())
+	mock.ExpectQuery("^INSERT INTO public.note (.+) RETURNING (.+)$").WithArgs("abc123", "New note").WillReturnRows(rows)
+
+	note, err := newTestClient(server.URL).Create(context.Background(), "New note")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Id != "xyz789" || note.Content != "New note" {
+		t.Fatalf("unexpected note: %v", note)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+		AddRow("xyz789", "abc123", "Updated #new", time.Now(), time.Now())
+	mock.ExpectQuery("^UPDATE public.note SET (.+) RETURNING (.+)$").WithArgs("xyz789", "abc123", "Updated #new", int64(36)).WillReturnRows(rows)
+
+	note, err := newTestClient(server.URL).Update(context.Background(), "xyz789", `"xyz789.10"`, "Updated #new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Content != "Updated #new" || !reflect.DeepEqual(note.Tags, []string{"new"}) {
+		t.Fatalf("unexpected note: %v", note)
+	}
+	if note.ETag == `"xyz789.10"` {
+		t.Fatal("expected a new ETag")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteNotFound(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	mock.ExpectQuery("^UPDATE public.note SET deleted_at (.+)$").WithArgs("xyz789", "abc123", int64(0)).WillReturnRows(mock.NewRows([]string{"id"}))
+
+	err := newTestClient(server.URL).Delete(context.Background(), "xyz789", "*")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected *Error with status %d, got %v", http.StatusNotFound, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteConflict(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	mock.ExpectQuery("^UPDATE public.note SET deleted_at (.+)$").WithArgs("xyz789", "abc123", int64(36)).WillReturnRows(mock.NewRows([]string{"id"}))
+	mock.ExpectQuery("^SELECT EXISTS (.+)$").WithArgs("xyz789", "abc123").WillReturnRows(mock.NewRows([]string{"exists"}).AddRow(true))
+
+	err := newTestClient(server.URL).Delete(context.Background(), "xyz789", `"xyz789.10"`)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	server, _ := newTestServer(t, auth.StateDeny)
+
+	_, err := newTestClient(server.URL).List(context.Background())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	// Each page is a separate request, so the query runs once per page
+	for i := 0; i < 2; i++ {
+		rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+			AddRow("n1", "abc123", "One", time.Now(), time.Now()).
+			AddRow("n2", "abc123", "Two", time.Now(), time.Now()).
+			AddRow("n3", "abc123", "Three", time.Now(), time.Now())
+		mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE owner = (.+) AND deleted_at IS NULL ORDER BY created, id$").WillReturnRows(rows)
+	}
+
+	c := newTestClient(server.URL)
+	c.config.PageSize = 2
+	notes, err := c.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, n := range notes {
+		ids = append(ids, n.Id)
+	}
+	if !reflect.DeepEqual(ids, []string{"n1", "n2", "n3"}) {
+		t.Fatalf("expected all three notes, got %v", ids)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+		AddRow("n1", "abc123", "Meeting #work", time.Now(), time.Now()).
+		AddRow("n2", "abc123", "Meeting #home", time.Now(), time.Now())
+	mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE owner = (.+) AND content ILIKE (.+)$").
+		WithArgs("abc123", "%meeting%").
+		WillReturnRows(rows)
+
+	notes, err := newTestClient(server.URL).Search(context.Background(), "meeting", "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Id != "n1" {
+		t.Fatalf("expected only n1, got %v", notes)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls += 1
+		if calls < 3 {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"note":{"id":"xyz789"}}`))
+	}))
+	defer server.Close()
+
+	note, err := newTestClient(server.URL).Get(context.Background(), "xyz789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Id != "xyz789" {
+		t.Fatalf("unexpected note: %v", note)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestNoRetryForCreate(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls += 1
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(server.URL).Create(context.Background(), "New note")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected *Error with status %d, got %v", http.StatusServiceUnavailable, err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestNoRetryForConditionalOrDelete(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls += 1
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}))
+	defer server.Close()
+	c := newTestClient(server.URL)
+
+	requests := map[string]func() error{
+		"update": func() error {
+			_, err := c.Update(context.Background(), "xyz789", `"abc"`, "New content")
+			return err
+		},
+		"delete": func() error { return c.Delete(context.Background(), "xyz789", "*") },
+		"purge":  func() error { return c.Purge(context.Background(), "xyz789") },
+	}
+	for name, request := range requests {
+		calls = 0
+		err := request()
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+			t.Fatalf("%s: expected *Error with status %d, got %v", name, http.StatusBadGateway, err)
+		}
+		if calls != 1 {
+			t.Fatalf("%s: expected 1 call, got %d", name, calls)
+		}
+	}
+}
+
+func TestErrorDecodesJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"content is too long"}`))
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(server.URL).Create(context.Background(), "New note")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Message != "content is too long" {
+		t.Fatalf("expected decoded error message, got %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+		AddRow("xyz789", "abc123", "Back again", time.Now(), time.Now())
+	mock.ExpectQuery("^UPDATE public.note SET deleted_at = NULL (.+)$").WithArgs("xyz789", "abc123").WillReturnRows(rows)
+
+	note, err := newTestClient(server.URL).Restore(context.Background(), "xyz789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Id != "xyz789" || note.ETag == "" {
+		t.Fatalf("unexpected note: %v", note)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeNotFound(t *testing.T) {
+	server, mock := newTestServer(t, auth.StateAllow)
+
+	mock.ExpectQuery("^WITH purged AS (.+)$").WithArgs("xyz789", "abc123").WillReturnRows(mock.NewRows([]string{"count", "array"}).AddRow(int64(0), []string{}))
+
+	err := newTestClient(server.URL).Purge(context.Background(), "xyz789")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
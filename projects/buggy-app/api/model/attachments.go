@@ -0,0 +1,175 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Files can be attached to notes. Only the metadata is kept here: the bytes are in a blob
+// store, under BlobKey. Attachments go when their note is purged from the trash.
+
+type Attachment struct {
+	Id          string    `json:"id"`
+	Note        string    `json:"note"`
+	Owner       string    `json:"owner"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
+	// Where the bytes are kept. This is internal, so it's never sent to clients.
+	BlobKey string `json:"-"`
+}
+
+// Record an attachment on one of the owner's notes. ErrNotFound is returned if the owner has
+// no such note, or it is in the trash.
+func CreateAttachment(ctx context.Context, conn Conn, owner string, attachment Attachment) (Attachment, error) {
+	var created Attachment
+	if owner == "" {
+		return created, errors.New("model: owner not supplied")
+	}
+	if attachment.Note == "" {
+		return created, errors.New("model: note not supplied")
+	}
+
+	// Inserting from a SELECT of the note means there's nothing to insert if the note isn't
+	// the owner's, without a separate check that could race with a delete
+	row := conn.QueryRow(ctx,
+		`INSERT INTO public.attachment (note, owner, filename, content_type, size, blob_key)
+		SELECT id, owner, $3, $4, $5, $6 FROM public.note WHERE id = $1 AND owner = $2 AND deleted_at IS NULL
+		RETURNING id, note, owner, filename, content_type, size, blob_key, created`,
+		attachment.Note, owner, attachment.Filename, attachment.ContentType, attachment.Size, attachment.BlobKey,
+	)
+
+	err := scanAttachment(row, &created)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return created, ErrNotFound
+		}
+		return created, fmt.Errorf("model: insert scan failed: %w", err)
+	}
+	return created, nil
+}
+
+// List the attachments on one of the owner's notes, oldest first. ErrNotFound is returned if
+// the owner has no such note, or it is in the trash.
+func GetAttachmentsForNote(ctx context.Context, conn Conn, owner string, note string) ([]Attachment, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+	if note == "" {
+		return nil, errors.New("model: note not supplied")
+	}
+
+	// The note is joined so that an empty list can be told apart from a missing note
+	queryRows, err := conn.Query(ctx,
+		`SELECT a.id, a.note, a.owner, a.filename, a.content_type, a.size, a.blob_key, a.created
+		FROM public.note n LEFT JOIN public.attachment a ON a.note = n.id
+		WHERE n.id = $1 AND n.owner = $2 AND n.deleted_at IS NULL
+		ORDER BY a.created`,
+		note, owner,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not query attachments: %w", err)
+	}
+	defer queryRows.Close()
+
+	found := false
+	attachments := []Attachment{}
+	for queryRows.Next() {
+		found = true
+		var (
+			id, noteId, attOwner, filename, contentType, blobKey *string
+			size                                                 *int64
+			created                                              *time.Time
+		)
+		err = queryRows.Scan(&id, &noteId, &attOwner, &filename, &contentType, &size, &blobKey, &created)
+		if err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		// A note with no attachments comes back as one row of NULLs
+		if id == nil {
+			continue
+		}
+		attachments = append(attachments, Attachment{
+			Id:          *id,
+			Note:        *noteId,
+			Owner:       *attOwner,
+			Filename:    *filename,
+			ContentType: *contentType,
+			Size:        *size,
+			BlobKey:     *blobKey,
+			Created:     *created,
+		})
+	}
+
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return attachments, nil
+}
+
+// Get one attachment on one of the owner's notes. ErrNotFound is returned if there's no such
+// attachment, or its note is in the trash.
+func GetAttachment(ctx context.Context, conn Conn, owner string, note string, id string) (Attachment, error) {
+	var attachment Attachment
+	if owner == "" {
+		return attachment, errors.New("model: owner not supplied")
+	}
+	if note == "" || id == "" {
+		return attachment, errors.New("model: id not supplied")
+	}
+
+	row := conn.QueryRow(ctx,
+		`SELECT a.id, a.note, a.owner, a.filename, a.content_type, a.size, a.blob_key, a.created
+		FROM public.attachment a JOIN public.note n ON a.note = n.id
+		WHERE a.id = $1 AND a.note = $2 AND n.owner = $3 AND n.deleted_at IS NULL`,
+		id, note, owner,
+	)
+
+	err := scanAttachment(row, &attachment)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return attachment, ErrNotFound
+		}
+		return attachment, fmt.Errorf("model: query scan failed: %w", err)
+	}
+	return attachment, nil
+}
+
+// Delete an attachment on one of the owner's notes, returning its blob key so that the caller
+// can delete the bytes too. ErrNotFound is returned if there's no such attachment, or its note
+// is in the trash.
+func DeleteAttachment(ctx context.Context, conn Conn, owner string, note string, id string) (string, error) {
+	if owner == "" {
+		return "", errors.New("model: owner not supplied")
+	}
+	if note == "" || id == "" {
+		return "", errors.New("model: id not supplied")
+	}
+
+	var blobKey string
+	err := conn.QueryRow(ctx,
+		`DELETE FROM public.attachment a USING public.note n
+		WHERE a.note = n.id AND a.id = $1 AND a.note = $2 AND n.owner = $3 AND n.deleted_at IS NULL
+		RETURNING a.blob_key`,
+		id, note, owner,
+	).Scan(&blobKey)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("model: delete failed: %w", err)
+	}
+	return blobKey, nil
+}
+
+func scanAttachment(row pgx.Row, a *Attachment) error {
+	return row.Scan(&a.Id, &a.Note, &a.Owner, &a.Filename, &a.ContentType, &a.Size, &a.BlobKey, &a.Created)
+}
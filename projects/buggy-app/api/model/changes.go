@@ -0,0 +1,49 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ForEachNoteChangedSince calls fn with each of the owner's notes that has changed since the
+// note with the given id was modified, oldest change first. Notes in the trash are included
+// (with Deleted set), so that callers can tell that they've gone. Content isn't read.
+//
+// Notes modified at the same time are ordered by id, so (modified, id) is a position in the
+// list of changes that can be picked up from later. It's only a rough one: modified is when
+// the change's transaction started, not when it committed, so a transaction that commits late
+// can add a change before a position that has already been handed out. Notes created by an
+// import keep the modified time from the archive, so they can land anywhere in the list.
+func ForEachNoteChangedSince(ctx context.Context, conn Conn, owner string, modified time.Time, id string, fn func(Note) error) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT id, owner, created, modified, deleted_at FROM public.note WHERE owner = $1 AND (modified, id) > ($2, $3) ORDER BY modified, id",
+		owner, modified.UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("model: could not query changes: %w", err)
+	}
+	defer queryRows.Close()
+
+	for queryRows.Next() {
+		note := Note{}
+		err = queryRows.Scan(&note.Id, &note.Owner, &note.Created, &note.Modified, &note.Deleted)
+		if err != nil {
+			return fmt.Errorf("model: query scan failed: %w", err)
+		}
+		if err := fn(note); err != nil {
+			return err
+		}
+	}
+
+	if queryRows.Err() != nil {
+		return fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	return nil
+}
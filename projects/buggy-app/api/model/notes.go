@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"regexp"
 	"strings"
 	"time"
 
@@ -18,53 +17,88 @@ type Note struct {
 	Created  time.Time `json:"created"`
 	Modified time.Time `json:"modified"`
 	Tags     []string  `json:"tags"`
+	// When the note was moved to the trash. Only set for notes in the trash.
+	Deleted *time.Time `json:"deleted,omitempty"`
+	// Content as HTML. This is only filled in by the API, and only when asked for.
+	Rendered string `json:"rendered,omitempty"`
 }
 
 type Notes []Note
 
-type dbConn interface {
+var (
+	// ErrNotFound is returned when a note does not exist, is not owned by the caller, or is in
+	// (or, for trash operations, not in) the trash
+	ErrNotFound = errors.New("model: note not found")
+	// ErrConflict is returned when a note has changed since the version the caller expected
+	ErrConflict = errors.New("model: note has been modified")
+)
+
+// Version identifies a revision of a note. It changes every time the note is modified.
+func (n Note) Version() int64 {
+	return n.Modified.UnixMicro()
+}
+
+// Conn is what the model needs to talk to the database: a pool, a connection or a transaction
+type Conn interface {
 	Query(ctx context.Context, sql string, optionsAndArgs ...interface{}) (pgx.Rows, error)
 	QueryRow(context.Context, string, ...interface{}) pgx.Row
 }
 
-func GetNotesForOwner(ctx context.Context, conn dbConn, owner string) (Notes, error) {
+func GetNotesForOwner(ctx context.Context, conn Conn, owner string) (Notes, error) {
+	notes := []Note{}
+	err := ForEachNoteForOwner(ctx, conn, owner, func(note Note) error {
+		notes = append(notes, note)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// ForEachNoteForOwner calls fn with each of the owner's notes as they are read from the
+// database, so that they never all have to be in memory at once. If fn returns an error,
+// iteration stops and that error is returned. Notes come oldest first, with the id breaking
+// ties, so that the same offset always finds the same place in the list.
+func ForEachNoteForOwner(ctx context.Context, conn Conn, owner string, fn func(Note) error) error {
 	if owner == "" {
-		return nil, errors.New("model: owner not supplied")
+		return errors.New("model: owner not supplied")
 	}
 
-	queryRows, err := conn.Query(ctx, "SELECT id, owner, content, created, modified FROM public.note")
+	queryRows, err := conn.Query(ctx, "SELECT id, owner, content, created, modified FROM public.note WHERE owner = $1 AND deleted_at IS NULL ORDER BY created, id", owner)
 	if err != nil {
-		return nil, fmt.Errorf("model: could not query notes: %w", err)
+		return fmt.Errorf("model: could not query notes: %w", err)
 	}
 	defer queryRows.Close()
 
-	notes := []Note{}
 	for queryRows.Next() {
 		note := Note{}
 		err = queryRows.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
 		if err != nil {
-			return nil, fmt.Errorf("model: query scan failed: %w", err)
+			return fmt.Errorf("model: query scan failed: %w", err)
 		}
 		if note.Owner == owner {
 			note.Tags = extractTags(note.Content)
-			notes = append(notes, note)
+			if err := fn(note); err != nil {
+				return err
+			}
 		}
 	}
 
 	if queryRows.Err() != nil {
-		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+		return fmt.Errorf("model: query read failed: %w", queryRows.Err())
 	}
 
-	return notes, nil
+	return nil
 }
 
-func GetNoteById(ctx context.Context, conn dbConn, id string) (Note, error) {
+func GetNoteById(ctx context.Context, conn Conn, id string) (Note, error) {
 	var note Note
 	if id == "" {
 		return note, errors.New("model: id not supplied")
 	}
 
-	row := conn.QueryRow(ctx, "SELECT id, owner, content, created, modified FROM public.note WHERE id = $1", id)
+	row := conn.QueryRow(ctx, "SELECT id, owner, content, created, modified FROM public.note WHERE id = $1 AND deleted_at IS NULL", id)
 
 	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
 	if err != nil {
@@ -74,14 +108,219 @@ func GetNoteById(ctx context.Context, conn dbConn, id string) (Note, error) {
 	return note, nil
 }
 
-// Extract tags from the note. We're looking for #something. There could be
-// multiple tags, so we FindAll.
-func extractTags(input string) []string {
-	re := regexp.MustCompile(`#([^#]+)`)
-	matches := re.FindAllStringSubmatch(input, -1)
-	tags := make([]string, 0, len(matches))
-	for _, f := range matches {
-		tags = append(tags, strings.TrimSpace(f[1]))
+// NoteExists reports whether the owner has a note with the id that isn't in the trash
+func NoteExists(ctx context.Context, conn Conn, owner string, id string) (bool, error) {
+	if owner == "" {
+		return false, errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return false, errors.New("model: id not supplied")
+	}
+
+	var exists bool
+	err := conn.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM public.note WHERE id = $1 AND owner = $2 AND deleted_at IS NULL)",
+		id, owner,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("model: query scan failed: %w", err)
+	}
+	return exists, nil
+}
+
+// Create a new note for the owner, returning the stored note (with its generated ID)
+func CreateNote(ctx context.Context, conn Conn, owner string, content string) (Note, error) {
+	var note Note
+	if owner == "" {
+		return note, errors.New("model: owner not supplied")
+	}
+
+	row := conn.QueryRow(ctx,
+		"INSERT INTO public.note (owner, content) VALUES ($1, $2) RETURNING id, owner, content, created, modified",
+		owner, content,
+	)
+
+	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	if err != nil {
+		return note, fmt.Errorf("model: insert scan failed: %w", err)
+	}
+	note.Tags = extractTags(note.Content)
+	return note, nil
+}
+
+// Replace the content of a note. The note must be owned by owner, otherwise ErrNotFound
+// is returned. If version is not 0, the note is only updated if its Version() still matches,
+// otherwise ErrConflict is returned.
+func UpdateNote(ctx context.Context, conn Conn, owner string, id string, content string, version int64) (Note, error) {
+	var note Note
+	if owner == "" {
+		return note, errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return note, errors.New("model: id not supplied")
+	}
+
+	row := conn.QueryRow(ctx,
+		"UPDATE public.note SET content = $3 WHERE id = $1 AND owner = $2 AND deleted_at IS NULL AND "+matchesVersion("$4")+" RETURNING id, owner, content, created, modified",
+		id, owner, content, version,
+	)
+
+	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return note, notFoundOrConflict(ctx, conn, owner, id, version)
+		}
+		return note, fmt.Errorf("model: update scan failed: %w", err)
+	}
+	note.Tags = extractTags(note.Content)
+	return note, nil
+}
+
+// Delete a note by moving it to the trash, where it can be restored from until it is purged
+// (see trash.go). The note must be owned by owner, otherwise ErrNotFound is returned. If version
+// is not 0, the note is only deleted if its Version() still matches, otherwise ErrConflict is
+// returned.
+func DeleteNote(ctx context.Context, conn Conn, owner string, id string, version int64) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return errors.New("model: id not supplied")
+	}
+
+	// RETURNING lets us use QueryRow to find out whether anything was deleted
+	var deleted string
+	err := conn.QueryRow(ctx,
+		"UPDATE public.note SET deleted_at = current_timestamp WHERE id = $1 AND owner = $2 AND deleted_at IS NULL AND "+matchesVersion("$3")+" RETURNING id",
+		id, owner, version,
+	).Scan(&deleted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return notFoundOrConflict(ctx, conn, owner, id, version)
+		}
+		return fmt.Errorf("model: delete failed: %w", err)
+	}
+	return nil
+}
+
+// ImportNote stores a note from an export. If id is one of the owner's notes its content is
+// replaced, otherwise a new note is created, keeping the created and modified times if they
+// are not zero. created is true if a new note was made.
+func ImportNote(ctx context.Context, conn Conn, owner string, id string, content string, createdAt time.Time, modifiedAt time.Time) (note Note, created bool, err error) {
+	if owner == "" {
+		return note, false, errors.New("model: owner not supplied")
+	}
+
+	if id != "" {
+		note, err = UpdateNote(ctx, conn, owner, id, content, 0)
+		if !errors.Is(err, ErrNotFound) {
+			return note, false, err
+		}
+	}
+
+	// The ID is always generated, because the note may have come from someone else's export
+	row := conn.QueryRow(ctx,
+		"INSERT INTO public.note (owner, content, created, modified) VALUES ($1, $2, COALESCE($3::timestamp, current_timestamp), COALESCE($4::timestamp, current_timestamp)) RETURNING id, owner, content, created, modified",
+		owner, content, nullTime(createdAt), nullTime(modifiedAt),
+	)
+
+	err = row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	if err != nil {
+		return note, false, fmt.Errorf("model: insert scan failed: %w", err)
+	}
+	note.Tags = extractTags(note.Content)
+	return note, true, nil
+}
+
+// A zero time is sent to the database as NULL
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// SQL condition for "version is 0 or matches the note's Version()". The version is microseconds
+// since the Unix epoch, and adding it to the epoch as an interval keeps it exact (no floating
+// point, no time zones).
+func matchesVersion(param string) string {
+	return fmt.Sprintf("(%[1]s::bigint = 0 OR modified = 'epoch'::timestamp + %[1]s::bigint * interval '1 microsecond')", param)
+}
+
+// When an update or delete matched no rows, work out whether that's because the note doesn't
+// exist or because it didn't match the version.
+func notFoundOrConflict(ctx context.Context, conn Conn, owner string, id string, version int64) error {
+	if version == 0 {
+		return ErrNotFound
+	}
+	var exists bool
+	err := conn.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM public.note WHERE id = $1 AND owner = $2 AND deleted_at IS NULL)",
+		id, owner,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("model: exists query failed: %w", err)
+	}
+	if exists {
+		return ErrConflict
+	}
+	return ErrNotFound
+}
+
+// Search the owner's notes for ones that contain query (case-insensitive). If tag is supplied,
+// only notes with that tag are returned. Either can be empty.
+func SearchNotesForOwner(ctx context.Context, conn Conn, owner string, query string, tag string) (Notes, error) {
+	notes := []Note{}
+	err := ForEachSearchResult(ctx, conn, owner, query, tag, func(note Note) error {
+		notes = append(notes, note)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// ForEachSearchResult is like SearchNotesForOwner, but calls fn with each note as it is read
+// from the database rather than collecting them.
+func ForEachSearchResult(ctx context.Context, conn Conn, owner string, query string, tag string, fn func(Note) error) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT id, owner, content, created, modified FROM public.note WHERE owner = $1 AND deleted_at IS NULL AND content ILIKE $2 ORDER BY created, id",
+		owner, "%"+escapeLike(query)+"%",
+	)
+	if err != nil {
+		return fmt.Errorf("model: could not search notes: %w", err)
 	}
-	return tags
+	defer queryRows.Close()
+
+	for queryRows.Next() {
+		note := Note{}
+		err = queryRows.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+		if err != nil {
+			return fmt.Errorf("model: query scan failed: %w", err)
+		}
+		note.Tags = extractTags(note.Content)
+		if tag != "" && !hasTag(note.Tags, tag) {
+			continue
+		}
+		if err := fn(note); err != nil {
+			return err
+		}
+	}
+
+	if queryRows.Err() != nil {
+		return fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	return nil
+}
+
+// The characters %, _ and \ have special meaning in a LIKE pattern, so they need escaping
+// if we want to match them literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
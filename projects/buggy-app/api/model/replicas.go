@@ -0,0 +1,207 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Reads can be spread over streaming replicas of the primary database, while writes always go to
+// the primary. Replicas are a little behind the primary, so:
+//
+//   - a user who has just written reads from the primary for a while afterwards, so that they
+//     see their own change (read-your-writes)
+//   - replicas are checked regularly, and one that can't be reached or is too far behind isn't
+//     used until it catches up
+//   - if no replica is healthy, reads go to the primary
+//
+// Who has written recently is only known to this process, so with more than one API replica
+// behind a load balancer, a user's requests should stick to one of them for read-your-writes to
+// hold.
+
+// ReplicaConfig is how reads are routed between replicas and the primary
+type ReplicaConfig struct {
+	// How long a user reads from the primary after writing. A replica can be up to MaxLag
+	// behind, so this is never less than MaxLag.
+	ReadYourWrites time.Duration
+	// Replicas further behind the primary than this aren't used
+	MaxLag time.Duration
+	// How often replicas are checked
+	CheckInterval time.Duration
+}
+
+const (
+	defaultReadYourWrites = 10 * time.Second
+	defaultMaxLag         = 10 * time.Second
+	defaultCheckInterval  = 5 * time.Second
+	// How long a replica has to answer a check
+	replicaCheckTimeout = 2 * time.Second
+)
+
+// How far behind the primary a replica is. When it's streaming from the primary and has replayed
+// everything it has received, it's up to date, however long ago the last transaction was.
+// Otherwise (say the primary can't be reached) it's as far behind as its last transaction, and
+// NULL if it hasn't replayed one at all. Roles without pg_read_all_stats can see that there's a
+// WAL receiver but not its status, so for them a running receiver counts as streaming.
+const replicaLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() THEN 0
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn()
+		AND EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE COALESCE(status, 'streaming') = 'streaming') THEN 0
+	ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) * 1000000
+END::bigint`
+
+type replica struct {
+	conn    Conn
+	healthy atomic.Bool
+}
+
+// Replicas routes reads to healthy replicas. A nil *Replicas routes everything to the primary.
+type Replicas struct {
+	config   ReplicaConfig
+	replicas []*replica
+	next     atomic.Uint32
+
+	mu sync.Mutex
+	// When each owner last wrote
+	writes map[string]time.Time
+	now    func() time.Time
+}
+
+// NewReplicas routes reads between the given replicas. They aren't used until they've been
+// checked by Run.
+func NewReplicas(conns []Conn, config ReplicaConfig) *Replicas {
+	if config.ReadYourWrites <= 0 {
+		config.ReadYourWrites = defaultReadYourWrites
+	}
+	if config.MaxLag <= 0 {
+		config.MaxLag = defaultMaxLag
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = defaultCheckInterval
+	}
+	if config.ReadYourWrites < config.MaxLag {
+		config.ReadYourWrites = config.MaxLag
+	}
+
+	rs := &Replicas{config: config, writes: map[string]time.Time{}, now: time.Now}
+	for _, conn := range conns {
+		rs.replicas = append(rs.replicas, &replica{conn: conn})
+	}
+	return rs
+}
+
+// Read returns where to read the owner's data from: a healthy replica, or the primary if the
+// owner has written recently or no replica is healthy
+func (rs *Replicas) Read(primary Conn, owner string) Conn {
+	if rs == nil || len(rs.replicas) == 0 || rs.wroteRecently(owner) {
+		return primary
+	}
+
+	// Round robin, skipping unhealthy replicas
+	start := rs.next.Add(1)
+	for i := 0; i < len(rs.replicas); i++ {
+		r := rs.replicas[(int(start)+i)%len(rs.replicas)]
+		if r.healthy.Load() {
+			return r.conn
+		}
+	}
+	return primary
+}
+
+// Wrote records that the owner is writing, so that they read from the primary for a while
+func (rs *Replicas) Wrote(owner string) {
+	if rs == nil || len(rs.replicas) == 0 {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.writes[owner] = rs.now()
+}
+
+func (rs *Replicas) wroteRecently(owner string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	wrote, ok := rs.writes[owner]
+	if !ok {
+		return false
+	}
+	if rs.now().Sub(wrote) >= rs.config.ReadYourWrites {
+		delete(rs.writes, owner)
+		return false
+	}
+	return true
+}
+
+// Run checks the replicas every CheckInterval until ctx is done
+func (rs *Replicas) Run(ctx context.Context, logf func(format string, v ...interface{})) {
+	if rs == nil || len(rs.replicas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(rs.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		rs.Check(ctx, logf)
+		rs.forgetWrites()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check checks each replica once, logging any that stop or start being used
+func (rs *Replicas) Check(ctx context.Context, logf func(format string, v ...interface{})) {
+	var wg sync.WaitGroup
+	for i, r := range rs.replicas {
+		wg.Add(1)
+		go func(i int, r *replica) {
+			defer wg.Done()
+			err := rs.check(ctx, r)
+			healthy := err == nil
+			if r.healthy.Swap(healthy) != healthy {
+				if healthy {
+					logf("model: replica %d is healthy", i)
+				} else {
+					logf("model: replica %d is unhealthy: %v", i, err)
+				}
+			}
+		}(i, r)
+	}
+	wg.Wait()
+}
+
+func (rs *Replicas) check(ctx context.Context, r *replica) error {
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+
+	var lagMicros pgtype.Int8
+	if err := r.conn.QueryRow(ctx, replicaLagQuery).Scan(&lagMicros); err != nil {
+		return err
+	}
+	if !lagMicros.Valid {
+		return errors.New("not streaming and hasn't replayed anything")
+	}
+	if lag := time.Duration(lagMicros.Int64) * time.Microsecond; lag > rs.config.MaxLag {
+		return fmt.Errorf("%v behind the primary", lag)
+	}
+	return nil
+}
+
+// Forget writes that are too old to matter, so that the map doesn't grow forever
+func (rs *Replicas) forgetWrites() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := rs.now()
+	for owner, wrote := range rs.writes {
+		if now.Sub(wrote) >= rs.config.ReadYourWrites {
+			delete(rs.writes, owner)
+		}
+	}
+}
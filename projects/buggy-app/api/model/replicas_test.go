@@ -0,0 +1,166 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+func newMockReplicas(t *testing.T, n int) ([]pgxmock.PgxPoolIface, *Replicas) {
+	mocks := []pgxmock.PgxPoolIface{}
+	conns := []Conn{}
+	for i := 0; i < n; i++ {
+		mock, err := pgxmock.NewPool()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		t.Cleanup(mock.Close)
+		mocks = append(mocks, mock)
+		conns = append(conns, mock)
+	}
+	return mocks, NewReplicas(conns, ReplicaConfig{})
+}
+
+func expectLag(mock pgxmock.PgxPoolIface, lag time.Duration) {
+	mock.ExpectQuery("SELECT CASE").WillReturnRows(pgxmock.NewRows([]string{"lag"}).AddRow(lag.Microseconds()))
+}
+
+func TestReplicasReadFromPrimaryWithoutReplicas(t *testing.T) {
+	primary, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	var rs *Replicas
+	if rs.Read(primary, "abc123") != primary {
+		t.Fatal("expected a nil *Replicas to read from the primary")
+	}
+	rs.Wrote("abc123")
+
+	rs = NewReplicas(nil, ReplicaConfig{})
+	if rs.Read(primary, "abc123") != primary {
+		t.Fatal("expected no replicas to read from the primary")
+	}
+}
+
+func TestReplicasRoundRobin(t *testing.T) {
+	primary, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	mocks, rs := newMockReplicas(t, 2)
+
+	// Replicas aren't used until they've been checked
+	if rs.Read(primary, "abc123") != primary {
+		t.Fatal("expected unchecked replicas not to be used")
+	}
+
+	for _, mock := range mocks {
+		expectLag(mock, 0)
+	}
+	rs.Check(context.Background(), t.Logf)
+
+	first := rs.Read(primary, "abc123")
+	second := rs.Read(primary, "abc123")
+	if first == primary || second == primary || first == second {
+		t.Fatalf("expected reads to alternate between the replicas")
+	}
+
+	for _, mock := range mocks {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+func TestReplicasReadYourWrites(t *testing.T) {
+	primary, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	mocks, rs := newMockReplicas(t, 1)
+	now := time.Now()
+	rs.now = func() time.Time { return now }
+
+	expectLag(mocks[0], 0)
+	rs.Check(context.Background(), t.Logf)
+
+	rs.Wrote("abc123")
+	if rs.Read(primary, "abc123") != primary {
+		t.Fatal("expected the writer to read from the primary")
+	}
+	if rs.Read(primary, "def456") != mocks[0] {
+		t.Fatal("expected other users to read from the replica")
+	}
+
+	now = now.Add(defaultReadYourWrites)
+	if rs.Read(primary, "abc123") != mocks[0] {
+		t.Fatal("expected the writer to read from the replica after the window")
+	}
+}
+
+func TestReplicasReadYourWritesCoversMaxLag(t *testing.T) {
+	rs := NewReplicas(nil, ReplicaConfig{ReadYourWrites: time.Second, MaxLag: time.Minute})
+	if rs.config.ReadYourWrites != time.Minute {
+		t.Fatalf("expected the read-your-writes window to be raised to %v, got %v", time.Minute, rs.config.ReadYourWrites)
+	}
+}
+
+func TestReplicasFailover(t *testing.T) {
+	primary, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	mocks, rs := newMockReplicas(t, 2)
+
+	// One is too far behind, and the other can't be reached
+	expectLag(mocks[0], time.Minute)
+	mocks[1].ExpectQuery("SELECT CASE").WillReturnError(errors.New("connection refused"))
+	rs.Check(context.Background(), t.Logf)
+	if rs.Read(primary, "abc123") != primary {
+		t.Fatal("expected unhealthy replicas not to be used")
+	}
+
+	// The first catches up
+	expectLag(mocks[0], time.Second)
+	mocks[1].ExpectQuery("SELECT CASE").WillReturnError(errors.New("connection refused"))
+	rs.Check(context.Background(), t.Logf)
+	for i := 0; i < 3; i++ {
+		if rs.Read(primary, "abc123") != mocks[0] {
+			t.Fatal("expected the healthy replica to be used")
+		}
+	}
+
+	for _, mock := range mocks {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+func TestReplicasNothingReplayed(t *testing.T) {
+	primary, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	mocks, rs := newMockReplicas(t, 1)
+
+	// A replica that isn't streaming and has never replayed a transaction has no lag to report
+	mocks[0].ExpectQuery("SELECT CASE").WillReturnRows(pgxmock.NewRows([]string{"lag"}).AddRow(nil))
+	rs.Check(context.Background(), t.Logf)
+	if rs.Read(primary, "abc123") != primary {
+		t.Fatal("expected a replica with unknown lag not to be used")
+	}
+
+	if err := mocks[0].ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,138 @@
+package model
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+	"github.com/jackc/pgx/v5"
+)
+
+// Postgres enforces who can see and change notes with row-level security: a policy on
+// public.note only lets a connection at the notes owned by the user in its app.current_user
+// setting. The API connects as the app role, which the policy applies to, and RowSecurity sets
+// app.current_user to the authenticated user in the context (see authuserctx) for every
+// statement and transaction it runs.
+//
+// The setting is local to a transaction, so it can't leak to the next user of a pooled
+// connection. A single statement is sent in a batch after set_config, which Postgres runs as
+// one implicit transaction, so it doesn't cost another round trip.
+//
+// Without an authenticated user, nothing is set, and no notes can be seen. There's no way past the
+// policy for the app role: purging the trash, which works on every user's notes, calls a function
+// that runs as postgres instead (see PurgeDeletedNotes).
+
+// DB is a pool of connections to run statements and transactions on
+type DB interface {
+	Conn
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Ping(ctx context.Context) error
+	Close()
+}
+
+// RowSecurity wraps db so that each statement and transaction is run as the user in its context
+func RowSecurity(db DB) DB {
+	return &rowSecurity{db}
+}
+
+type rowSecurity struct {
+	DB
+}
+
+// The statement that sets who the transaction is for. Passing true for is_local means it only
+// lasts until the end of the transaction.
+func setUser(ctx context.Context) (string, []interface{}, bool) {
+	if owner, ok := authuserctx.FromAuthenticatedContext(ctx); ok {
+		return "SELECT set_config('app.current_user', $1, true)", []interface{}{owner}, true
+	}
+	return "", nil, false
+}
+
+func (rs *rowSecurity) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	setSql, setArgs, ok := setUser(ctx)
+	if !ok {
+		return rs.DB.Query(ctx, sql, args...)
+	}
+
+	b := &pgx.Batch{}
+	b.Queue(setSql, setArgs...)
+	b.Queue(sql, args...)
+	br := rs.DB.SendBatch(ctx, b)
+	if _, err := br.Exec(); err != nil {
+		br.Close()
+		return nil, fmt.Errorf("model: setting user failed: %w", err)
+	}
+	rows, err := br.Query()
+	if err != nil {
+		br.Close()
+		return nil, err
+	}
+	return &batchRows{Rows: rows, br: br}, nil
+}
+
+func (rs *rowSecurity) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	rows, err := rs.Query(ctx, sql, args...)
+	return &row{rows: rows, err: err}
+}
+
+func (rs *rowSecurity) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := rs.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if setSql, setArgs, ok := setUser(ctx); ok {
+		if _, err := tx.Exec(ctx, setSql, setArgs...); err != nil {
+			tx.Rollback(ctx)
+			return nil, fmt.Errorf("model: setting user failed: %w", err)
+		}
+	}
+	return tx, nil
+}
+
+// batchRows are the rows of the statement in a batch. The batch has to be closed after them,
+// to give back its connection.
+type batchRows struct {
+	pgx.Rows
+	br  pgx.BatchResults
+	err error
+}
+
+func (r *batchRows) Close() {
+	r.Rows.Close()
+	if err := r.br.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *batchRows) Err() error {
+	if err := r.Rows.Err(); err != nil {
+		return err
+	}
+	return r.err
+}
+
+// row is the first row of some rows, like pgx's own QueryRow
+type row struct {
+	rows pgx.Rows
+	err  error
+}
+
+func (r *row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return pgx.ErrNoRows
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	r.rows.Close()
+	return r.rows.Err()
+}
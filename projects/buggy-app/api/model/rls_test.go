@@ -0,0 +1,177 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+// pgxmock doesn't support batches, so batchDB fakes them. The batch's last statement is run on
+// the mock, so that its rows can be set up as usual.
+type batchDB struct {
+	pgxmock.PgxPoolIface
+	batches []*fakeBatch
+	setErr  error
+}
+
+func (db *batchDB) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	batch := &fakeBatch{ctx: ctx, db: db, len: b.Len()}
+	db.batches = append(db.batches, batch)
+	return batch
+}
+
+type fakeBatch struct {
+	ctx    context.Context
+	db     *batchDB
+	len    int
+	execs  int
+	closed bool
+}
+
+func (b *fakeBatch) Exec() (pgconn.CommandTag, error) {
+	b.execs++
+	return pgconn.CommandTag{}, b.db.setErr
+}
+
+func (b *fakeBatch) Query() (pgx.Rows, error) {
+	return b.db.PgxPoolIface.Query(b.ctx, "SELECT from the batch")
+}
+
+func (b *fakeBatch) QueryRow() pgx.Row {
+	return b.db.PgxPoolIface.QueryRow(b.ctx, "SELECT from the batch")
+}
+
+func (b *fakeBatch) Close() error {
+	b.closed = true
+	return nil
+}
+
+func newBatchDB(t *testing.T) *batchDB {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(mock.Close)
+	return &batchDB{PgxPoolIface: mock}
+}
+
+func TestRowSecurityQueryAsUser(t *testing.T) {
+	db := newBatchDB(t)
+	ctx := authuserctx.NewAuthenticatedContext(context.Background(), "abc123")
+
+	db.ExpectQuery("SELECT from the batch").WillReturnRows(db.NewRows([]string{"id"}).AddRow("xyz789"))
+
+	var id string
+	if err := RowSecurity(db).QueryRow(ctx, "SELECT id FROM public.note").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if id != "xyz789" {
+		t.Fatalf("expected xyz789, got %s", id)
+	}
+
+	if len(db.batches) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(db.batches))
+	}
+	batch := db.batches[0]
+	if batch.len != 2 || batch.execs != 1 {
+		t.Fatalf("expected set_config then the statement, got %d statements with %d execs", batch.len, batch.execs)
+	}
+	if !batch.closed {
+		t.Fatal("expected the batch to be closed")
+	}
+	if err := db.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRowSecurityNoRows(t *testing.T) {
+	db := newBatchDB(t)
+	ctx := authuserctx.NewAuthenticatedContext(context.Background(), "abc123")
+
+	db.ExpectQuery("SELECT from the batch").WillReturnRows(db.NewRows([]string{"id"}))
+
+	var id string
+	err := RowSecurity(db).QueryRow(ctx, "SELECT id FROM public.note WHERE id = $1", "xyz789").Scan(&id)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected pgx.ErrNoRows, got %v", err)
+	}
+	if !db.batches[0].closed {
+		t.Fatal("expected the batch to be closed")
+	}
+}
+
+func TestRowSecuritySetFails(t *testing.T) {
+	db := newBatchDB(t)
+	db.setErr = errors.New("permission denied")
+	ctx := authuserctx.NewAuthenticatedContext(context.Background(), "abc123")
+
+	_, err := RowSecurity(db).Query(ctx, "SELECT id FROM public.note")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !db.batches[0].closed {
+		t.Fatal("expected the batch to be closed")
+	}
+}
+
+func TestRowSecurityWithoutUser(t *testing.T) {
+	db := newBatchDB(t)
+
+	// Statements without a user are sent as they are, and Postgres shows them no notes
+	db.ExpectQuery("SELECT id FROM public.note").WillReturnRows(db.NewRows([]string{"id"}))
+
+	rows, err := RowSecurity(db).Query(context.Background(), "SELECT id FROM public.note")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	if len(db.batches) != 0 {
+		t.Fatalf("expected no batches, got %d", len(db.batches))
+	}
+	if err := db.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRowSecurityBegin(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		expected string
+		args     []interface{}
+	}{
+		{
+			name:     "user",
+			ctx:      authuserctx.NewAuthenticatedContext(context.Background(), "abc123"),
+			expected: `set_config\('app.current_user', \$1, true\)`,
+			args:     []interface{}{"abc123"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newBatchDB(t)
+			db.ExpectBegin()
+			db.ExpectExec(tt.expected).WithArgs(tt.args...).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+			db.ExpectCommit()
+
+			tx, err := RowSecurity(db).Begin(tt.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(tt.ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
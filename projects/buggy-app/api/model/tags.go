@@ -0,0 +1,207 @@
+package model
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+)
+
+// Tags are words in a note that start with #. The rules are:
+//
+//   - A tag is made of letters (in any language) and digits, and must contain at least one
+//     letter, so "#1" isn't a tag
+//   - Tags can contain _, - and /, but not at the end: "#snake_case", "#well-known" and
+//     "#project/alpha" are tags, and "#tag/" is just "tag"
+//   - The # must start a word, so "C#" and "example.com/#fragment" aren't tags
+//   - Nothing in `code` or fenced code blocks is a tag
+//   - Tags are case-insensitive: "#Work" and "#work" are the same tag, and a note's tags are
+//     listed once each, spelled the way they first appear
+//   - / makes a hierarchy: searching for "project" finds "#project/alpha" too
+
+// TagLength returns the length in bytes of the tag at the start of s (not counting the #), or
+// 0 if there isn't one. before is the character before s, or 0 if s is the start of the text.
+//
+// This is exported so that other packages (like render) find exactly the same tags.
+func TagLength(before rune, s string) int {
+	if !strings.HasPrefix(s, "#") || !tagCanFollow(before) {
+		return 0
+	}
+
+	n, end := 1, 1
+	hasLetter := false
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if isTagRune(r) {
+			hasLetter = hasLetter || unicode.IsLetter(r)
+			n += size
+			end = n
+			continue
+		}
+		// Joiners are only part of the tag if there's more tag after them
+		if r == '_' || r == '-' || r == '/' {
+			next, _ := utf8.DecodeRuneInString(s[n+size:])
+			if isTagRune(next) {
+				n += size
+				continue
+			}
+		}
+		break
+	}
+
+	if !hasLetter {
+		return 0
+	}
+	return end - 1
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// A tag has to start a word: it can come after a space, an opening bracket or quote, or
+// Markdown emphasis, but not after a letter (C#) or part of a URL (/#fragment, &#123;).
+func tagCanFollow(before rune) bool {
+	return before == 0 ||
+		unicode.IsSpace(before) ||
+		unicode.In(before, unicode.Ps, unicode.Pi) ||
+		strings.ContainsRune(`"'*_~,;`, before)
+}
+
+// Extract tags from the note, in the order they first appear
+func extractTags(input string) []string {
+	text := withoutCode(input)
+	fold := cases.Fold()
+
+	tags := []string{}
+	seen := map[string]bool{}
+	var before rune
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if n := TagLength(before, text[i:]); n > 0 {
+			tag := text[i+1 : i+1+n]
+			if key := fold.String(tag); !seen[key] {
+				seen[key] = true
+				tags = append(tags, tag)
+			}
+			before, _ = utf8.DecodeLastRuneInString(tag)
+			i += 1 + n
+			continue
+		}
+		before = r
+		i += size
+	}
+	return tags
+}
+
+// Is tag (or one of its children, like "project/alpha" for "project") in tags?
+func hasTag(tags []string, tag string) bool {
+	fold := cases.Fold()
+	tag = fold.String(tag)
+	for _, t := range tags {
+		t = fold.String(t)
+		if t == tag || strings.HasPrefix(t, tag+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Blank out fenced code blocks and `code spans`, so that things like #include in code
+// aren't mistaken for tags. Code spans are replaced with a single backtick, so that a tag
+// straight after one isn't treated as starting a word (which is how Markdown sees it too).
+func withoutCode(input string) string {
+	var out strings.Builder
+	// The fence that opened the code block we're in, if any
+	fence := ""
+	for _, line := range strings.SplitAfter(input, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		indented := len(line)-len(trimmed) >= 4
+		if fence != "" {
+			if !indented && isClosingFence(trimmed, fence) {
+				fence = ""
+			}
+			if strings.HasSuffix(line, "\n") {
+				out.WriteString("\n")
+			}
+			continue
+		}
+		if f := openingFence(trimmed); f != "" && !indented {
+			fence = f
+			out.WriteString("\n")
+			continue
+		}
+		out.WriteString(line)
+	}
+	return withoutCodeSpans(out.String())
+}
+
+// A fence is three or more backticks or tildes: ``` or ~~~
+func openingFence(line string) string {
+	if line == "" || (line[0] != '`' && line[0] != '~') {
+		return ""
+	}
+	n := runLength(line, line[0])
+	if n < 3 {
+		return ""
+	}
+	// The info string after a backtick fence can't contain backticks
+	if line[0] == '`' && strings.Contains(line[n:], "`") {
+		return ""
+	}
+	return line[:n]
+}
+
+// A block is closed by a fence of the same kind that is at least as long, with nothing after it
+func isClosingFence(line string, fence string) bool {
+	n := runLength(line, fence[0])
+	return n >= len(fence) && strings.TrimSpace(line[n:]) == ""
+}
+
+func runLength(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+// A code span starts with a run of backticks and ends with a run of the same length. A run
+// without a match is just backticks.
+func withoutCodeSpans(text string) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(text, '`')
+		if start < 0 {
+			out.WriteString(text)
+			return out.String()
+		}
+		n := runLength(text[start:], '`')
+		end := closingRun(text[start+n:], n)
+		if end < 0 {
+			out.WriteString(text[:start+n])
+			text = text[start+n:]
+			continue
+		}
+		out.WriteString(text[:start])
+		out.WriteString("`")
+		text = text[start+n+end+n:]
+	}
+}
+
+// Find a run of exactly n backticks in text
+func closingRun(text string, n int) int {
+	for i := 0; i < len(text); {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+		run := runLength(text[i:], '`')
+		if run == n {
+			return i
+		}
+		i += run
+	}
+	return -1
+}
@@ -0,0 +1,63 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractTags(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"none", "No tags here", []string{}},
+		{"word boundary", "#work meeting notes", []string{"work"}},
+		{"punctuation ends a tag", "Done (#work), then #home.", []string{"work", "home"}},
+		{"unicode letters", "#café #日本語 #naïve", []string{"café", "日本語", "naïve"}},
+		{"digits and underscores", "#v2 #snake_case", []string{"v2", "snake_case"}},
+		{"numbers aren't tags", "Issue #123", []string{}},
+		{"hyphens", "#well-known #trailing-", []string{"well-known", "trailing"}},
+		{"hierarchy", "#project/alpha #project/beta/", []string{"project/alpha", "project/beta"}},
+		{"duplicates", "#work and #work again", []string{"work"}},
+		{"case folded duplicates", "#Work #WORK #work", []string{"Work"}},
+		{"must start a word", "C# and F# and mid#word", []string{}},
+		{"adjacent", "#one#two", []string{"one"}},
+		{"url fragment", "See https://example.com/page#section and example.com/#/route", []string{}},
+		{"html entity", "&#35;notatag", []string{}},
+		{"heading", "# Heading\n## Another", []string{}},
+		{"emphasis", "**#bold** _#italic_", []string{"bold", "italic"}},
+		{"code span", "Use `#include` or ``#a ` #b`` but #real", []string{"real"}},
+		{"unclosed code span", "A ` then #tag", []string{"tag"}},
+		{"fenced code", "#before\n```c\n#include <stdio.h>\n```\n#after", []string{"before", "after"}},
+		{"tilde fence", "~~~\n#hidden\n~~~~\n#shown", []string{"shown"}},
+		{"unclosed fence", "```\n#hidden", []string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tags := extractTags(tc.input)
+			if !reflect.DeepEqual(tc.expected, tags) {
+				t.Fatalf("expected %v, got %v", tc.expected, tags)
+			}
+		})
+	}
+}
+
+func TestHasTag(t *testing.T) {
+	tags := []string{"Work", "project/alpha"}
+	for _, tc := range []struct {
+		tag      string
+		expected bool
+	}{
+		{"work", true},
+		{"WORK", true},
+		{"project", true},
+		{"project/alpha", true},
+		{"alpha", false},
+		{"proj", false},
+		{"home", false},
+	} {
+		if got := hasTag(tags, tc.tag); got != tc.expected {
+			t.Errorf("hasTag(%v, %q): expected %v, got %v", tags, tc.tag, tc.expected, got)
+		}
+	}
+}
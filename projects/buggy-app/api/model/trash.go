@@ -0,0 +1,139 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Deleting a note sets its deleted_at rather than removing the row. Deleted notes are hidden
+// from everything else in this package, but can be listed, restored or permanently deleted
+// here until they are purged.
+
+// ForEachDeletedNoteForOwner calls fn with each of the owner's notes in the trash, most
+// recently deleted first.
+func ForEachDeletedNoteForOwner(ctx context.Context, conn Conn, owner string, fn func(Note) error) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT id, owner, content, created, modified, deleted_at FROM public.note WHERE owner = $1 AND deleted_at IS NOT NULL ORDER BY deleted_at DESC, id",
+		owner,
+	)
+	if err != nil {
+		return fmt.Errorf("model: could not query trash: %w", err)
+	}
+	defer queryRows.Close()
+
+	for queryRows.Next() {
+		note := Note{}
+		err = queryRows.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified, &note.Deleted)
+		if err != nil {
+			return fmt.Errorf("model: query scan failed: %w", err)
+		}
+		note.Tags = extractTags(note.Content)
+		if err := fn(note); err != nil {
+			return err
+		}
+	}
+
+	if queryRows.Err() != nil {
+		return fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	return nil
+}
+
+// Take a note out of the trash. ErrNotFound is returned if the owner has no such note in
+// the trash.
+func RestoreNote(ctx context.Context, conn Conn, owner string, id string) (Note, error) {
+	var note Note
+	if owner == "" {
+		return note, errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return note, errors.New("model: id not supplied")
+	}
+
+	row := conn.QueryRow(ctx,
+		"UPDATE public.note SET deleted_at = NULL WHERE id = $1 AND owner = $2 AND deleted_at IS NOT NULL RETURNING id, owner, content, created, modified",
+		id, owner,
+	)
+
+	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return note, ErrNotFound
+		}
+		return note, fmt.Errorf("model: restore scan failed: %w", err)
+	}
+	note.Tags = extractTags(note.Content)
+	return note, nil
+}
+
+// Permanently delete a note that is in the trash, along with its attachments. The blob keys of
+// the attachments are returned so that the caller can delete the bytes too. ErrNotFound is
+// returned if the owner has no such note in the trash.
+func PurgeNote(ctx context.Context, conn Conn, owner string, id string) ([]string, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return nil, errors.New("model: id not supplied")
+	}
+
+	var count int64
+	var blobKeys []string
+	err := conn.QueryRow(ctx,
+		`WITH purged AS (
+			DELETE FROM public.note WHERE id = $1 AND owner = $2 AND deleted_at IS NOT NULL RETURNING id
+		) `+purgedSelect,
+		id, owner,
+	).Scan(&count, &blobKeys)
+	if err != nil {
+		return nil, fmt.Errorf("model: purge failed: %w", err)
+	}
+	if count == 0 {
+		return nil, ErrNotFound
+	}
+	return blobKeys, nil
+}
+
+// Count the notes in the purged CTE and get the blob keys of their attachments. The attachment
+// rows are deleted by the cascade, but every part of a statement sees the database as it was
+// when the statement started, so they can still be read here.
+const purgedSelect = `SELECT
+	(SELECT count(*) FROM purged),
+	ARRAY(SELECT blob_key FROM public.attachment WHERE note IN (SELECT id FROM purged))`
+
+// Permanently delete every note that has been in the trash for longer than retention, returning
+// how many were deleted and the blob keys of their attachments. Notes are deleted batchSize at a
+// time, so that a big purge doesn't hold locks on lots of rows for a long time.
+//
+// The cutoff is worked out by the database, so the API's clock doesn't matter. The notes are
+// deleted by the purge_deleted_notes function (see migrations/app/000010), which runs as postgres,
+// because row-level security only lets the API at one user's notes at a time.
+func PurgeDeletedNotes(ctx context.Context, conn Conn, retention time.Duration, batchSize int) (int64, []string, error) {
+	var total int64
+	allBlobKeys := []string{}
+	for {
+		var count int64
+		var blobKeys []string
+		err := conn.QueryRow(ctx,
+			"SELECT purged_count, blob_keys FROM public.purge_deleted_notes($1, $2)",
+			retention.Microseconds(), batchSize,
+		).Scan(&count, &blobKeys)
+		if err != nil {
+			return total, allBlobKeys, fmt.Errorf("model: purge failed: %w", err)
+		}
+		total += count
+		allBlobKeys = append(allBlobKeys, blobKeys...)
+		if count < int64(batchSize) {
+			return total, allBlobKeys, nil
+		}
+	}
+}
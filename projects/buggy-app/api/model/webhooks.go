@@ -0,0 +1,270 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Users can register webhooks: URLs that are sent a request whenever one of their notes
+// changes. A trigger queues a delivery for each webhook in the same transaction as the change,
+// and workers claim due deliveries, send them and record what happened.
+
+type Webhook struct {
+	Id    string `json:"id"`
+	Owner string `json:"owner"`
+	Url   string `json:"url"`
+	// Used to sign requests. It's only sent to the client when the webhook is created.
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Delivery statuses
+const (
+	// Waiting to be sent, or to be retried
+	DeliveryPending = "pending"
+	// Sent, and the webhook responded with a 2xx status
+	DeliveryDelivered = "delivered"
+	// Failed too many times, and won't be retried
+	DeliveryDead = "dead"
+)
+
+type Delivery struct {
+	Id       string          `json:"id"`
+	Webhook  string          `json:"webhook"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Status   string          `json:"status"`
+	Attempts int             `json:"attempts"`
+	// When it will next be tried, if it's pending
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	// The HTTP status of the last attempt, if there was a response
+	LastStatus *int `json:"last_status,omitempty"`
+	// Why the last attempt failed
+	LastError *string    `json:"last_error,omitempty"`
+	Created   time.Time  `json:"created"`
+	Delivered *time.Time `json:"delivered,omitempty"`
+}
+
+// ErrNoDelivery is returned by ClaimDelivery when there is nothing due to be sent
+var ErrNoDelivery = errors.New("model: no delivery due")
+
+const deliveryColumns = "id, webhook, event, payload, status, attempts, next_attempt, last_status, last_error, created, delivered"
+
+func scanDelivery(row pgx.Row, d *Delivery) error {
+	return row.Scan(&d.Id, &d.Webhook, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.LastStatus, &d.LastError, &d.Created, &d.Delivered)
+}
+
+// Register a webhook for the owner
+func CreateWebhook(ctx context.Context, conn Conn, owner string, url string, secret string) (Webhook, error) {
+	var webhook Webhook
+	if owner == "" {
+		return webhook, errors.New("model: owner not supplied")
+	}
+
+	row := conn.QueryRow(ctx,
+		"INSERT INTO public.webhook (owner, url, secret) VALUES ($1, $2, $3) RETURNING id, owner, url, secret, created",
+		owner, url, secret,
+	)
+	err := row.Scan(&webhook.Id, &webhook.Owner, &webhook.Url, &webhook.Secret, &webhook.Created)
+	if err != nil {
+		return webhook, fmt.Errorf("model: insert scan failed: %w", err)
+	}
+	return webhook, nil
+}
+
+// List the owner's webhooks, without their secrets
+func GetWebhooksForOwner(ctx context.Context, conn Conn, owner string) ([]Webhook, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+
+	queryRows, err := conn.Query(ctx, "SELECT id, owner, url, created FROM public.webhook WHERE owner = $1 ORDER BY created", owner)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not query webhooks: %w", err)
+	}
+	defer queryRows.Close()
+
+	webhooks := []Webhook{}
+	for queryRows.Next() {
+		webhook := Webhook{}
+		if err := queryRows.Scan(&webhook.Id, &webhook.Owner, &webhook.Url, &webhook.Created); err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+	return webhooks, nil
+}
+
+// Delete one of the owner's webhooks, and its deliveries. ErrNotFound is returned if the owner
+// has no such webhook.
+func DeleteWebhook(ctx context.Context, conn Conn, owner string, id string) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return errors.New("model: id not supplied")
+	}
+
+	var deleted string
+	err := conn.QueryRow(ctx, "DELETE FROM public.webhook WHERE id = $1 AND owner = $2 RETURNING id", id, owner).Scan(&deleted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("model: delete failed: %w", err)
+	}
+	return nil
+}
+
+// List up to limit of the deliveries for one of the owner's webhooks, newest first.
+// ErrNotFound is returned if the owner has no such webhook.
+func GetDeliveriesForWebhook(ctx context.Context, conn Conn, owner string, webhook string, limit int) ([]Delivery, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+	if webhook == "" {
+		return nil, errors.New("model: id not supplied")
+	}
+
+	var id string
+	err := conn.QueryRow(ctx, "SELECT id FROM public.webhook WHERE id = $1 AND owner = $2", webhook, owner).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("model: query scan failed: %w", err)
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT "+deliveryColumns+" FROM public.webhook_delivery WHERE webhook = $1 ORDER BY created DESC, id LIMIT $2",
+		webhook, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not query deliveries: %w", err)
+	}
+	defer queryRows.Close()
+
+	deliveries := []Delivery{}
+	for queryRows.Next() {
+		delivery := Delivery{}
+		if err := scanDelivery(queryRows, &delivery); err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+	return deliveries, nil
+}
+
+// ClaimedDelivery is a delivery that a worker is about to send, with where to send it
+type ClaimedDelivery struct {
+	Delivery
+	Url    string
+	Secret string
+}
+
+// Claim the pending delivery that has been due longest, counting an attempt at it. Claiming
+// pushes its next attempt back by lease, so that no other worker picks it up in the meantime,
+// but it's retried if this one dies before recording the result. ErrNoDelivery is returned if
+// nothing is due.
+//
+// SKIP LOCKED means that workers claiming at the same time get different deliveries rather
+// than waiting for each other.
+func ClaimDelivery(ctx context.Context, conn Conn, lease time.Duration) (ClaimedDelivery, error) {
+	var claimed ClaimedDelivery
+	row := conn.QueryRow(ctx,
+		`WITH claimed AS (
+			UPDATE public.webhook_delivery
+			SET attempts = attempts + 1, next_attempt = current_timestamp + $1::bigint * interval '1 microsecond'
+			WHERE id = (
+				SELECT id FROM public.webhook_delivery
+				WHERE status = 'pending' AND next_attempt <= current_timestamp
+				ORDER BY next_attempt
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING `+deliveryColumns+`
+		)
+		SELECT c.id, c.webhook, c.event, c.payload, c.status, c.attempts, c.next_attempt, c.last_status, c.last_error, c.created, c.delivered, w.url, w.secret
+		FROM claimed c JOIN public.webhook w ON w.id = c.webhook`,
+		lease.Microseconds(),
+	)
+	d := &claimed.Delivery
+	err := row.Scan(&d.Id, &d.Webhook, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.LastStatus, &d.LastError, &d.Created, &d.Delivered, &claimed.Url, &claimed.Secret)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return claimed, ErrNoDelivery
+		}
+		return claimed, fmt.Errorf("model: claim failed: %w", err)
+	}
+	return claimed, nil
+}
+
+// Record that a delivery was sent successfully
+func CompleteDelivery(ctx context.Context, conn Conn, id string, status int) error {
+	var updated string
+	err := conn.QueryRow(ctx,
+		"UPDATE public.webhook_delivery SET status = 'delivered', delivered = current_timestamp, next_attempt = NULL, last_status = $2, last_error = NULL WHERE id = $1 RETURNING id",
+		id, status,
+	).Scan(&updated)
+	if err != nil {
+		return fmt.Errorf("model: complete delivery failed: %w", err)
+	}
+	return nil
+}
+
+// Record that an attempt at a delivery failed. It's tried again after retryAfter, or if retryAfter
+// is 0 it's given up on and marked dead. status is the HTTP status of the response, or 0 if
+// there wasn't one.
+func FailDelivery(ctx context.Context, conn Conn, id string, status int, reason string, retryAfter time.Duration) error {
+	var lastStatus *int
+	if status != 0 {
+		lastStatus = &status
+	}
+
+	var updated string
+	var err error
+	if retryAfter > 0 {
+		err = conn.QueryRow(ctx,
+			"UPDATE public.webhook_delivery SET next_attempt = current_timestamp + $2::bigint * interval '1 microsecond', last_status = $3, last_error = $4 WHERE id = $1 RETURNING id",
+			id, retryAfter.Microseconds(), lastStatus, reason,
+		).Scan(&updated)
+	} else {
+		err = conn.QueryRow(ctx,
+			"UPDATE public.webhook_delivery SET status = 'dead', next_attempt = NULL, last_status = $2, last_error = $3 WHERE id = $1 RETURNING id",
+			id, lastStatus, reason,
+		).Scan(&updated)
+	}
+	if err != nil {
+		return fmt.Errorf("model: fail delivery failed: %w", err)
+	}
+	return nil
+}
+
+// Delete deliveries that were delivered or given up on longer ago than retention, returning
+// how many were deleted
+func PurgeDeliveries(ctx context.Context, conn Conn, retention time.Duration) (int64, error) {
+	var count int64
+	err := conn.QueryRow(ctx,
+		`WITH purged AS (
+			DELETE FROM public.webhook_delivery
+			WHERE status <> 'pending' AND created < current_timestamp - $1::bigint * interval '1 microsecond'
+			RETURNING 1
+		) SELECT count(*) FROM purged`,
+		retention.Microseconds(),
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("model: purge deliveries failed: %w", err)
+	}
+	return count, nil
+}
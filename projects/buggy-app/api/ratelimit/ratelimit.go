@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// This package implements token bucket rate limiting. Each key (for example, a user ID) has
+// a bucket that holds up to Burst tokens and refills at Rate tokens per second. Every request
+// takes a token; when the bucket is empty, requests are refused until it refills.
+//
+// https://en.wikipedia.org/wiki/Token_bucket
+//
+// Buckets live in a Store. MemoryStore keeps them in this process, which is fine for one
+// replica. PostgresStore keeps them in the database so that all replicas share them.
+//
+//	store := ratelimit.NewMemoryStore()
+//	res, err := store.Take(ctx, "user:abc123", ratelimit.Limit{Rate: 10, Burst: 20})
+//	if err == nil && !res.Allowed {
+//		// slow down for res.RetryAfter
+//	}
+
+// Limit describes a bucket. The zero Limit means "no limit".
+type Limit struct {
+	// Tokens added per second
+	Rate float64
+	// Maximum tokens the bucket can hold
+	Burst int
+}
+
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Result is the outcome of taking a token from a bucket
+type Result struct {
+	Allowed bool
+	// The Burst of the bucket
+	Limit int
+	// Whole tokens left in the bucket
+	Remaining int
+	// How long until a token is available, if not Allowed
+	RetryAfter time.Duration
+	// How long until the bucket is full again
+	Reset time.Duration
+}
+
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Work out a Result from the tokens left in a bucket
+func newResult(allowed bool, tokens float64, limit Limit) Result {
+	res := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     secondsToDuration((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+	if !allowed {
+		res.RetryAfter = secondsToDuration((1 - tokens) / limit.Rate)
+	}
+	return res
+}
+
+func secondsToDuration(s float64) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// MemoryStore keeps buckets in memory, so limits only apply per-process
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	// now is a variable so that tests can control the clock
+	now func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// How often we look for buckets that are full and can be forgotten
+const sweepInterval = time.Minute
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+
+	// Refill for the time that has passed since we last looked
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens -= 1
+	}
+	return newResult(allowed, b.tokens, limit), nil
+}
+
+// A bucket that would have refilled completely is the same as one that doesn't exist, so
+// there's no need to keep it around. Without this, the map would grow forever.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+type dbConn interface {
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+}
+
+// PostgresStore keeps buckets in the public.rate_limit table, so that limits hold across all
+// API replicas. The bucket logic is in the rate_limit_take function (see migrations). Nothing
+// deletes buckets as they're used, so Sweep has to be called every so often.
+type PostgresStore struct {
+	conn dbConn
+}
+
+func NewPostgresStore(conn dbConn) *PostgresStore {
+	return &PostgresStore{
+		conn: conn,
+	}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	var allowed bool
+	var tokens float64
+	err := s.conn.QueryRow(ctx,
+		"SELECT allowed, remaining FROM rate_limit_take($1, $2, $3)",
+		key, limit.Rate, float64(limit.Burst),
+	).Scan(&allowed, &tokens)
+	if err != nil {
+		return Result{}, fmt.Errorf("ratelimit: take failed: %w", err)
+	}
+	return newResult(allowed, tokens, limit), nil
+}
+
+// Sweep deletes the buckets that have refilled completely, as MemoryStore does, and says how many
+// it deleted. Without this, the table would grow forever.
+func (s *PostgresStore) Sweep(ctx context.Context) (int64, error) {
+	var deleted int64
+	err := s.conn.QueryRow(ctx,
+		"WITH deleted AS (DELETE FROM public.rate_limit WHERE full_at <= clock_timestamp() RETURNING 1) SELECT count(*) FROM deleted",
+	).Scan(&deleted)
+	if err != nil {
+		return 0, fmt.Errorf("ratelimit: sweep failed: %w", err)
+	}
+	return deleted, nil
+}
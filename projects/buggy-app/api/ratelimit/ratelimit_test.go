@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+func TestMemoryStoreBurst(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	limit := Limit{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		res, err := s.Take(context.Background(), "k", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed {
+			t.Fatalf("take %d: expected allowed", i)
+		}
+		if res.Remaining != 2-i {
+			t.Fatalf("take %d: expected %d remaining, got %d", i, 2-i, res.Remaining)
+		}
+	}
+
+	res, _ := s.Take(context.Background(), "k", limit)
+	if res.Allowed {
+		t.Fatal("expected bucket to be empty")
+	}
+	if res.RetryAfter != time.Second {
+		t.Fatalf("expected RetryAfter of 1s, got %v", res.RetryAfter)
+	}
+	if res.Reset != 3*time.Second {
+		t.Fatalf("expected Reset of 3s, got %v", res.Reset)
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	limit := Limit{Rate: 2, Burst: 1}
+
+	if res, _ := s.Take(context.Background(), "k", limit); !res.Allowed {
+		t.Fatal("expected first take to be allowed")
+	}
+	if res, _ := s.Take(context.Background(), "k", limit); res.Allowed {
+		t.Fatal("expected second take to be denied")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if res, _ := s.Take(context.Background(), "k", limit); !res.Allowed {
+		t.Fatal("expected take after refill to be allowed")
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Rate: 1, Burst: 1}
+
+	if res, _ := s.Take(context.Background(), "a", limit); !res.Allowed {
+		t.Fatal("expected a to be allowed")
+	}
+	if res, _ := s.Take(context.Background(), "b", limit); !res.Allowed {
+		t.Fatal("expected b to be allowed: buckets should be separate")
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	limit := Limit{Rate: 1, Burst: 1}
+
+	s.Take(context.Background(), "a", limit)
+	now = now.Add(2 * sweepInterval)
+	s.Take(context.Background(), "b", limit)
+
+	if _, ok := s.buckets["a"]; ok {
+		t.Fatal("expected full bucket to be swept")
+	}
+}
+
+func TestPostgresStore(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mock.Close()
+
+	rows := mock.NewRows([]string{"allowed", "remaining"}).AddRow(false, 0.5)
+	mock.ExpectQuery("^SELECT allowed, remaining FROM rate_limit_take(.+)$").
+		WithArgs("k", 2.0, 10.0).
+		WillReturnRows(rows)
+
+	res, err := NewPostgresStore(mock).Take(context.Background(), "k", Limit{Rate: 2, Burst: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter != 250*time.Millisecond {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgresStoreSweep(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mock.Close()
+
+	mock.ExpectQuery("^WITH deleted AS \\(DELETE FROM public.rate_limit WHERE full_at <= clock_timestamp\\(\\) (.+)$").
+		WillReturnRows(mock.NewRows([]string{"count"}).AddRow(int64(3)))
+
+	deleted, err := NewPostgresStore(mock).Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Fatalf("expected 3 buckets deleted, got %d", deleted)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
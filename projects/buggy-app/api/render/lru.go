@@ -0,0 +1,65 @@
+package render
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is the Renderer's cache. It keeps the most recently used entries, up to a fixed number, so
+// that it doesn't grow with every note that has ever been rendered. It's safe to use from several
+// goroutines.
+type lru struct {
+	mu   sync.Mutex
+	size int
+	// Most recently used at the front. The values are *lruItem.
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	value entry
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *lru) get(key string) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return entry{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruItem).value, true
+}
+
+// put adds or replaces the entry for key, forgetting the least recently used one if the cache is
+// full
+func (c *lru) put(key string, value entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruItem).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem).key)
+	}
+}
+
+func (c *lru) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
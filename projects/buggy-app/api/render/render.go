@@ -0,0 +1,104 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// This package turns the Markdown content of a note into HTML that is safe to show in a
+// browser. #tags become links, so that clicking one finds the other notes with that tag:
+//
+//	r := render.New(func(tag string) string { return "/1/my/search.json?tag=" + tag })
+//	html, err := r.Render(note)
+//
+// Notes are written by users, so the HTML is sanitized: raw HTML in the Markdown is dropped,
+// and anything that could run script (javascript: links, event handlers) is removed.
+//
+// Rendering is relatively slow, so the output is cached for each note until it is modified. Only
+// the cacheSize most recently rendered notes are kept.
+
+// How many notes' HTML the cache keeps
+const cacheSize = 1000
+
+type entry struct {
+	modified time.Time
+	html     string
+}
+
+type Renderer struct {
+	markdown goldmark.Markdown
+	policy   *bluemonday.Policy
+	cache    *lru
+}
+
+// New makes a Renderer. tagURL gives the link for a tag, which should already be escaped.
+func New(tagURL func(tag string) string) *Renderer {
+	markdown := goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithParserOptions(
+			parser.WithInlineParsers(util.Prioritized(&tagParser{url: tagURL}, 500)),
+		),
+	)
+
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^tag$`)).OnElements("a")
+
+	return &Renderer{
+		markdown: markdown,
+		policy:   policy,
+		cache:    newLRU(cacheSize),
+	}
+}
+
+// Render the note's content as sanitized HTML
+func (r *Renderer) Render(note model.Note) (string, error) {
+	if cached, ok := r.cache.get(note.Id); ok && cached.modified.Equal(note.Modified) {
+		return cached.html, nil
+	}
+
+	var buf bytes.Buffer
+	if err := r.markdown.Convert([]byte(note.Content), &buf); err != nil {
+		return "", fmt.Errorf("render: could not render note %s: %w", note.Id, err)
+	}
+	html := r.policy.SanitizeBytes(buf.Bytes())
+
+	// Only one version of each note is kept, so old versions don't pile up
+	r.cache.put(note.Id, entry{modified: note.Modified, html: string(html)})
+	return string(html), nil
+}
+
+// tagParser turns #tag into a link, using the same rules as the model uses to find tags. It is
+// only called for text outside of code, so `#not-a-tag` is left alone.
+type tagParser struct {
+	url func(tag string) string
+}
+
+func (p *tagParser) Trigger() []byte {
+	return []byte{'#'}
+}
+
+func (p *tagParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	n := model.TagLength(block.PrecendingCharacter(), string(line))
+	if n == 0 {
+		return nil
+	}
+	block.Advance(1 + n)
+
+	link := ast.NewLink()
+	link.Destination = []byte(p.url(string(line[1 : 1+n])))
+	link.SetAttributeString("class", []byte("tag"))
+	link.AppendChild(link, ast.NewTextSegment(segment.WithStop(segment.Start+1+n)))
+	return link
+}
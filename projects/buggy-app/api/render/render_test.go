@@ -0,0 +1,85 @@
+package render
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+)
+
+func newTestRenderer() *Renderer {
+	return New(func(tag string) string {
+		return "/1/my/search.json?tag=" + url.QueryEscape(tag)
+	})
+}
+
+func TestRender(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"markdown", "# Title\n\nSome *emphasis*", "<h1>Title</h1>\n<p>Some <em>emphasis</em></p>\n"},
+		{"tag", "Note #example", `<p>Note <a href="/1/my/search.json?tag=example" class="tag" rel="nofollow">#example</a></p>` + "\n"},
+		{"unicode tag", "#café", `<p><a href="/1/my/search.json?tag=caf%C3%A9" class="tag" rel="nofollow">#café</a></p>` + "\n"},
+		{"code span", "Run `make #target`", "<p>Run <code>make #target</code></p>\n"},
+		{"not a tag", "C# and http://example.com/#fragment", `<p>C# and <a href="http://example.com/#fragment" rel="nofollow">http://example.com/#fragment</a></p>` + "\n"},
+		{"raw html", "Hi <img src=x onerror=alert(1)>", "<p>Hi </p>\n"},
+		{"javascript link", "[click](javascript:alert(1))", "<p>click</p>\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			html, err := newTestRenderer().Render(model.Note{Id: "abc", Content: tc.content})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if html != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, html)
+			}
+		})
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	r := newTestRenderer()
+	modified := time.Now()
+
+	first, _ := r.Render(model.Note{Id: "abc", Content: "First", Modified: modified})
+	// Same version, so the cached output is used even though the content is different
+	cached, _ := r.Render(model.Note{Id: "abc", Content: "Second", Modified: modified})
+	if cached != first {
+		t.Fatalf("expected cached %q, got %q", first, cached)
+	}
+
+	updated, _ := r.Render(model.Note{Id: "abc", Content: "Second", Modified: modified.Add(time.Second)})
+	if !strings.Contains(updated, "Second") {
+		t.Fatalf("expected new render after modification, got %q", updated)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := newLRU(2)
+	c.put("a", entry{html: "a"})
+	c.put("b", entry{html: "b"})
+	// Using a makes b the least recently used, so b is the one to go
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	c.put("c", entry{html: "c"})
+
+	if _, ok := c.get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if cached, ok := c.get(key); !ok || cached.html != key {
+			t.Fatalf("expected %s to be cached, got %+v", key, cached)
+		}
+	}
+
+	// Replacing an entry doesn't take up more room
+	c.put("a", entry{html: "a2"})
+	if cached, _ := c.get("a"); cached.html != "a2" || c.len() != 2 {
+		t.Fatalf("expected a2 and 2 entries, got %q and %d", cached.html, c.len())
+	}
+}
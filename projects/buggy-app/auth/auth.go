@@ -6,18 +6,29 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type Config struct {
 	Port        int
 	DatabaseUrl string
 	Log         *log.Logger
+	Pool        util.PoolConfig
+	// How long to keep trying the database when starting, before logging that it's unavailable
+	ConnectBackoff util.Backoff
+	// RPCs are cancelled after this long, if the client hasn't given an earlier deadline
+	// (0 for no limit)
+	RequestTimeout time.Duration
+	// How often to log the database pool's stats (0 to not log them)
+	PoolStatsInterval time.Duration
 }
 
 type Service struct {
@@ -32,6 +43,18 @@ func New(config Config) *Service {
 	}
 }
 
+// waitForDatabase logs when the database is ready, or why it isn't
+func (as *Service) waitForDatabase(ctx context.Context, pool *pgxpool.Pool) {
+	err := util.WaitForDatabase(ctx, pool, as.config.ConnectBackoff, as.config.Log.Printf)
+	switch {
+	case ctx.Err() != nil:
+	case err != nil:
+		as.config.Log.Printf("auth: database unavailable: %v", err)
+	default:
+		as.config.Log.Printf("auth: database ready")
+	}
+}
+
 // Run starts the underlying gRPC server according to the supplied Config
 // It uses the supplied context cancel signal to trigger graceful shutdown:
 //
@@ -45,11 +68,14 @@ func New(config Config) *Service {
 //	}
 func (as *Service) Run(ctx context.Context) error {
 	// Connect to the database via a "pool" of connections, allowing concurrency
-	pool, err := pgxpool.New(ctx, as.config.DatabaseUrl)
+	pool, err := util.NewPool(ctx, as.config.DatabaseUrl, as.config.Pool)
 	if err != nil {
 		return fmt.Errorf("unable to create connection pool: %w", err)
 	}
 	defer pool.Close()
+	// Serve straight away, rather than waiting for the database: the health check says whether
+	// it's ready
+	go as.waitForDatabase(ctx, pool)
 	// Add the pool to the "inner" auth service which implements the gRPC interface
 	// and responds to RPCs
 	as.grpcService.pool = pool
@@ -62,8 +88,9 @@ func (as *Service) Run(ctx context.Context) error {
 	}
 
 	// Set up and register the server
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(timeoutInterceptor(as.config.RequestTimeout)))
 	pb.RegisterAuthServer(grpcServer, as.grpcService)
+	healthpb.RegisterHealthServer(grpcServer, newHealthService(pool, as.config.Log))
 
 	// Serve on the supplied listener
 	// This call blocks, so we put it in a goroutine
@@ -77,6 +104,14 @@ func (as *Service) Run(ctx context.Context) error {
 
 	as.config.Log.Printf("auth service: listening: %s", listen)
 
+	if as.config.PoolStatsInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			util.LogPoolStats(ctx, as.config.Log, "auth service", pool, as.config.PoolStatsInterval)
+		}()
+	}
+
 	// Wait for the context cancel (e.g. from interrupt signal) before
 	// gracefully shutting down any ongoing RPCs
 	<-ctx.Done()
@@ -87,6 +122,20 @@ func (as *Service) Run(ctx context.Context) error {
 	return runErr
 }
 
+// timeoutInterceptor gives each RPC a deadline, so that a slow query can't hold on to a database
+// connection for good. The client's deadline, which gRPC passes on in the context, is kept if
+// it's sooner.
+func timeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return handler(ctx, req)
+	}
+}
+
 // Internal grpcAuthService struct that implements the gRPC server interface
 type grpcAuthService struct {
 	pb.UnimplementedAuthServer
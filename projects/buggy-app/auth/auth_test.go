@@ -192,3 +192,25 @@ func TestSimpleVerifyAllow(t *testing.T) {
 		t.Fatalf("runErr: %v", err)
 	}
 }
+
+func TestTimeoutInterceptor(t *testing.T) {
+	var deadline time.Time
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		deadline, _ = ctx.Deadline()
+		return nil, nil
+	}
+
+	interceptor := timeoutInterceptor(time.Minute)
+	interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, handler)
+	if deadline.IsZero() || time.Until(deadline) > time.Minute {
+		t.Fatalf("expected a deadline within a minute, got %v", deadline)
+	}
+
+	// A client's earlier deadline is kept
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	interceptor(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+	if time.Until(deadline) > time.Second {
+		t.Fatalf("expected the client's deadline, got %v", deadline)
+	}
+}
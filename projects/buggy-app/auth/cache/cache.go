@@ -3,6 +3,7 @@ package cache
 import (
 	"crypto/md5"
 	"sync"
+	"sync/atomic"
 )
 
 // This package provides a very simple cache. It's designed to hide the values of the keys because
@@ -24,6 +25,16 @@ type Entry[Value any] struct {
 
 type Cache[Value any] struct {
 	entries *sync.Map
+	// Gets that found an entry, and that didn't
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// Stats says how well the cache is working
+type Stats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
 }
 
 func New[Value any]() *Cache[Value] {
@@ -39,9 +50,11 @@ func (c *Cache[V]) Key(k string) Key {
 func (c *Cache[Value]) Get(k Key) (*Value, bool) {
 	if value, ok := c.entries.Load(k); ok {
 		if entry, ok := value.(Entry[Value]); ok {
+			c.hits.Add(1)
 			return entry.value, true
 		}
 	}
+	c.misses.Add(1)
 	return nil, false
 }
 
@@ -50,3 +63,13 @@ func (c *Cache[Value]) Put(k Key, v *Value) {
 		value: v,
 	})
 }
+
+// Stats counts the gets since the cache was made, and the entries in it now
+func (c *Cache[Value]) Stats() Stats {
+	entries := 0
+	c.entries.Range(func(_, _ any) bool {
+		entries++
+		return true
+	})
+	return Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: entries}
+}
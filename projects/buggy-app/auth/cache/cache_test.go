@@ -28,3 +28,19 @@ func TestGet(t *testing.T) {
 		t.Fatalf("cache: expected %s, got %s", v, *gV)
 	}
 }
+
+func TestStats(t *testing.T) {
+	c := New[TestValue]()
+	k := c.Key("foo")
+	v := TestValue("entry")
+	c.Get(k)
+	c.Put(k, &v)
+	c.Get(k)
+	c.Get(k)
+	c.Get(c.Key("bar"))
+
+	expected := Stats{Hits: 2, Misses: 2, Entries: 1}
+	if stats := c.Stats(); stats != expected {
+		t.Fatalf("cache: expected %+v, got %+v", expected, stats)
+	}
+}
@@ -8,11 +8,14 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type Client interface {
 	Close() error
 	Verify(ctx context.Context, id, passwd string) (*VerifyResult, error)
+	// Health returns an error unless the auth service says it is serving
+	Health(ctx context.Context) error
 }
 
 type VerifyResult struct {
@@ -29,6 +32,7 @@ type GrpcClient struct {
 	conn   *grpc.ClientConn
 	cancel context.CancelFunc
 	aC     pb.AuthClient
+	hC     healthpb.HealthClient
 	cache  *cache.Cache[VerifyResult]
 }
 
@@ -73,6 +77,26 @@ func (c *GrpcClient) Verify(ctx context.Context, id, passwd string) (*VerifyResu
 	return vR, nil
 }
 
+// CacheStats says how often Verify has been answered from the cache, rather than by the auth
+// service
+func (c *GrpcClient) CacheStats() cache.Stats {
+	return c.cache.Stats()
+}
+
+// Health asks the auth service whether it is serving, using the standard gRPC health check
+func (c *GrpcClient) Health(ctx context.Context) error {
+	res, err := c.hC.Check(ctx, &healthpb.HealthCheckRequest{
+		Service: pb.Auth_ServiceDesc.ServiceName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check health: %w", err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("auth service is %s", res.Status)
+	}
+	return nil
+}
+
 func defaultOpts() []grpc.DialOption {
 	return []grpc.DialOption{
 		// TODO: insecure connection should move to TLS
@@ -94,6 +118,7 @@ func newClientWithOpts(ctx context.Context, target string, opts ...grpc.DialOpti
 		conn:   conn,
 		cancel: cancel,
 		aC:     pb.NewAuthClient(conn),
+		hC:     healthpb.NewHealthClient(conn),
 		cache:  cache.New[VerifyResult](),
 	}, nil
 }
@@ -109,7 +134,8 @@ func NewMockClient(result *VerifyResult) *MockClient {
 	}
 }
 
-func (ac *MockClient) Close() error { return nil }
+func (ac *MockClient) Close() error                     { return nil }
+func (ac *MockClient) Health(ctx context.Context) error { return nil }
 func (ac *MockClient) Verify(ctx context.Context, id, passwd string) (*VerifyResult, error) {
 	return ac.result, nil
 }
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"time"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// The auth service implements the standard gRPC health check:
+// https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+//
+// It's serving if it can reach Postgres, because it can't verify anyone without it. The check
+// is made when it's asked for, so the answer is never stale. Watch isn't supported.
+
+// How long to wait for Postgres to answer a health check
+const healthCheckTimeout = 2 * time.Second
+
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type healthService struct {
+	healthpb.UnimplementedHealthServer
+
+	db  pinger
+	log *log.Logger
+}
+
+func newHealthService(db pinger, log *log.Logger) *healthService {
+	return &healthService{db: db, log: log}
+}
+
+// Check reports on the whole server ("") or the Auth service, which are the same thing
+func (hs *healthService) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if in.Service != "" && in.Service != pb.Auth_ServiceDesc.ServiceName {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", in.Service)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := hs.db.Ping(ctx); err != nil {
+		hs.log.Printf("health: database ping failed: %v", err)
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"testing"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (p *fakePinger) Ping(ctx context.Context) error {
+	return p.err
+}
+
+func TestHealthCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		pingErr  error
+		expected healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{name: "serving", service: "", expected: healthpb.HealthCheckResponse_SERVING},
+		{name: "auth service", service: pb.Auth_ServiceDesc.ServiceName, expected: healthpb.HealthCheckResponse_SERVING},
+		{name: "database down", service: "", pingErr: errors.New("connection refused"), expected: healthpb.HealthCheckResponse_NOT_SERVING},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs := newHealthService(&fakePinger{err: tt.pingErr}, log.Default())
+			res, err := hs.Check(context.Background(), &healthpb.HealthCheckRequest{Service: tt.service})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, res.Status)
+			}
+		})
+	}
+}
+
+func TestHealthCheckUnknownService(t *testing.T) {
+	hs := newHealthService(&fakePinger{}, log.Default())
+	_, err := hs.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "other.Service"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+}
+
+func TestClientHealth(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	pinger := &fakePinger{}
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, newHealthService(pinger, log.Default()))
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	client, err := NewClient(context.Background(), lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Health(context.Background()); err != nil {
+		t.Fatalf("expected healthy, got %v", err)
+	}
+
+	pinger.err = errors.New("connection refused")
+	if err := client.Health(context.Background()); err == nil {
+		t.Fatal("expected an error when the database is down")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/config"
+)
+
+// The API's settings. See util/config for how they're loaded.
+type apiConfig struct {
+	config.Database
+
+	Port                 int           `config:"port" usage:"port the server will listen on"`
+	DebugAddr            string        `config:"debug-addr" usage:"host:port to serve the /debug endpoints on, which shouldn't be reachable by clients (empty to not serve them)"`
+	RequestTimeout       time.Duration `config:"request-timeout" usage:"cancel requests, and their queries, after this long (0 for no limit)"`
+	AuthServiceUrl       string        `config:"auth-service-url" usage:"host:port of the auth service"`
+	ReadReplicaUrls      string        `config:"read-replica-urls" usage:"comma-separated Postgres URLs of streaming replicas to send reads to"`
+	ReadYourWritesWindow time.Duration `config:"read-your-writes-window" usage:"how long a user reads from the primary after writing"`
+	ReplicaMaxLag        time.Duration `config:"replica-max-lag" usage:"don't read from replicas further behind the primary than this"`
+	ReplicaCheckInterval time.Duration `config:"replica-check-interval" usage:"how often to check the replicas"`
+	SharedRateLimit      bool          `config:"shared-rate-limit" usage:"share rate limits between replicas using Postgres"`
+	TrustForwardedFor    bool          `config:"trust-forwarded-for" usage:"rate limit by the client IP in X-Forwarded-For"`
+
+	TrashRetention     time.Duration `config:"trash-retention" usage:"how long deleted notes stay in the trash before they are purged (0 to keep them forever)"`
+	TrashPurgeInterval time.Duration `config:"trash-purge-interval" usage:"how often to purge old notes from the trash"`
+
+	AttachmentsDir     string `config:"attachments-dir" usage:"directory to keep attachments in, when not using S3"`
+	AttachmentMaxBytes int64  `config:"attachment-max-bytes" usage:"largest attachment that can be uploaded"`
+	S3Endpoint         string `config:"s3-endpoint" usage:"S3 (or S3-compatible) endpoint for attachments"`
+	S3Region           string `config:"s3-region" usage:"S3 region for attachments"`
+	S3Bucket           string `config:"s3-bucket" usage:"keep attachments in this S3 bucket, rather than in -attachments-dir"`
+	S3PathStyle        bool   `config:"s3-path-style" usage:"put the bucket in the URL path, which most S3-compatible servers need"`
+	// The S3 credentials can't be flags, so that they don't show up in ps
+	S3AccessKeyId     string `config:"s3-access-key-id" flag:"-" secret:"true"`
+	S3SecretAccessKey string `config:"s3-secret-access-key" flag:"-" secret:"true"`
+
+	WebhookWorkers      int  `config:"webhook-workers" usage:"how many webhook deliveries to send at once (0 to not send them)"`
+	WebhookMaxAttempts  int  `config:"webhook-max-attempts" usage:"how many times to try a webhook delivery before giving up on it"`
+	WebhookAllowPrivate bool `config:"webhook-allow-private-networks" usage:"let webhooks send requests to loopback and private addresses (for development)"`
+}
+
+func defaultConfig() apiConfig {
+	return apiConfig{
+		Database:             config.DefaultDatabase(),
+		Port:                 80,
+		DebugAddr:            "localhost:6060",
+		RequestTimeout:       30 * time.Second,
+		ReadYourWritesWindow: 10 * time.Second,
+		ReplicaMaxLag:        10 * time.Second,
+		ReplicaCheckInterval: 5 * time.Second,
+		AuthServiceUrl:       "auth:80",
+		TrashRetention:       30 * 24 * time.Hour,
+		TrashPurgeInterval:   time.Hour,
+		AttachmentsDir:       "/var/lib/attachments",
+		AttachmentMaxBytes:   10 << 20,
+		S3Endpoint:           "https://s3.amazonaws.com",
+		S3Region:             "us-east-1",
+		WebhookWorkers:       4,
+		WebhookMaxAttempts:   10,
+	}
+}
+
+func (c *apiConfig) Validate() error {
+	// The API connects as the app role, so that row-level security applies to it
+	if c.DatabaseUrl == "" {
+		databaseUrl, err := util.DefaultAppDatabaseUrl()
+		if err != nil {
+			return fmt.Errorf("no database-url: %w", err)
+		}
+		c.DatabaseUrl = databaseUrl
+	}
+	if err := c.Database.Validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case c.Port < 0 || c.Port > 65535:
+		return fmt.Errorf("port %d is out of range", c.Port)
+	case c.MaxConns < 2:
+		// Listening for note events takes a connection of its own
+		return errors.New("db-max-conns must be at least 2")
+	case c.RequestTimeout < 0:
+		return errors.New("request-timeout can't be negative")
+	case c.ReadYourWritesWindow <= 0, c.ReplicaMaxLag <= 0, c.ReplicaCheckInterval <= 0:
+		return errors.New("read-your-writes-window, replica-max-lag and replica-check-interval must be positive")
+	case c.ReadYourWritesWindow < c.ReplicaMaxLag:
+		// Otherwise a user could go back to a replica that hasn't seen their write yet
+		return errors.New("read-your-writes-window must be at least replica-max-lag")
+	case c.AuthServiceUrl == "":
+		return errors.New("auth-service-url must be set")
+	case c.TrashRetention < 0:
+		return errors.New("trash-retention can't be negative")
+	case c.TrashPurgeInterval <= 0:
+		return errors.New("trash-purge-interval must be positive")
+	case c.AttachmentMaxBytes <= 0:
+		return errors.New("attachment-max-bytes must be positive")
+	case c.WebhookWorkers < 0:
+		return errors.New("webhook-workers can't be negative")
+	case c.WebhookMaxAttempts < 1:
+		return errors.New("webhook-max-attempts must be at least 1")
+	}
+
+	if c.DebugAddr != "" {
+		if _, _, err := net.SplitHostPort(c.DebugAddr); err != nil {
+			return fmt.Errorf("debug-addr should be host:port: %w", err)
+		}
+	}
+
+	for _, replicaUrl := range c.ReplicaUrls() {
+		if _, err := url.Parse(replicaUrl); err != nil {
+			return errors.New("read-replica-urls has an invalid URL")
+		}
+	}
+
+	if c.S3Bucket != "" {
+		if _, err := url.ParseRequestURI(c.S3Endpoint); err != nil {
+			return errors.New("s3-endpoint is not a valid URL")
+		}
+		if c.S3AccessKeyId == "" || c.S3SecretAccessKey == "" {
+			return errors.New("s3-bucket needs S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+		}
+	}
+	return nil
+}
+
+// The read replica URLs as a list
+func (c *apiConfig) ReplicaUrls() []string {
+	urls := []string{}
+	for _, replicaUrl := range strings.Split(c.ReadReplicaUrls, ",") {
+		if replicaUrl = strings.TrimSpace(replicaUrl); replicaUrl != "" {
+			urls = append(urls, replicaUrl)
+		}
+	}
+	return urls
+}
@@ -1,39 +1,98 @@
 package main
 
 import (
-	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
 
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api"
-	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/blob"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/ratelimit"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/config"
 	"golang.org/x/net/context"
 )
 
 func main() {
-	port := flag.Int("port", 80, "port the server will listen on")
-	flag.Parse()
-
-	// Get the postgres password from a file supplied in an environment variable
-	// TODO: it would be better for this to come from DATABASE_URL or to "figure out"
-	// the best auth params from environment variables
-	passwd, err := util.ReadPasswd()
-	if err != nil {
+	cfg := defaultConfig()
+	if err := config.Load(&cfg); err != nil {
 		log.Fatal(err)
 	}
 
+	// Attachments go in S3 if there's a bucket, and on disk otherwise
+	var attachmentStore api.BlobStore = blob.NewFileStore(cfg.AttachmentsDir)
+	if cfg.S3Bucket != "" {
+		var err error
+		attachmentStore, err = blob.NewS3Store(blob.S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			AccessKeyId:     cfg.S3AccessKeyId,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			PathStyle:       cfg.S3PathStyle,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// The NotifyContext will signal Done when these signals are sent, allowing the server
 	// to shutdown gracefully
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer stop()
 
 	as := api.New(api.Config{
-		Port:           *port,
-		Log:            log.Default(),
-		AuthServiceUrl: "auth:80",
-		DatabaseUrl:    fmt.Sprintf("postgres://postgres:%s@postgres:5432/app", passwd),
+		Port:            cfg.Port,
+		DebugAddr:       cfg.DebugAddr,
+		Log:             log.Default(),
+		AuthServiceUrl:  cfg.AuthServiceUrl,
+		DatabaseUrl:     cfg.DatabaseUrl,
+		Pool:            cfg.Pool(),
+		ConnectBackoff:  cfg.Backoff(),
+		RequestTimeout:  cfg.RequestTimeout,
+		ReadReplicaUrls: cfg.ReplicaUrls(),
+		Replicas: model.ReplicaConfig{
+			ReadYourWrites: cfg.ReadYourWritesWindow,
+			MaxLag:         cfg.ReplicaMaxLag,
+			CheckInterval:  cfg.ReplicaCheckInterval,
+		},
+		RateLimit: api.RateLimitConfig{
+			Default: api.RouteLimit{
+				IP:   ratelimit.Limit{Rate: 20, Burst: 40},
+				User: ratelimit.Limit{Rate: 10, Burst: 20},
+			},
+			Routes: map[string]api.RouteLimit{
+				// Listing is the most expensive thing we do
+				"/1/my/notes.json": {
+					IP:   ratelimit.Limit{Rate: 10, Burst: 20},
+					User: ratelimit.Limit{Rate: 2, Burst: 10},
+				},
+				// Exports and imports touch every note, so users shouldn't need them often
+				"/1/my/export": {
+					IP:   ratelimit.Limit{Rate: 1, Burst: 5},
+					User: ratelimit.Limit{Rate: 0.1, Burst: 2},
+				},
+				"/1/my/import": {
+					IP:   ratelimit.Limit{Rate: 1, Burst: 5},
+					User: ratelimit.Limit{Rate: 0.1, Burst: 2},
+				},
+			},
+			Shared:            cfg.SharedRateLimit,
+			TrustForwardedFor: cfg.TrustForwardedFor,
+		},
+		Trash: api.TrashConfig{
+			Retention:     cfg.TrashRetention,
+			PurgeInterval: cfg.TrashPurgeInterval,
+		},
+		Attachments: api.AttachmentConfig{
+			Store:    attachmentStore,
+			MaxBytes: cfg.AttachmentMaxBytes,
+		},
+		Webhooks: api.WebhookConfig{
+			Workers:              cfg.WebhookWorkers,
+			MaxAttempts:          cfg.WebhookMaxAttempts,
+			AllowPrivateNetworks: cfg.WebhookAllowPrivate,
+		},
 	})
 	if err := as.Run(ctx); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/config"
+)
+
+// The auth service's settings. See util/config for how they're loaded.
+type authConfig struct {
+	config.Database
+
+	Port              int           `config:"port" usage:"port the server will listen on"`
+	RequestTimeout    time.Duration `config:"request-timeout" usage:"cancel RPCs, and their queries, after this long if the client hasn't set a deadline (0 for no limit)"`
+	PoolStatsInterval time.Duration `config:"pool-stats-interval" usage:"how often to log database pool stats (0 to not log them)"`
+}
+
+func defaultConfig() authConfig {
+	return authConfig{
+		Database:       config.DefaultDatabase(),
+		Port:           80,
+		RequestTimeout: 10 * time.Second,
+	}
+}
+
+func (c *authConfig) Validate() error {
+	if err := c.Database.Validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case c.Port < 0 || c.Port > 65535:
+		return fmt.Errorf("port %d is out of range", c.Port)
+	case c.RequestTimeout < 0:
+		return errors.New("request-timeout can't be negative")
+	case c.PoolStatsInterval < 0:
+		return errors.New("pool-stats-interval can't be negative")
+	}
+	return nil
+}
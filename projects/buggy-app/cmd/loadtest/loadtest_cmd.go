@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// This command load tests the API. It makes some users (and notes for them) directly in the
+// database, as cmd/test does, then sends a mix of requests as those users at a steady rate, and
+// reports how long they took, how many failed and how often the API's auth cache saved asking the
+// auth service (from its debug address, -admin-api). Afterwards it deletes the users and their
+// notes.
+//
+// The API and the database need to be running: make run.
+//
+//	> go run ./cmd/loadtest -users 50 -notes 200 -rps 100 -duration 1m -mix list=2,get=5,create=1,search=2
+//
+// Requests are sent at -rps whether or not earlier ones have finished, as real users would, up to
+// -concurrency at once. If that many are waiting the rest are dropped and counted, because the API
+// can't keep up. Requests aren't retried. Bear in mind that the API rate limits each user, so
+// requests that come back 429 Too Many Requests are counted separately: use more users to
+// spread the load.
+//
+// More notes make the load more realistic. To load lots of other users' notes in the background,
+// use cmd/test seed first.
+
+type Flags struct {
+	hostport string
+	db       string
+	api      string
+	adminApi string
+
+	users    int
+	notes    int
+	password string
+
+	rps         float64
+	duration    time.Duration
+	concurrency int
+	timeout     time.Duration
+	mix         mix
+	seed        int64
+
+	format string
+	keep   bool
+}
+
+func parseFlags() *Flags {
+	f := &Flags{mix: defaultMix()}
+	flag.StringVar(&f.hostport, "hostport", "localhost:5432", "host:port of Postgres, for making users")
+	flag.StringVar(&f.db, "db", "app", "target database")
+	flag.StringVar(&f.api, "api", "http://localhost:8090", "base URL of the API")
+	flag.StringVar(&f.adminApi, "admin-api", "http://localhost:8091", "base URL of the API's debug endpoints, for its auth cache stats (empty to not report on them)")
+	flag.IntVar(&f.users, "users", 20, "number of users to make")
+	flag.IntVar(&f.notes, "notes", 100, "number of notes to make for each user")
+	flag.StringVar(&f.password, "password", "loadtest", "password of the users")
+	flag.Float64Var(&f.rps, "rps", 50, "requests to send per second")
+	flag.DurationVar(&f.duration, "duration", 30*time.Second, "how long to send requests for")
+	flag.IntVar(&f.concurrency, "concurrency", 100, "most requests to wait for at once")
+	flag.DurationVar(&f.timeout, "timeout", 10*time.Second, "requests that take longer than this fail")
+	flag.Var(&f.mix, "mix", "relative numbers of each kind of request: list, get, create and search")
+	flag.Int64Var(&f.seed, "seed", 1, "random seed for choosing requests")
+	flag.StringVar(&f.format, "format", "table", "report format: table or json")
+	flag.BoolVar(&f.keep, "keep", false, "keep the users and their notes afterwards")
+	flag.Parse()
+	return f
+}
+
+func main() {
+	f := parseFlags()
+	if f.users < 1 || f.notes < 0 || f.rps <= 0 || f.duration <= 0 || f.concurrency < 1 {
+		log.Fatal("loadtest: -users, -rps, -duration and -concurrency must be positive, and -notes can't be negative")
+	}
+	if f.format != "table" && f.format != "json" {
+		log.Fatalf("loadtest: invalid format, %s", f.format)
+	}
+
+	if err := loadtest(f); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadtest(f *Flags) error {
+	// Set up a default POSTGRES_PASSWORD_FILE because we know where it's likely to be...
+	if os.Getenv("POSTGRES_PASSWORD_FILE") == "" {
+		os.Setenv("POSTGRES_PASSWORD_FILE", "volumes/secrets/postgres-passwd")
+	}
+	// ... and the read it. $POSTGRES_USER will still take precedence.
+	dbPasswd, err := util.ReadPasswd()
+	if err != nil {
+		return err
+	}
+
+	// The NotifyContext will signal Done when these signals are sent. Stopping early still
+	// reports on the requests so far, and cleans up.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer stop()
+
+	connString := fmt.Sprintf("postgres://postgres:%s@%s/%s?sslmode=disable", dbPasswd, f.hostport, f.db)
+	conn, err := util.Connect(ctx, connString, util.DefaultBackoff, log.Printf)
+	if err != nil {
+		return fmt.Errorf("error connecting to database: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	users, err := makeUsers(ctx, conn, f.users, f.notes, f.password)
+	if err != nil {
+		return err
+	}
+	if !f.keep {
+		defer deleteUsers(conn, users)
+	}
+
+	return run(ctx, f, users).write(os.Stdout, f.format)
+}
+
+// A user that requests are sent as, and the ids of their notes
+type user struct {
+	id    string
+	notes []string
+}
+
+// Tags of the notes that are made, which search requests look for
+var tags = []string{"work", "home", "ideas", "todo", "reading"}
+
+// makeUsers adds users, and notes for each of them, to the database
+func makeUsers(ctx context.Context, conn *pgx.Conn, n int, notes int, passwd string) ([]*user, error) {
+	start := time.Now()
+
+	// Every user has the same password, so that it's only hashed once: hashing is slow on purpose
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), 10)
+	if err != nil {
+		return nil, fmt.Errorf("loadtest: could not hash password, %w", err)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	users := make([]*user, n)
+	for i := range users {
+		u := &user{}
+		err := tx.QueryRow(ctx, "INSERT INTO public.user (status, password) VALUES ('active', $1) RETURNING id", hash).Scan(&u.id)
+		if err != nil {
+			return nil, fmt.Errorf("loadtest: could not insert user, %w", err)
+		}
+		rows, err := tx.Query(ctx, `INSERT INTO public.note (owner, content)
+			SELECT $1, 'Load test note ' || g || ' #' || ($3::text[])[1 + g % array_length($3::text[], 1)]
+			FROM generate_series(1, $2) g RETURNING id`, u.id, notes, tags)
+		if err != nil {
+			return nil, fmt.Errorf("loadtest: could not insert notes, %w", err)
+		}
+		if u.notes, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+			return nil, fmt.Errorf("loadtest: could not insert notes, %w", err)
+		}
+		users[i] = u
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	log.Printf("loadtest: made %d users with %d notes each in %v", n, notes, time.Since(start).Round(time.Millisecond))
+	return users, nil
+}
+
+// deleteUsers deletes the users, and all of their notes, including those made during the test
+func deleteUsers(conn *pgx.Conn, users []*user) {
+	ctx := context.Background()
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.id
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		log.Printf("loadtest: could not delete users, %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	for _, sql := range []string{
+		"DELETE FROM public.note WHERE owner = ANY($1)",
+		"DELETE FROM public.user WHERE id = ANY($1)",
+	} {
+		if _, err := tx.Exec(ctx, sql, ids); err != nil {
+			log.Printf("loadtest: could not delete users, %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("loadtest: could not delete users, %v", err)
+		return
+	}
+	log.Printf("loadtest: deleted the %d users and their notes", len(users))
+}
+
+// The kinds of request, in the order they're reported
+var operations = []string{"list", "get", "create", "search"}
+
+// A mix says how often to send each kind of request, relative to the others
+type mix map[string]int
+
+func defaultMix() mix {
+	return mix{"list": 2, "get": 5, "create": 1, "search": 2}
+}
+
+func (m *mix) String() string {
+	if m == nil {
+		return ""
+	}
+	parts := []string{}
+	for _, op := range operations {
+		if (*m)[op] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", op, (*m)[op]))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses a mix like list=2,get=5. Kinds that aren't mentioned aren't sent.
+func (m *mix) Set(value string) error {
+	parsed := mix{}
+	total := 0
+	for _, part := range strings.Split(value, ",") {
+		op, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return fmt.Errorf("expected kind=weight, got %q", part)
+		}
+		known := false
+		for _, o := range operations {
+			known = known || o == op
+		}
+		if !known {
+			return fmt.Errorf("unknown kind of request %q, expected one of: %s", op, strings.Join(operations, ", "))
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid weight for %s: %q", op, weight)
+		}
+		parsed[op] = n
+		total += n
+	}
+	if total == 0 {
+		return fmt.Errorf("nothing to send")
+	}
+	*m = parsed
+	return nil
+}
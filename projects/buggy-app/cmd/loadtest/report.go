@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/cache"
+)
+
+// A report says how the requests went, for each kind of request and overall
+type report struct {
+	mu sync.Mutex
+
+	TargetRPS float64        `json:"target_rps"`
+	Elapsed   time.Duration  `json:"elapsed_ns"`
+	Ops       map[string]*op `json:"operations"`
+	// Only set if the API reports on its auth cache
+	AuthCache *authCacheReport `json:"auth_cache,omitempty"`
+}
+
+type op struct {
+	// How many requests ended each way: "ok", a status code like "500", "timeout" or "network".
+	// Dropped requests weren't sent, because -concurrency requests were already waiting.
+	Outcomes map[string]int `json:"outcomes"`
+	Dropped  int            `json:"dropped"`
+	// Of the requests that got a response (of any kind)
+	Latency   latency `json:"latency"`
+	latencies []time.Duration
+}
+
+type latency struct {
+	P50 time.Duration `json:"p50_ns"`
+	P90 time.Duration `json:"p90_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	Max time.Duration `json:"max_ns"`
+}
+
+type authCacheReport struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	// Entries in the cache at the end. It's never emptied, so this is every password ever checked.
+	Entries int `json:"entries"`
+}
+
+func newReport(f *Flags) *report {
+	r := &report{TargetRPS: f.rps, Ops: map[string]*op{}}
+	for _, name := range operations {
+		if f.mix[name] > 0 {
+			r.Ops[name] = &op{Outcomes: map[string]int{}}
+		}
+	}
+	return r
+}
+
+func (r *report) op(name string) *op {
+	o, ok := r.Ops[name]
+	if !ok {
+		// Gets turn into lists when there are no notes, even if the mix has no lists
+		o = &op{Outcomes: map[string]int{}}
+		r.Ops[name] = o
+	}
+	return o
+}
+
+func (r *report) record(name string, took time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o := r.op(name)
+	result := outcome(err)
+	o.Outcomes[result]++
+	if result != "timeout" && result != "network" {
+		o.latencies = append(o.latencies, took)
+	}
+}
+
+func (r *report) dropped(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.op(name).Dropped++
+}
+
+func (r *report) authCache(before cache.Stats, after cache.Stats) {
+	a := &authCacheReport{
+		Hits:    after.Hits - before.Hits,
+		Misses:  after.Misses - before.Misses,
+		Entries: after.Entries,
+	}
+	if total := a.Hits + a.Misses; total > 0 {
+		a.HitRate = float64(a.Hits) / float64(total)
+	}
+	r.AuthCache = a
+}
+
+// percentile of sorted latencies, by the nearest rank
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func (o *op) summarise() {
+	sort.Slice(o.latencies, func(i, j int) bool { return o.latencies[i] < o.latencies[j] })
+	o.Latency = latency{
+		P50: percentile(o.latencies, 50),
+		P90: percentile(o.latencies, 90),
+		P99: percentile(o.latencies, 99),
+		Max: percentile(o.latencies, 100),
+	}
+}
+
+func (o *op) sent() int {
+	n := 0
+	for _, count := range o.Outcomes {
+		n += count
+	}
+	return n
+}
+
+// errorRate is the share of requests sent that didn't succeed
+func (o *op) errorRate() float64 {
+	if o.sent() == 0 {
+		return 0
+	}
+	return float64(o.sent()-o.Outcomes["ok"]) / float64(o.sent())
+}
+
+func (r *report) write(w io.Writer, format string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := []string{}
+	total := &op{Outcomes: map[string]int{}}
+	for _, name := range operations {
+		o, ok := r.Ops[name]
+		if !ok {
+			continue
+		}
+		names = append(names, name)
+		for result, count := range o.Outcomes {
+			total.Outcomes[result] += count
+		}
+		total.Dropped += o.Dropped
+		total.latencies = append(total.latencies, o.latencies...)
+		o.summarise()
+	}
+	total.summarise()
+	r.Ops["all"] = total
+	defer delete(r.Ops, "all")
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	fmt.Fprintf(w, "%d requests in %v: %.1f a second (target %v)\n\n", total.sent(), r.Elapsed.Round(time.Millisecond),
+		float64(total.sent())/r.Elapsed.Seconds(), r.TargetRPS)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REQUEST\tSENT\tERRORS\tDROPPED\tP50\tP90\tP99\tMAX\tOUTCOMES")
+	for _, name := range append(names, "all") {
+		o := r.Ops[name]
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%d\t%v\t%v\t%v\t%v\t%s\n", name, o.sent(), 100*o.errorRate(), o.Dropped,
+			round(o.Latency.P50), round(o.Latency.P90), round(o.Latency.P99), round(o.Latency.Max), outcomes(o.Outcomes))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if a := r.AuthCache; a != nil {
+		fmt.Fprintf(w, "\nauth cache: %d hits, %d misses (%.1f%% hit rate), %d entries\n", a.Hits, a.Misses, 100*a.HitRate, a.Entries)
+	}
+	return nil
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
+
+// outcomes lists how many requests ended each way, e.g. "ok 950, 429 40, 500 10"
+func outcomes(counts map[string]int) string {
+	results := []string{}
+	for result := range counts {
+		results = append(results, result)
+	}
+	// Most common first
+	sort.Slice(results, func(i, j int) bool {
+		if counts[results[i]] != counts[results[j]] {
+			return counts[results[i]] > counts[results[j]]
+		}
+		return results[i] < results[j]
+	})
+	parts := make([]string, len(results))
+	for i, result := range results {
+		parts[i] = fmt.Sprintf("%s %d", result, counts[result])
+	}
+	return strings.Join(parts, ", ")
+}
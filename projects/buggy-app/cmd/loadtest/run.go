@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/client"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/cache"
+)
+
+// run sends requests at the target rate for the duration (or until ctx is done) and reports on
+// them
+func run(ctx context.Context, f *Flags, users []*user) *report {
+	// One connection per request in flight, kept open between requests, as a busy client would
+	httpClient := &http.Client{
+		Timeout: f.timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: f.timeout}).DialContext,
+			MaxIdleConns:        f.concurrency,
+			MaxIdleConnsPerHost: f.concurrency,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	clients := make([]*client.NotesClient, len(users))
+	for i, u := range users {
+		clients[i] = client.New(client.Config{
+			BaseUrl:    f.api,
+			Id:         u.id,
+			Password:   f.password,
+			HttpClient: httpClient,
+			// Failures are what we're here to count
+			MaxRetries: -1,
+		})
+	}
+
+	// The auth cache stats are on the API's debug address, which might not be reachable
+	cacheErr := errors.New("-admin-api isn't set")
+	var cacheBefore cache.Stats
+	if f.adminApi != "" {
+		cacheBefore, cacheErr = authCacheStats(ctx, httpClient, f.adminApi)
+	}
+	if cacheErr != nil {
+		log.Printf("loadtest: the auth cache won't be reported on: %v", cacheErr)
+	}
+
+	r := newReport(f)
+	g := &generator{rand: rand.New(rand.NewSource(f.seed)), mix: f.mix, users: users}
+	// Notes are made during the test, so the users' lists of them are shared with the requests
+	var mu sync.Mutex
+
+	ctx, cancel := context.WithTimeout(ctx, f.duration)
+	defer cancel()
+	log.Printf("loadtest: sending %v requests a second to %s for %v", f.rps, f.api, f.duration)
+
+	inFlight := make(chan struct{}, f.concurrency)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / f.rps))
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+	start := time.Now()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+
+		mu.Lock()
+		req := g.next()
+		mu.Unlock()
+
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			r.dropped(req.op)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			// Requests already sent are finished, even if the test is over
+			started := time.Now()
+			note, err := req.send(context.Background(), clients[req.user])
+			r.record(req.op, time.Since(started), err)
+			if err == nil && req.op == "create" {
+				mu.Lock()
+				users[req.user].notes = append(users[req.user].notes, note)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.Elapsed = time.Since(start)
+
+	if cacheErr == nil {
+		cacheAfter, err := authCacheStats(context.Background(), httpClient, f.adminApi)
+		if err != nil {
+			log.Printf("loadtest: the auth cache won't be reported on: %v", err)
+		} else {
+			r.authCache(cacheBefore, cacheAfter)
+		}
+	}
+	return r
+}
+
+// A request to send, as one of the users
+type request struct {
+	op   string
+	user int
+	// The note to get, or the content to create, or what to search for
+	arg string
+	tag string
+}
+
+func (req request) send(ctx context.Context, c *client.NotesClient) (string, error) {
+	switch req.op {
+	case "list":
+		_, _, err := c.ListPage(ctx, 0)
+		return "", err
+	case "get":
+		_, err := c.Get(ctx, req.arg)
+		return "", err
+	case "create":
+		note, err := c.Create(ctx, req.arg)
+		return note.Id, err
+	case "search":
+		_, err := c.Search(ctx, req.arg, req.tag)
+		return "", err
+	}
+	return "", fmt.Errorf("unknown kind of request %s", req.op)
+}
+
+// A generator chooses requests: the kind by the mix, and the user evenly
+type generator struct {
+	rand  *rand.Rand
+	mix   mix
+	users []*user
+	count int
+}
+
+func (g *generator) next() request {
+	total := 0
+	for _, op := range operations {
+		total += g.mix[op]
+	}
+	pick := g.rand.Intn(total)
+	req := request{user: g.rand.Intn(len(g.users))}
+	for _, op := range operations {
+		if pick < g.mix[op] {
+			req.op = op
+			break
+		}
+		pick -= g.mix[op]
+	}
+
+	g.count++
+	tag := tags[g.rand.Intn(len(tags))]
+	switch req.op {
+	case "get":
+		// Users with no notes yet list them instead
+		notes := g.users[req.user].notes
+		if len(notes) == 0 {
+			req.op = "list"
+			break
+		}
+		req.arg = notes[g.rand.Intn(len(notes))]
+	case "create":
+		req.arg = fmt.Sprintf("Load test note %d, made during the test #%s", g.count, tag)
+	case "search":
+		// Half by tag, half by text
+		if g.rand.Intn(2) == 0 {
+			req.tag = tag
+		} else {
+			req.arg = strconv.Itoa(g.rand.Intn(10))
+		}
+	}
+	return req
+}
+
+// authCacheStats asks the API's debug endpoints how its auth cache is doing
+func authCacheStats(ctx context.Context, httpClient *http.Client, adminApi string) (cache.Stats, error) {
+	var stats cache.Stats
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, adminApi+"/debug/auth-cache", nil)
+	if err != nil {
+		return stats, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return stats, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("GET /debug/auth-cache: %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return stats, fmt.Errorf("GET /debug/auth-cache: %w", err)
+	}
+	return stats, nil
+}
+
+// outcome sorts a request's error into something worth counting
+func outcome(err error) string {
+	var apiErr *client.Error
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return "timeout"
+	}
+	return "network"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// Migration names become part of the file name, e.g. 000011_add_note_title.up.sql
+var migrationName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// create adds an empty up and down migration, numbered after the last one, to the database's
+// directory in dir. db can be left out when only one database has migrations.
+func create(dir, db, name string, dryRun bool) error {
+	name = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), " ", "_"))
+	if !migrationName.MatchString(name) {
+		return fmt.Errorf("migration name %q should only have letters, numbers and underscores", name)
+	}
+
+	fsys := os.DirFS(dir)
+	databases, err := databaseDirs(fsys, db)
+	if err != nil {
+		return err
+	}
+	if len(databases) > 1 {
+		return fmt.Errorf("more than one database has migrations, choose one with -db: %s", strings.Join(databases, ", "))
+	}
+	db = databases[0]
+
+	// Number it after the last migration
+	next := uint(1)
+	src, err := iofs.New(fsys, db)
+	if err != nil {
+		return err
+	}
+	vs, err := versions(src)
+	if err != nil {
+		return err
+	}
+	if len(vs) > 0 {
+		next = vs[len(vs)-1] + 1
+	}
+
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, db, fmt.Sprintf("%06d_%s.%s.sql", next, name, direction))
+		if dryRun {
+			fmt.Printf("would create %s\n", path)
+			continue
+		}
+		// O_EXCL so that an existing migration is never overwritten
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		log.Printf("migrate: created %s", path)
+	}
+	if !dryRun {
+		log.Println("migrate: rebuild to embed the new migration")
+	}
+	return nil
+}
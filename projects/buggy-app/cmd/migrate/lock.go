@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+// When several containers start together, each of them can run migrate. Only one at a time may
+// change a database, so before it does, migrate takes a Postgres advisory lock for the database
+// and holds it until it's done. The others wait for it, and then usually find there's nothing
+// left to do.
+//
+// The migrate package takes a lock of its own, but only for each step, and waits for it without
+// saying why. This one covers the whole command, and says who is holding it.
+
+// How often to try for the lock while someone else has it
+const lockPollInterval = 500 * time.Millisecond
+
+// Who is holding the lock, from the connection that took it
+const lockHolderQuery = `SELECT a.pid, COALESCE(a.application_name, ''), COALESCE(host(a.client_addr), 'local'),
+	EXTRACT(EPOCH FROM now() - a.backend_start)::bigint
+FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+WHERE l.locktype = 'advisory' AND l.granted
+AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+AND l.classid::bigint = $1 AND l.objid::bigint = $2 AND l.objsubid = 1`
+
+// A migrationLock is held by a connection of its own, and released when it's closed
+type migrationLock struct {
+	conn *pgx.Conn
+	key  int64
+}
+
+// lockKey is the advisory lock for migrating the database
+func lockKey(database string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("buggy-app migrate " + database))
+	return int64(h.Sum64())
+}
+
+// lock waits up to timeout for the database's migration lock
+func lock(ctx context.Context, databaseUrl, database string, timeout time.Duration) (*migrationLock, error) {
+	// Name the connection, so that anyone waiting can see who has the lock
+	u, err := url.Parse(databaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("application_name", "migrate")
+	u.RawQuery = q.Encode()
+
+	conn, err := util.Connect(ctx, u.String(), util.DefaultBackoff, log.Printf)
+	if err != nil {
+		return nil, err
+	}
+	l := &migrationLock{conn: conn, key: lockKey(database)}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	waiting := false
+	for {
+		var locked bool
+		err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&locked)
+		if err == nil && locked {
+			if waiting {
+				log.Printf("migrate: %s: got the migration lock", database)
+			}
+			return l, nil
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			conn.Close(context.Background())
+			return nil, fmt.Errorf("taking the migration lock failed: %w", err)
+		}
+
+		if !waiting {
+			log.Printf("migrate: %s: waiting up to %v for the migration lock, held by %s", database, timeout, l.holder(ctx))
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			holder := l.holder(context.Background())
+			conn.Close(context.Background())
+			return nil, fmt.Errorf("gave up after %v waiting for the migration lock, held by %s; if that's stuck, it can be stopped with pg_terminate_backend(pid)", timeout, holder)
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// holder describes the connection holding the lock, if it can be found
+func (l *migrationLock) holder(ctx context.Context) string {
+	var pid int
+	var app, client string
+	var connectedSecs int64
+	key := uint64(l.key)
+	err := l.conn.QueryRow(ctx, lockHolderQuery, int64(key>>32), int64(key&0xffffffff)).
+		Scan(&pid, &app, &client, &connectedSecs)
+	if err != nil {
+		return "another connection"
+	}
+	if app == "" {
+		app = "a client"
+	}
+	return fmt.Sprintf("%s (pid %d, from %s, connected %v ago)", app, pid, client, time.Duration(connectedSecs)*time.Second)
+}
+
+// unlock releases the lock and closes its connection
+func (l *migrationLock) unlock() {
+	ctx := context.Background()
+	if _, err := l.conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", l.key); err != nil {
+		log.Printf("migrate: releasing the migration lock failed: %v", err)
+	}
+	// Closing the connection releases it anyway
+	l.conn.Close(ctx)
+}
@@ -1,141 +1,360 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/migrations"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/migrations/lint"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
 )
 
-// The migrate command reads a directory (-path) for sub-directories containing .sql files.
-// Names of the sub-directories map to database names, so migrations/app will migrate into
-// the "app" database.
+// The migrate command migrates each database that has a directory of .sql files in the
+// migrations package, so migrations/app will migrate into the "app" database. The migrations are
+// embedded in the binary; -path reads them from a directory on disk instead.
 //
-// The command is based around the github.com/golang-migrate/migrate package, and supports "up"
-// and "down" migrations:
+// The command is based around the github.com/golang-migrate/migrate package:
 //
-//	go run ./cmd/migrate -path migrations up
-//	go run ./cmd/migrate -path migrations down
+//	go run ./cmd/migrate up          # apply every migration that hasn't been applied
+//	go run ./cmd/migrate down        # undo every migration
+//	go run ./cmd/migrate status      # show the version of each database and what's pending
+//	go run ./cmd/migrate goto 5      # migrate up or down to version 5
+//	go run ./cmd/migrate steps 2     # apply the next 2 migrations
+//	go run ./cmd/migrate steps -1    # undo the last migration
+//	go run ./cmd/migrate force 4     # mark the database as at version 4, without running anything
+//	go run ./cmd/migrate create add_note_title
+//	go run ./cmd/migrate lint        # look for risky operations in the migrations
+//
+// Flags go before the command. -db limits the command to one database. With -dry-run, the SQL
+// that would run is printed rather than run. "status" and -dry-run only read the database's
+// version, so they don't create migrate's schema_migrations table if it isn't there yet.
 //
 // The command does not error if the database is fully migrated already.
 //
-// If you experience an error, it's likely that the database is in a bad state. Migration status
-// is tracked in the `public.schema_migrations` table: it has a version and a dirty flag. Migrations
-// will not run if dirty is true. The most likely fix is:
+// Only one migrate at a time changes a database: it holds an advisory lock on the database while
+// it does, and others wait for up to -lock-timeout (see lock.go). If one database fails, the
+// others are still migrated, and the command exits with an error after saying which were
+// applied, skipped (nothing to do) and failed.
+//
+// If a migration fails part way, the database is left "dirty" at that migration's version, and
+// no more migrations will run until that's resolved. Run "status" to see the version, undo
+// whatever the failed migration managed to do by hand, then "force" the version before it (or
+// -1 if it was the first) and try again. If the migration did in fact complete, force its own
+// version instead.
+//
+// "lint" doesn't need a database. It reports statements that lose data, block a busy table for
+// a long time or break running code (see the migrations/lint package), and exits with an error
+// if it finds any. Change them, or mark them as fine with a "-- lint:ignore <rule>: <why>"
+// comment before them.
+//
+// "create" adds an empty up and down migration to the database's directory under -path
+// (migrations by default). Rebuild the command to embed it.
 //
-//  - Undo the changes of the migration version in the schema_migrations table
-//  - Set the version to 1 less than the migration that errored
-//  - Set dirty to false
-//  - Try the migration again
+// After migrating, the app role that the API connects as is given the password in $APP_PASSWORD
+// or $APP_PASSWORD_FILE, if either is set (see role.go).
+//
+// If Postgres isn't ready yet (e.g. it's starting up alongside this command in docker-compose),
+// connecting is retried for up to a minute.
 //
 // Before running this tool, make sure the password for the postgres user is available at
 // $POSTGRES_PASSWORD or $POSTGRES_PASSWORD_FILE.
 
-func readDir(path string) ([]os.DirEntry, error) {
-	// Stat the file so we can check if it's a directory or not before
-	// we try to read it as a directory using ReadDir. os.ReadDir will
-	// generates an error if the thing you pass to it is not a directory.
-	// https://pkg.go.dev/os#Stat
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		return nil, err
-	}
+const usage = `usage: migrate [flags] command
 
-	// We can only list the contents of a directory.
-	// https://pkg.go.dev/io/fs#FileInfo
-	if !fileInfo.IsDir() {
-		return nil, errors.New("path must be a directory")
-	}
+commands:
+  up             apply every pending migration
+  down           undo every migration
+  status         show each database's version and pending migrations
+  goto N         migrate up or down to version N
+  steps N        apply the next N migrations, or undo the last -N
+  force N        set the version to N without running anything, to fix a dirty database
+  create NAME    add an empty migration named NAME
+  lint           look for risky operations in the migrations
 
-	// Read this directory to get a list of files
-	// https://pkg.go.dev/os#ReadDir
-	contents, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
-	}
-	return contents, nil
-}
+flags:
+`
 
 func main() {
-	path := flag.String("path", "", "Path to migrations directory")
+	path := flag.String("path", "", "Path to a migrations directory to use instead of the embedded migrations (default for create: migrations)")
 	hostport := flag.String("hostport", "postgres:5432", "Host:port of Postgres")
+	db := flag.String("db", "", "Only migrate this database (default: all of them)")
+	dryRun := flag.Bool("dry-run", false, "Print the SQL that would run, without running it")
+	lockTimeout := flag.Duration("lock-timeout", 5*time.Minute, "How long to wait for another migrate to finish with a database")
 
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	if len(flag.Args()) == 0 {
-		log.Println("missing command, expected one of [up, down]")
-		log.Println("migrate up -path [...]")
+	if flag.NArg() == 0 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	if *path == "" {
+	command, args := flag.Arg(0), flag.Args()[1:]
+	n, err := parseArgs(command, args)
+	if err != nil {
+		log.Println(err)
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if command == "create" {
+		dir := *path
+		if dir == "" {
+			dir = "migrations"
+		}
+		if err := create(dir, *db, args[0], *dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var fsys fs.FS = migrations.FS
+	if *path != "" {
+		fsys = os.DirFS(*path)
+	}
+	databases, err := databaseDirs(fsys, *db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if command == "lint" {
+		if !lintDatabases(fsys, databases) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Get the Postgres password from the environment
 	passwd, err := util.ReadPasswd()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Read the migrations directory
-	contents, err := readDir(*path)
+	// Carry on with the other databases when one fails, and say how each went at the end
+	var applied, skipped, failed []string
+	for _, name := range databases {
+		url := fmt.Sprintf("postgres://postgres:%s@%s/%s?sslmode=disable", passwd, *hostport, name)
+		changed, err := migrateDatabase(fsys, name, url, command, n, *dryRun, *lockTimeout)
+		switch {
+		case err != nil:
+			log.Printf("migrate: %s: failed: %v", name, err)
+			failed = append(failed, name)
+		case changed:
+			applied = append(applied, name)
+		default:
+			skipped = append(skipped, name)
+		}
+	}
+
+	if command == "status" || *dryRun {
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	serverUrl := fmt.Sprintf("postgres://postgres:%s@%s/postgres?sslmode=disable", passwd, *hostport)
+	roleErr := setAppPassword(context.Background(), serverUrl)
+	if roleErr != nil {
+		log.Printf("migrate: setting the app role's password failed: %v", roleErr)
+	}
+
+	log.Printf("migrate: %d applied %v, %d skipped %v, %d failed %v",
+		len(applied), applied, len(skipped), skipped, len(failed), failed)
+	if len(failed) > 0 || roleErr != nil {
+		os.Exit(1)
+	}
+	log.Println("migrate: complete")
+}
+
+// migrateDatabase does the command to one database, and says whether it changed anything
+func migrateDatabase(fsys fs.FS, name, url, command string, n int, dryRun bool, lockTimeout time.Duration) (bool, error) {
+	src, err := iofs.New(fsys, name)
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
 
-	if len(contents) == 0 {
-		log.Fatalln("path is empty directory")
+	// Looking doesn't need the lock, or migrate, which creates its table when it connects
+	if command == "status" || dryRun {
+		return false, inspect(src, name, url, command, n)
 	}
 
-	// TODO: this is hack to make the migration wait for Postgres to be ready. The correct
-	// thing is to detect the retryable error ("pq: the database system is starting up") and
-	// retry, with exponential backoff.
-	<-time.After(500 * time.Millisecond)
+	// Only one migrate at a time can change the database
+	l, err := lock(context.Background(), url, name, lockTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer l.unlock()
 
-	for _, entry := range contents {
-		// We only want to migrate directories
-		if !entry.IsDir() {
-			continue
-		}
-		// Build a file:// and a postres:// URL to migrate into
-		dir := fmt.Sprintf("file://%s/%s", *path, entry.Name())
-		url := fmt.Sprintf("postgres://postgres:%s@%s/%s?sslmode=disable", passwd, *hostport, entry.Name())
+	// Prepare the migration, waiting for Postgres to be ready
+	var m *migrate.Migrate
+	err = util.Retry(context.Background(), util.DefaultBackoff, log.Printf, func(ctx context.Context) error {
+		var err error
+		m, err = migrate.NewWithSourceInstance("iofs", src, url)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	defer m.Close()
 
-		log.Printf("migrate: %q into %q database", dir, entry.Name())
+	return run(m, name, command, n)
+}
 
-		// Prepare the migration
-		m, err := migrate.New(dir, url)
+// inspect prints the database's status, or what the command would do to it, without changing it
+func inspect(src source.Driver, name, url, command string, n int) error {
+	ctx := context.Background()
+	conn, err := util.Connect(ctx, url, util.DefaultBackoff, log.Printf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	current, dirty, err := readVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if command == "status" {
+		return status(os.Stdout, src, name, current, dirty)
+	}
+	return printPlan(os.Stdout, src, name, command, n, current, dirty)
+}
+
+// lintDatabases prints what's risky in each database's migrations, and says whether they're fine
+func lintDatabases(fsys fs.FS, databases []string) bool {
+	count := 0
+	for _, name := range databases {
+		findings, err := lint.Dir(fsys, name)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("migrate: %s: %v", name, err)
+		}
+		for _, f := range findings {
+			fmt.Println(f)
 		}
+		count += len(findings)
+	}
+	if count > 0 {
+		log.Printf("migrate: lint: %d risky statements", count)
+		return false
+	}
+	log.Println("migrate: lint: no problems found")
+	return true
+}
 
-		// Do it, according to the argument
-		switch flag.Arg(0) {
-		case "up":
-			err = m.Up()
-		case "down":
-			err = m.Down()
-		default:
-			log.Fatal("expected one of up or down")
+// parseArgs checks the command has the arguments it needs, and returns its number if it has one
+func parseArgs(command string, args []string) (int, error) {
+	switch command {
+	case "up", "down", "status", "lint":
+		if len(args) != 0 {
+			return 0, fmt.Errorf("%s takes no arguments", command)
+		}
+		return 0, nil
+	case "goto", "steps", "force":
+		if len(args) != 1 {
+			return 0, fmt.Errorf("%s needs a number", command)
 		}
+		n, err := strconv.Atoi(args[0])
 		if err != nil {
-			// The NoChange error is not a problem
-			if errors.Is(err, migrate.ErrNoChange) {
-				log.Printf("migrate: %s: no change", dir)
-			} else {
-				log.Fatal(err)
-			}
+			return 0, fmt.Errorf("%s needs a number: %w", command, err)
+		}
+		if command == "goto" && n < 0 {
+			return 0, errors.New("goto needs a version")
 		}
+		if command == "steps" && n == 0 {
+			return 0, errors.New("steps needs a number other than 0")
+		}
+		return n, nil
+	case "create":
+		if len(args) != 1 {
+			return 0, errors.New("create needs a name")
+		}
+		return 0, nil
 	}
+	return 0, fmt.Errorf("unknown command %q", command)
+}
 
-	log.Println("migrate: complete")
+// databaseDirs lists the databases that have migrations, or just db if it's given
+func databaseDirs(fsys fs.FS, db string) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		// We only want to migrate directories
+		if !entry.IsDir() {
+			continue
+		}
+		if db == "" || entry.Name() == db {
+			names = append(names, entry.Name())
+		}
+	}
+
+	if len(names) == 0 {
+		if db != "" {
+			return nil, fmt.Errorf("no migrations for database %q", db)
+		}
+		return nil, errors.New("no migrations found")
+	}
+	return names, nil
+}
+
+// run does the command to one database, and says whether it changed anything
+func run(m *migrate.Migrate, name, command string, n int) (bool, error) {
+	log.Printf("migrate: %s into %q database", command, name)
+
+	var err error
+	switch command {
+	case "up":
+		err = m.Up()
+	case "down":
+		err = m.Down()
+	case "goto":
+		err = m.Migrate(uint(n))
+	case "steps":
+		err = m.Steps(n)
+	case "force":
+		err = m.Force(n)
+	}
+	if err != nil {
+		// The NoChange error is not a problem
+		if errors.Is(err, migrate.ErrNoChange) {
+			log.Printf("migrate: %s: no change", name)
+			return false, nil
+		}
+		return false, err
+	}
+
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		log.Printf("migrate: %s: no migrations applied", name)
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	log.Printf("migrate: %s: at version %d%s", name, version, dirtyLabel(dirty))
+	return true, nil
+}
+
+func dirtyLabel(dirty bool) string {
+	if dirty {
+		return " (dirty)"
+	}
+	return ""
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/jackc/pgx/v5"
+)
+
+// A step is one migration to apply (up) or undo (down)
+type step struct {
+	version uint
+	up      bool
+}
+
+// versions lists every migration version, in order
+func versions(src source.Driver) ([]uint, error) {
+	var vs []uint
+	v, err := src.First()
+	for err == nil {
+		vs = append(vs, v)
+		v, err = src.Next(v)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return vs, nil
+}
+
+// readVersion reads the database's version from migrate's table, or -1 if no migrations have
+// been applied. Unlike migrate, it doesn't create the table if it isn't there.
+func readVersion(ctx context.Context, conn *pgx.Conn) (int, bool, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return 0, false, err
+	}
+	if !exists {
+		return -1, false, nil
+	}
+
+	var version int64
+	var dirty bool
+	err = conn.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return int(version), dirty, nil
+}
+
+// plan works out which migrations a command would run, the same way migrate does, starting from
+// the current version (-1 for none)
+func plan(vs []uint, current int, command string, n int) ([]step, error) {
+	// Index of the current version in vs, -1 if none are applied
+	at := -1
+	if current >= 0 {
+		at = indexOf(vs, uint(current))
+		if at < 0 {
+			return nil, fmt.Errorf("database is at version %d, which has no migration", current)
+		}
+	}
+
+	ups := func(to int) []step {
+		var steps []step
+		for i := at + 1; i <= to; i++ {
+			steps = append(steps, step{version: vs[i], up: true})
+		}
+		return steps
+	}
+	downs := func(to int) []step {
+		var steps []step
+		for i := at; i > to; i-- {
+			steps = append(steps, step{version: vs[i], up: false})
+		}
+		return steps
+	}
+
+	switch command {
+	case "up":
+		return ups(len(vs) - 1), nil
+	case "down":
+		return downs(-1), nil
+	case "goto":
+		to := indexOf(vs, uint(n))
+		if to < 0 {
+			return nil, fmt.Errorf("no migration with version %d", n)
+		}
+		if to > at {
+			return ups(to), nil
+		}
+		return downs(to), nil
+	case "steps":
+		if n > 0 {
+			if at+n >= len(vs) {
+				return nil, fmt.Errorf("only %d migrations to apply", len(vs)-1-at)
+			}
+			return ups(at + n), nil
+		}
+		if at+n < -1 {
+			return nil, fmt.Errorf("only %d migrations to undo", at+1)
+		}
+		return downs(at + n), nil
+	}
+	return nil, fmt.Errorf("can't plan %s", command)
+}
+
+func indexOf(vs []uint, v uint) int {
+	for i := range vs {
+		if vs[i] == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// printPlan prints the SQL that the command would run on the database
+func printPlan(w io.Writer, src source.Driver, name, command string, n int, current int, dirty bool) error {
+	if dirty && command != "force" {
+		return fmt.Errorf("database is dirty at version %d: fix it and use force first", current)
+	}
+
+	if command == "force" {
+		fmt.Fprintf(w, "-- %s: would set the version to %d, without running anything\n", name, n)
+		return nil
+	}
+
+	vs, err := versions(src)
+	if err != nil {
+		return err
+	}
+	steps, err := plan(vs, current, command, n)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		fmt.Fprintf(w, "-- %s: no change\n", name)
+		return nil
+	}
+
+	for _, s := range steps {
+		read, direction := src.ReadUp, "up"
+		if !s.up {
+			read, direction = src.ReadDown, "down"
+		}
+		r, identifier, err := read(s.version)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "-- %s: %06d_%s (%s)\n%s\n", name, s.version, identifier, direction, body)
+	}
+	return nil
+}
+
+// status prints the database's version and whether each migration has been applied
+func status(w io.Writer, src source.Driver, name string, current int, dirty bool) error {
+	vs, err := versions(src)
+	if err != nil {
+		return err
+	}
+
+	if current < 0 {
+		fmt.Fprintf(w, "%s: no migrations applied\n", name)
+	} else {
+		fmt.Fprintf(w, "%s: version %d%s\n", name, current, dirtyLabel(dirty))
+	}
+	for _, v := range vs {
+		identifier, err := readIdentifier(src, v)
+		if err != nil {
+			return err
+		}
+		state := "pending"
+		switch {
+		case current >= 0 && int(v) == current && dirty:
+			state = "dirty"
+		case current >= 0 && int(v) <= current:
+			state = "applied"
+		}
+		fmt.Fprintf(w, "  %06d  %-40s %s\n", v, identifier, state)
+	}
+	if dirty {
+		fmt.Fprintf(w, "%s is dirty: undo what version %d did, then force the version before it\n", name, current)
+	}
+	return nil
+}
+
+// readIdentifier gets the name of a migration, e.g. create_users_table
+func readIdentifier(src source.Driver, v uint) (string, error) {
+	r, identifier, err := src.ReadUp(v)
+	if err != nil {
+		return "", err
+	}
+	r.Close()
+	return identifier, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+// The API connects as the app role (see migrations/app/000010). volumes/init makes it, with the
+// password from volumes/secrets/app-passwd, when Postgres first starts with an empty data
+// directory. Databases made before that get the role from the migration instead, which can't know
+// the password, so it has none and the API can't log in. After migrating, migrate sets the app
+// role's password from $APP_PASSWORD or $APP_PASSWORD_FILE, so that both end up the same.
+
+// setAppPassword sets the app role's password, if there's one to set and the role exists
+func setAppPassword(ctx context.Context, serverUrl string) error {
+	passwd, err := util.ReadAppPasswd()
+	if err != nil {
+		log.Printf("migrate: leaving the app role's password as it is: %v", err)
+		return nil
+	}
+
+	conn, err := util.Connect(ctx, serverUrl, util.DefaultBackoff, log.Printf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	var exists bool
+	err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT FROM pg_catalog.pg_roles WHERE rolname = 'app')").Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// Nothing has been migrated that needs it yet
+		return nil
+	}
+
+	// ALTER ROLE doesn't take parameters, so have Postgres quote the password
+	var sql string
+	if err := conn.QueryRow(ctx, "SELECT format('ALTER ROLE app PASSWORD %L', $1::text)", passwd).Scan(&sql); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		return err
+	}
+	log.Println("migrate: set the app role's password")
+	return nil
+}
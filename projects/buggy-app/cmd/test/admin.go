@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/blob"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/jackc/pgx/v5"
+)
+
+// Commands for looking at and clearing up test data, so that starting again doesn't mean
+// resetting the volumes and restarting Postgres:
+//
+//	> go run ./cmd/test list users
+//	> go run ./cmd/test list notes -owner FxoAB2gl -format json
+//	> go run ./cmd/test delete user -id FxoAB2gl
+//	> go run ./cmd/test reset
+//
+// Lists are printed as a table, or as JSON with -format json. Deleting a user deletes everything
+// of theirs too, and reset empties every table but keeps the schema, so there's no need to
+// migrate again. Both delete the files of the attachments they delete, from wherever the API keeps
+// them: -attachments-dir, or the S3 bucket given by -s3-bucket and friends.
+
+// Where docker-compose keeps the API's attachments
+const defaultAttachmentsDir = "/tmp/buggy-app-attachments"
+
+// What each command can do things to
+var targets = map[string][]string{
+	"list":   {"users", "notes"},
+	"delete": {"user"},
+}
+
+// target checks the word after a command that needs one, e.g. users in "list users"
+func target(cmd string, args []string) (string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", fmt.Errorf("%s what? expected one of: %s", cmd, strings.Join(targets[cmd], ", "))
+	}
+	for _, t := range targets[cmd] {
+		if args[0] == t {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("can't %s %s, expected one of: %s", cmd, args[0], strings.Join(targets[cmd], ", "))
+}
+
+// Flags associated with the list command
+func listFlags(f *Flags) *flag.FlagSet {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.StringVar(&f.format, "format", "table", "output format: table or json")
+	fs.IntVar(&f.limit, "limit", 100, "list at most this many (0 for all)")
+	fs.StringVar(&f.owner, "owner", "", "owner of the notes to list")
+	fs.BoolVar(&f.trash, "trash", false, "list the notes in the trash, rather than the others")
+	return fs
+}
+
+// Flags associated with the delete command
+func deleteFlags(f *Flags) *flag.FlagSet {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	fs.StringVar(&f.id, "id", "", "id of the user to delete")
+	attachmentFlags(fs, f)
+	return fs
+}
+
+// Flags associated with the reset command
+func resetFlags(f *Flags) *flag.FlagSet {
+	fs := flag.NewFlagSet("reset", flag.ExitOnError)
+	attachmentFlags(fs, f)
+	return fs
+}
+
+// Flags saying where the API keeps attachments, which are the same as cmd/api's
+func attachmentFlags(fs *flag.FlagSet, f *Flags) {
+	fs.StringVar(&f.attachmentsDir, "attachments-dir", defaultAttachmentsDir, "directory the API keeps attachments in, when not using S3 (empty to leave the files)")
+	fs.StringVar(&f.s3Bucket, "s3-bucket", "", "S3 bucket the API keeps attachments in, rather than -attachments-dir")
+	fs.StringVar(&f.s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 (or S3-compatible) endpoint for attachments")
+	fs.StringVar(&f.s3Region, "s3-region", "us-east-1", "S3 region for attachments")
+	fs.BoolVar(&f.s3PathStyle, "s3-path-style", false, "put the bucket in the URL path, which most S3-compatible servers need")
+}
+
+// A place attachments are kept, which they can be deleted from
+type blobStore interface {
+	Delete(ctx context.Context, key string) error
+}
+
+// attachmentStore is where the API keeps attachments: the S3 bucket if there is one, as in
+// cmd/api, and -attachments-dir otherwise. It also says where that is, for logging. The S3
+// credentials come from $S3_ACCESS_KEY_ID and $S3_SECRET_ACCESS_KEY, as the API's do. If there's
+// nowhere to delete attachments from, the store is nil.
+func attachmentStore(f *Flags) (blobStore, string, error) {
+	if f.s3Bucket != "" {
+		accessKeyId, secretAccessKey := os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY")
+		if accessKeyId == "" || secretAccessKey == "" {
+			return nil, "", errors.New("-s3-bucket needs S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+		}
+		store, err := blob.NewS3Store(blob.S3Config{
+			Endpoint:        f.s3Endpoint,
+			Region:          f.s3Region,
+			Bucket:          f.s3Bucket,
+			AccessKeyId:     accessKeyId,
+			SecretAccessKey: secretAccessKey,
+			PathStyle:       f.s3PathStyle,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		return store, "the " + f.s3Bucket + " bucket", nil
+	}
+	if f.attachmentsDir == "" {
+		return nil, "", nil
+	}
+	return blob.NewFileStore(f.attachmentsDir), f.attachmentsDir, nil
+}
+
+// List users or notes, according to command-line configuration
+func listCmd(ctx context.Context, f *Flags, conn *pgx.Conn) error {
+	if f.format != "table" && f.format != "json" {
+		return fmt.Errorf("list: invalid format, %s", f.format)
+	}
+	if f.limit < 0 {
+		return errors.New("list: -limit can't be negative")
+	}
+	switch f.target {
+	case "users":
+		return listUsers(ctx, f, conn, os.Stdout)
+	case "notes":
+		return listNotes(ctx, f, conn, os.Stdout)
+	}
+	return fmt.Errorf("list: can't list %s", f.target)
+}
+
+type userSummary struct {
+	Id       string    `json:"id"`
+	Status   string    `json:"status"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	Notes    int       `json:"notes"`
+	Trash    int       `json:"trash"`
+}
+
+func listUsers(ctx context.Context, f *Flags, conn *pgx.Conn, w io.Writer) error {
+	// LIMIT NULL is no limit
+	var limit *int
+	if f.limit > 0 {
+		limit = &f.limit
+	}
+	rows, err := conn.Query(ctx, `SELECT u.id, u.status, u.created, u.modified,
+			count(n.id) FILTER (WHERE n.deleted_at IS NULL), count(n.id) FILTER (WHERE n.deleted_at IS NOT NULL)
+		FROM public.user u LEFT JOIN public.note n ON n.owner = u.id
+		GROUP BY u.id ORDER BY u.created, u.id LIMIT $1`, limit)
+	if err != nil {
+		return fmt.Errorf("list: could not query users, %w", err)
+	}
+	defer rows.Close()
+
+	users := []userSummary{}
+	for rows.Next() {
+		var u userSummary
+		if err := rows.Scan(&u.Id, &u.Status, &u.Created, &u.Modified, &u.Notes, &u.Trash); err != nil {
+			return fmt.Errorf("list: query scan failed, %w", err)
+		}
+		users = append(users, u)
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("list: query read failed, %w", rows.Err())
+	}
+
+	if f.format == "json" {
+		return writeJSON(w, users)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tNOTES\tTRASH\tCREATED\tMODIFIED")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", u.Id, u.Status, u.Notes, u.Trash, tableTime(u.Created), tableTime(u.Modified))
+	}
+	return tw.Flush()
+}
+
+// errLimit stops listing notes when there are enough
+var errLimit = errors.New("limit reached")
+
+func listNotes(ctx context.Context, f *Flags, conn *pgx.Conn, w io.Writer) error {
+	if f.owner == "" {
+		return errors.New("list: please supply an owner with -owner")
+	}
+	var owner string
+	err := conn.QueryRow(ctx, "SELECT id FROM public.user WHERE id = $1", f.owner).Scan(&owner)
+	if err != nil {
+		return fmt.Errorf("list: could not find owner, %w", err)
+	}
+
+	// The model reads notes the way the API does, tags and all
+	notes := model.Notes{}
+	each := model.ForEachNoteForOwner
+	if f.trash {
+		each = model.ForEachDeletedNoteForOwner
+	}
+	err = each(ctx, conn, owner, func(note model.Note) error {
+		if f.limit > 0 && len(notes) == f.limit {
+			return errLimit
+		}
+		notes = append(notes, note)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLimit) {
+		return fmt.Errorf("list: %w", err)
+	}
+
+	if f.format == "json" {
+		return writeJSON(w, notes)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if f.trash {
+		fmt.Fprintln(tw, "ID\tCREATED\tDELETED\tTAGS\tCONTENT")
+	} else {
+		fmt.Fprintln(tw, "ID\tCREATED\tMODIFIED\tTAGS\tCONTENT")
+	}
+	for _, n := range notes {
+		when := n.Modified
+		if n.Deleted != nil {
+			when = *n.Deleted
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", n.Id, tableTime(n.Created), tableTime(when), strings.Join(n.Tags, " "), excerpt(n.Content, 50))
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func tableTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04")
+}
+
+// excerpt is the start of the first line of the content, up to n characters
+func excerpt(content string, n int) string {
+	content, _, more := strings.Cut(strings.TrimSpace(content), "\n")
+	if utf8.RuneCountInString(content) > n {
+		content = string([]rune(content)[:n-1])
+		more = true
+	}
+	if more {
+		content += "…"
+	}
+	return content
+}
+
+// Delete a user and everything of theirs, according to command-line configuration
+func deleteCmd(ctx context.Context, f *Flags, conn *pgx.Conn) error {
+	if f.id == "" {
+		return errors.New("delete: please supply the user's id with -id")
+	}
+	// Before deleting anything, so that a mistake here doesn't leave attachments behind
+	store, where, err := attachmentStore(f)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var id string
+	err = tx.QueryRow(ctx, "SELECT id FROM public.user WHERE id = $1 FOR UPDATE", f.id).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("delete: could not find user, %w", err)
+	}
+
+	var blobKeys []string
+	err = tx.QueryRow(ctx, `SELECT ARRAY(SELECT blob_key FROM public.attachment
+		WHERE owner = $1 OR note IN (SELECT id FROM public.note WHERE owner = $1))`, id).Scan(&blobKeys)
+	if err != nil {
+		return fmt.Errorf("delete: could not find attachments, %w", err)
+	}
+
+	// Nothing refers to the user with ON DELETE CASCADE, so delete what does first. Deliveries go
+	// with their webhooks, and any attachments on the user's notes that someone else owns go with
+	// the notes.
+	deleted := map[string]int64{}
+	for _, table := range []string{"webhook", "attachment", "note"} {
+		tag, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM public.%s WHERE owner = $1", table), id)
+		if err != nil {
+			return fmt.Errorf("delete: could not delete %ss, %w", table, err)
+		}
+		deleted[table] = tag.RowsAffected()
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM public.user WHERE id = $1", id); err != nil {
+		return fmt.Errorf("delete: could not delete user, %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	log.Printf("deleted user %s, with %d notes, %d attachments and %d webhooks", id, deleted["note"], len(blobKeys), deleted["webhook"])
+	return deleteBlobs(ctx, store, where, blobKeys)
+}
+
+// Empty the app's tables, according to command-line configuration
+func resetCmd(ctx context.Context, f *Flags, conn *pgx.Conn) error {
+	store, where, err := attachmentStore(f)
+	if err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Every table but migrate's, so that the schema stays at the same version
+	rows, err := tx.Query(ctx, "SELECT tablename FROM pg_tables WHERE schemaname = 'public' AND tablename <> 'schema_migrations' ORDER BY tablename")
+	if err != nil {
+		return fmt.Errorf("reset: could not list tables, %w", err)
+	}
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("reset: could not list tables, %w", err)
+	}
+	if len(tables) == 0 {
+		log.Printf("reset: there are no tables: run the migrations")
+		return nil
+	}
+
+	var blobKeys []string
+	if err := tx.QueryRow(ctx, "SELECT ARRAY(SELECT blob_key FROM public.attachment)").Scan(&blobKeys); err != nil {
+		return fmt.Errorf("reset: could not find attachments, %w", err)
+	}
+
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		names[i] = pgx.Identifier{"public", table}.Sanitize()
+	}
+	if _, err := tx.Exec(ctx, "TRUNCATE "+strings.Join(names, ", ")+" RESTART IDENTITY"); err != nil {
+		return fmt.Errorf("reset: could not empty tables, %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	log.Printf("reset: emptied %s", strings.Join(tables, ", "))
+	return deleteBlobs(ctx, store, where, blobKeys)
+}
+
+// deleteBlobs deletes the files of attachments whose rows have been deleted
+func deleteBlobs(ctx context.Context, store blobStore, where string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if store == nil {
+		log.Printf("left the files of %d attachments", len(keys))
+		return nil
+	}
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			return fmt.Errorf("could not delete attachment file, %w", err)
+		}
+	}
+	log.Printf("deleted the files of %d attachments from %s", len(keys), where)
+	return nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// The seed command fills the database with test data, either from a fixture file or generated.
+//
+// A fixture file (YAML, or JSON) describes users and their notes. Users are named in the file,
+// and notes refer to their owner by that name; the database gives them their ids, which are
+// logged. Tags are added to the end of a note's content as #hashtags, which is how notes have
+// tags. Timestamps are RFC 3339.
+//
+//	users:
+//	  - name: alice
+//	    password: banana
+//	notes:
+//	  - owner: alice
+//	    content: Buy milk
+//	    tags: [shopping]
+//	    created: 2023-01-02T10:00:00Z
+//
+//	> go run ./cmd/test seed -file cmd/test/fixtures/example.yaml
+//
+// Without -file, users and notes are generated: notes have random content and tags, a few users
+// have most of the notes, and timestamps are spread over -span before -until. The same -seed
+// gives the same data, ids included, so seed an empty database. Rows are loaded with COPY, and
+// triggers are turned off while they are (as for a restore), so hundreds of thousands of notes
+// take seconds. All generated users have the same -password.
+//
+//	> go run ./cmd/test seed -users 1000 -notes 200000 -seed 42
+
+type fixtures struct {
+	Users []fixtureUser `yaml:"users"`
+	Notes []fixtureNote `yaml:"notes"`
+	// Notes can't be shared yet: this is here to say so, rather than to complain about an
+	// unknown field
+	Shares []yaml.Node `yaml:"shares"`
+}
+
+type fixtureUser struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	Status   string `yaml:"status"`
+}
+
+type fixtureNote struct {
+	Owner    string     `yaml:"owner"`
+	Content  string     `yaml:"content"`
+	Tags     []string   `yaml:"tags"`
+	Created  *time.Time `yaml:"created"`
+	Modified *time.Time `yaml:"modified"`
+	// Notes with this set are in the trash
+	Deleted *time.Time `yaml:"deleted"`
+}
+
+// Flags associated with the seed command
+func seedFlags(f *Flags) *flag.FlagSet {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	fs.StringVar(&f.file, "file", "", "YAML or JSON fixture file to load (default: generate data)")
+	fs.IntVar(&f.users, "users", 100, "number of users to generate")
+	fs.IntVar(&f.notes, "notes", 10000, "number of notes to generate")
+	fs.Int64Var(&f.seed, "seed", 1, "random seed: the same seed generates the same data")
+	fs.StringVar(&f.until, "until", "2023-01-01T00:00:00Z", "generated timestamps are before this (RFC 3339)")
+	fs.DurationVar(&f.span, "span", 365*24*time.Hour, "generated timestamps are spread over this long")
+	fs.StringVar(&f.passwd, "password", "password", "password of the generated users")
+	return fs
+}
+
+// Load fixtures, or generate data, according to command-line configuration
+func seedCmd(ctx context.Context, f *Flags, conn *pgx.Conn) error {
+	if f.file != "" {
+		return loadFixtures(ctx, f.file, conn)
+	}
+	if f.users < 1 || f.notes < 0 {
+		return errors.New("seed: need at least one user, and no fewer than zero notes")
+	}
+	until, err := time.Parse(time.RFC3339, f.until)
+	if err != nil {
+		return fmt.Errorf("seed: invalid -until: %w", err)
+	}
+	return generate(ctx, conn, newGenerator(f.seed, until, f.span), f.users, f.notes, f.passwd)
+}
+
+func readFixtures(path string) (*fixtures, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// YAML is a superset of JSON, so this reads both
+	var fx fixtures
+	dec := yaml.NewDecoder(file)
+	dec.KnownFields(true)
+	if err := dec.Decode(&fx); err != nil {
+		return nil, fmt.Errorf("seed: reading %s failed: %w", path, err)
+	}
+
+	if len(fx.Shares) > 0 {
+		return nil, errors.New("seed: notes can't be shared in this app yet, so shares can't be loaded")
+	}
+	names := map[string]bool{}
+	for _, u := range fx.Users {
+		if u.Name == "" || names[u.Name] {
+			return nil, fmt.Errorf("seed: every user needs a different name (got %q)", u.Name)
+		}
+		if u.Status != "" && u.Status != "active" && u.Status != "inactive" {
+			return nil, fmt.Errorf("seed: user %s: invalid status, %s", u.Name, u.Status)
+		}
+		names[u.Name] = true
+	}
+	for i, n := range fx.Notes {
+		if !names[n.Owner] {
+			return nil, fmt.Errorf("seed: note %d: no user named %q", i+1, n.Owner)
+		}
+	}
+	return &fx, nil
+}
+
+// withTags adds the tags the content doesn't already have to the end of it
+func withTags(content string, tags []string) string {
+	for _, tag := range tags {
+		tag = "#" + strings.TrimPrefix(tag, "#")
+		if !strings.Contains(content, tag) {
+			content = strings.TrimRight(content, " \n") + " " + tag
+		}
+	}
+	return content
+}
+
+func loadFixtures(ctx context.Context, path string, conn *pgx.Conn) error {
+	fx, err := readFixtures(path)
+	if err != nil {
+		return err
+	}
+
+	// All or nothing
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	ids := map[string]string{}
+	for _, u := range fx.Users {
+		if u.Password == "" {
+			u.Password = "password"
+		}
+		if u.Status == "" {
+			u.Status = "active"
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), 10)
+		if err != nil {
+			return fmt.Errorf("seed: could not hash password, %w", err)
+		}
+		var id string
+		err = tx.QueryRow(ctx, "INSERT INTO public.user (status, password) VALUES ($1, $2) RETURNING id", u.Status, hash).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("seed: could not insert user %s, %w", u.Name, err)
+		}
+		ids[u.Name] = id
+		log.Printf("user %s: id %s, password %s, base64 for auth: %s", u.Name, id, u.Password, util.BasicAuthValue(id, u.Password))
+	}
+
+	for i, n := range fx.Notes {
+		_, err := tx.Exec(ctx, `INSERT INTO public.note (owner, content, created, modified, deleted_at)
+			VALUES ($1, $2, COALESCE($3, current_timestamp), COALESCE($4, $3, current_timestamp), $5)`,
+			ids[n.Owner], withTags(n.Content, n.Tags), n.Created, n.Modified, n.Deleted)
+		if err != nil {
+			return fmt.Errorf("seed: could not insert note %d, %w", i+1, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	log.Printf("seed: loaded %d users and %d notes from %s", len(fx.Users), len(fx.Notes), path)
+	return nil
+}
+
+// generate COPYs users and notes into the database
+func generate(ctx context.Context, conn *pgx.Conn, g *generator, users int, notes int, passwd string) error {
+	start := time.Now()
+
+	// Every user has the same password, so that it's only hashed once: hashing is slow on purpose
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), 10)
+	if err != nil {
+		return fmt.Errorf("seed: could not hash password, %w", err)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Turn off triggers (and foreign key checks, which are triggers), as pg_restore does: the
+	// generator makes its own ids, and events and webhooks aren't wanted for test data.
+	// This needs the postgres user, and only lasts until the transaction ends.
+	if _, err := tx.Exec(ctx, "SET LOCAL session_replication_role = replica"); err != nil {
+		return fmt.Errorf("seed: could not turn off triggers, %w", err)
+	}
+
+	userIds := make([]string, users)
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"public", "user"}, []string{"id", "status", "password", "created", "modified"},
+		pgx.CopyFromSlice(users, func(i int) ([]any, error) {
+			userIds[i] = g.id()
+			created := g.time()
+			return []any{userIds[i], g.status(), string(hash), created, created}, nil
+		}))
+	if err != nil {
+		return fmt.Errorf("seed: could not copy users, %w", err)
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"public", "note"}, []string{"id", "owner", "content", "created", "modified", "deleted_at"},
+		pgx.CopyFromSlice(notes, func(i int) ([]any, error) {
+			created, modified, deleted := g.noteTimes()
+			return []any{g.id(), userIds[g.owner(users)], g.content(), created, modified, deleted}, nil
+		}))
+	if err != nil {
+		return fmt.Errorf("seed: could not copy notes, %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	log.Printf("seed: generated %d users and %d notes in %v", users, notes, time.Since(start).Round(time.Millisecond))
+	log.Printf("seed: e.g. user %s, password %s, base64 for auth: %s", userIds[0], passwd, util.BasicAuthValue(userIds[0], passwd))
+	return nil
+}
+
+// A generator makes up realistic test data. The same seed makes the same data.
+type generator struct {
+	rand  *rand.Rand
+	until time.Time
+	span  time.Duration
+	// Users' share of notes follows a power law: a few have lots, most have a few
+	owners *rand.Zipf
+	tags   *rand.Zipf
+}
+
+func newGenerator(seed int64, until time.Time, span time.Duration) *generator {
+	r := rand.New(rand.NewSource(seed))
+	return &generator{
+		rand:  r,
+		until: until,
+		span:  span,
+		tags:  rand.NewZipf(r, 1.2, 1, uint64(len(tagWords)-1)),
+	}
+}
+
+// id is like the ids the database makes (see gen_id in the migrations): 6 random bytes, in URL
+// safe base64
+func (g *generator) id() string {
+	b := make([]byte, 6)
+	g.rand.Read(b)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func (g *generator) status() string {
+	if g.rand.Intn(10) == 0 {
+		return "inactive"
+	}
+	return "active"
+}
+
+// time is a random time in the span
+func (g *generator) time() time.Time {
+	return g.until.Add(-time.Duration(g.rand.Int63n(int64(g.span)))).Truncate(time.Microsecond)
+}
+
+// noteTimes are when a note was created and last modified, and when it was moved to the trash,
+// if it was. Most notes aren't modified after they're created.
+func (g *generator) noteTimes() (time.Time, time.Time, *time.Time) {
+	created := g.time()
+	modified := created
+	if g.rand.Intn(3) == 0 {
+		modified = created.Add(time.Duration(g.rand.Int63n(int64(g.until.Sub(created)) + 1))).Truncate(time.Microsecond)
+	}
+	if g.rand.Intn(50) == 0 {
+		deleted := modified.Add(time.Duration(g.rand.Int63n(int64(g.until.Sub(modified)) + 1))).Truncate(time.Microsecond)
+		return created, modified, &deleted
+	}
+	return created, modified, nil
+}
+
+func (g *generator) owner(users int) int {
+	if g.owners == nil {
+		g.owners = rand.NewZipf(g.rand, 1.1, 1, uint64(users-1))
+	}
+	return int(g.owners.Uint64())
+}
+
+// content is a few sentences of made up words, with up to three tags
+func (g *generator) content() string {
+	var b strings.Builder
+	sentences := 1 + g.rand.Intn(5)
+	for s := 0; s < sentences; s++ {
+		if s > 0 {
+			if g.rand.Intn(4) == 0 {
+				b.WriteString("\n\n")
+			} else {
+				b.WriteString(" ")
+			}
+		}
+		words := 3 + g.rand.Intn(12)
+		for w := 0; w < words; w++ {
+			word := contentWords[g.rand.Intn(len(contentWords))]
+			if w == 0 {
+				word = strings.ToUpper(word[:1]) + word[1:]
+			} else {
+				b.WriteString(" ")
+			}
+			b.WriteString(word)
+		}
+		b.WriteString(".")
+	}
+
+	seen := map[uint64]bool{}
+	for t := g.rand.Intn(4); t > 0; t-- {
+		i := g.tags.Uint64()
+		if !seen[i] {
+			seen[i] = true
+			b.WriteString(" #" + tagWords[i])
+		}
+	}
+	return b.String()
+}
+
+var contentWords = strings.Fields(`
+	the a to and of in for on with at from about meeting call email remember buy milk bread
+	eggs coffee tea book read write finish start project plan idea draft review notes list
+	today tomorrow later soon next week month monday friday weekend morning evening after
+	before check send ask team client report budget design code bug fix test deploy release
+	garden walk run gym doctor dentist birthday gift party dinner lunch recipe travel flight
+	hotel train ticket pack learn practice guitar piano spanish go rust database query index
+`)
+
+var tagWords = strings.Fields(`
+	todo work personal shopping ideas reading urgent home health travel recipes music
+	learning finance family meetings projects later someday books garden fitness golang
+	postgres writing
+`)
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
 	"github.com/jackc/pgx/v5"
@@ -15,7 +16,8 @@ import (
 )
 
 // This package is a CLI tool for interacting with the database to create/update/delete data for testing. It
-// can create users and notes.
+// can create users and notes, seed the database with lots of them (see seed.go), and list and
+// delete them (see admin.go).
 //
 // Use it like this:
 //
@@ -31,6 +33,9 @@ import (
 // 		2022/10/16 16:41:42 	owner: FxoAB2gl
 // 		2022/10/16 16:41:42 	content: "Example note content"
 //
+// > go run ./cmd/test seed -users 1000 -notes 200000 -seed 42
+//		2022/10/16 16:42:10 seed: generated 1000 users and 200000 notes in 4.12s
+//
 
 type Flags struct {
 	cmd string
@@ -48,6 +53,26 @@ type Flags struct {
 	// Note flags
 	content string
 	owner   string
+
+	// Seed flags
+	file  string
+	users int
+	notes int
+	seed  int64
+	until string
+	span  time.Duration
+
+	// List, delete and reset flags
+	target         string
+	format         string
+	limit          int
+	trash          bool
+	id             string
+	attachmentsDir string
+	s3Bucket       string
+	s3Endpoint     string
+	s3Region       string
+	s3PathStyle    bool
 }
 
 func usage() {
@@ -58,21 +83,43 @@ func usage() {
 func main() {
 	f := &Flags{}
 	if len(os.Args) < 2 {
-		log.Println("error: not enough arguments, expected one of: user, note")
+		log.Println("error: not enough arguments, expected one of: user, note, seed, list, delete, reset")
 		usage()
 	}
 
 	f.cmd = os.Args[1]
 	userFlagSet := userFlags(f)
 	noteFlagSet := noteFlags(f)
+	seedFlagSet := seedFlags(f)
+	listFlagSet := listFlags(f)
+	deleteFlagSet := deleteFlags(f)
+	resetFlagSet := resetFlags(f)
 
 	var err error
 	var fs *flag.FlagSet
+	args := os.Args[2:]
 	switch f.cmd {
 	case "user":
 		fs = userFlagSet
 	case "note":
 		fs = noteFlagSet
+	case "seed":
+		fs = seedFlagSet
+	case "list", "delete":
+		// These need to know what to list or delete, e.g. list users
+		f.target, err = target(f.cmd, args)
+		if err != nil {
+			log.Printf("error: %v", err)
+			usage()
+		}
+		args = args[1:]
+		if f.cmd == "list" {
+			fs = listFlagSet
+		} else {
+			fs = deleteFlagSet
+		}
+	case "reset":
+		fs = resetFlagSet
 	default:
 		log.Println("error: command not recognised")
 		usage()
@@ -80,7 +127,7 @@ func main() {
 
 	// Attach base flags to this flag and parse
 	baseFlags(f, fs)
-	err = fs.Parse(os.Args[2:])
+	err = fs.Parse(args)
 	if err != nil {
 		log.Println("error: could not parse flags")
 		fmt.Fprintf(fs.Output(), "Usage of %s:\n", f.cmd)
@@ -103,11 +150,16 @@ func main() {
 
 	// Connect to the database
 	connString := fmt.Sprintf("postgres://postgres:%s@%s/%s?sslmode=disable", dbPasswd, f.hostport, f.db)
-	conn, err := pgx.Connect(ctx, connString)
+	conn, err := util.Connect(ctx, connString, util.DefaultBackoff, log.Printf)
 	if err != nil {
 		log.Fatalf("error connecting to database: %v", err)
 	}
 
+	// Only user and note make one thing at a time
+	if f.cmd != "user" && f.cmd != "note" {
+		f.n = 1
+	}
+
 	i := 0
 	for i < f.n {
 		i += 1
@@ -117,6 +169,14 @@ func main() {
 			err = userCmd(ctx, f, conn)
 		case "note":
 			err = noteCmd(ctx, f, conn)
+		case "seed":
+			err = seedCmd(ctx, f, conn)
+		case "list":
+			err = listCmd(ctx, f, conn)
+		case "delete":
+			err = deleteCmd(ctx, f, conn)
+		case "reset":
+			err = resetCmd(ctx, f, conn)
 		default:
 			log.Fatalf("unrecognised command: %s", f.cmd)
 		}
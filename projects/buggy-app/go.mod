@@ -3,26 +3,35 @@ module github.com/CodeYourFuture/immersive-go-course/buggy-app
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.2.0
+	github.com/andybalholm/brotli v1.1.0
+	github.com/fergusstrange/embedded-postgres v1.25.0
 	github.com/gleicon/go-httplogger v0.0.0-20170829021956-ab2410a250ca
 	github.com/golang-migrate/migrate/v4 v4.15.2
 	github.com/jackc/pgx/v5 v5.0.2
+	github.com/lib/pq v1.10.7
+	github.com/microcosm-cc/bluemonday v1.0.21
 	github.com/pashagolub/pgxmock/v2 v2.1.0
+	github.com/yuin/goldmark v1.5.4
 	golang.org/x/crypto v0.0.0-20220919173607-35f4265a4bc0
 	golang.org/x/net v0.5.0
+	golang.org/x/text v0.6.0
 	google.golang.org/grpc v1.53.0
 	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/gorilla/css v1.0.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
 	github.com/jackc/puddle/v2 v2.0.0 // indirect
-	github.com/lib/pq v1.10.7 // indirect
+	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	golang.org/x/sys v0.4.0 // indirect
-	golang.org/x/text v0.6.0 // indirect
 	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
 )
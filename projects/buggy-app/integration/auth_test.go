@@ -0,0 +1,43 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+)
+
+func TestAuthHealth(t *testing.T) {
+	s := requireStack(t)
+	if err := s.auth.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := requireStack(t)
+	id := s.newUser(t, "banana")
+
+	tests := []struct {
+		name     string
+		id       string
+		password string
+		want     string
+	}{
+		{"right password", id, "banana", auth.StateAllow},
+		{"wrong password", id, "apple", auth.StateDeny},
+		{"no such user", "nobody00", "banana", auth.StateDeny},
+		{"no id", "", "banana", auth.StateDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := s.auth.Verify(context.Background(), tt.id, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.State != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, res.State)
+			}
+		})
+	}
+}
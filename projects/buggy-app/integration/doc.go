@@ -0,0 +1,22 @@
+// Package integration tests the services end to end: the API and the auth service, running for
+// real and talking to each other over HTTP and gRPC, in front of a real Postgres with the real
+// migrations applied. The unit tests mock the database, so they can't catch bugs in the SQL; these
+// tests can.
+//
+// Postgres is started for the tests with embedded-postgres, which downloads its binaries the first
+// time (to ~/.embedded-postgres-go) and runs them as a local process. Set INTEGRATION_DATABASE_URL
+// to use a server you already have instead, e.g. the docker-compose one:
+//
+//	INTEGRATION_DATABASE_URL=postgres://postgres:$(cat volumes/secrets/postgres-passwd)@localhost:5432/postgres \
+//		go test ./integration/...
+//
+// If Postgres can't be started (there are no binaries and no network, or the tests are running as
+// root, which Postgres refuses, as they do in the docker-compose test profile), the docker-compose
+// server is used if its password is available (see util.ReadPasswd). Whichever server it is, the
+// tests make a database of their own and drop it when they're done. If there's no Postgres to be
+// had, the tests are skipped. They're also skipped with -short.
+//
+// When INTEGRATION_DATABASE_URL is set, the tests are never skipped: if the services can't be
+// started against it, every test fails. That's how CI runs them (make test-integration-compose),
+// so that a broken setup can't pass by running nothing.
+package integration
@@ -0,0 +1,201 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+)
+
+// Response bodies
+type noteBody struct {
+	Note model.Note `json:"note"`
+}
+
+type notesBody struct {
+	Notes []model.Note `json:"notes"`
+}
+
+func decode[T any](t *testing.T, data []byte) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	return v
+}
+
+func expectStatus(t *testing.T, res *http.Response, data []byte, want int) {
+	t.Helper()
+	if res.StatusCode != want {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", res.Request.Method, res.Request.URL.Path, want, res.StatusCode, data)
+	}
+}
+
+func ifMatch(etag string) http.Header {
+	return http.Header{"If-Match": {etag}}
+}
+
+func noteIds(notes []model.Note) []string {
+	ids := []string{}
+	for _, note := range notes {
+		ids = append(ids, note.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// createNote creates a note through the API and returns it, along with its ETag
+func (s *services) createNote(t *testing.T, as user, content string) (model.Note, string) {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"content": content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, data := s.do(t, as, http.MethodPost, "/1/my/notes.json", string(body), nil)
+	expectStatus(t, res, data, http.StatusCreated)
+	return decode[noteBody](t, data).Note, res.Header.Get("ETag")
+}
+
+func TestRequiresAuth(t *testing.T) {
+	s := requireStack(t)
+	alice := s.newAPIUser(t)
+
+	tests := []struct {
+		name string
+		as   user
+	}{
+		{"no credentials", user{}},
+		{"wrong password", user{id: alice.id, password: "wrong"}},
+		{"no such user", user{id: "nobody00", password: alice.password}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, data := s.do(t, tt.as, http.MethodGet, "/1/my/notes.json", "", nil)
+			expectStatus(t, res, data, http.StatusUnauthorized)
+		})
+	}
+}
+
+func TestNoteLifecycle(t *testing.T) {
+	s := requireStack(t)
+	alice := s.newAPIUser(t)
+
+	created, etag := s.createNote(t, alice, "Buy milk #shopping")
+	if created.Id == "" || created.Owner != alice.id || !reflect.DeepEqual(created.Tags, []string{"shopping"}) {
+		t.Fatalf("unexpected note: %+v", created)
+	}
+	path := "/1/my/note/" + created.Id + ".json"
+
+	res, data := s.do(t, alice, http.MethodGet, path, "", nil)
+	expectStatus(t, res, data, http.StatusOK)
+	if got := decode[noteBody](t, data).Note; got.Content != "Buy milk #shopping" {
+		t.Fatalf("unexpected content: %q", got.Content)
+	}
+
+	res, data = s.do(t, alice, http.MethodGet, "/1/my/notes.json", "", nil)
+	expectStatus(t, res, data, http.StatusOK)
+	if ids := noteIds(decode[notesBody](t, data).Notes); !reflect.DeepEqual(ids, []string{created.Id}) {
+		t.Fatalf("expected to list %s, got %v", created.Id, ids)
+	}
+
+	// Updating needs the current version...
+	res, data = s.do(t, alice, http.MethodPut, path, `{"content":"Buy oat milk #shopping"}`, ifMatch(etag))
+	expectStatus(t, res, data, http.StatusOK)
+	updated := decode[noteBody](t, data).Note
+	if updated.Content != "Buy oat milk #shopping" {
+		t.Fatalf("unexpected content after update: %q", updated.Content)
+	}
+	newEtag := res.Header.Get("ETag")
+
+	// ... so the old one doesn't work any more
+	res, data = s.do(t, alice, http.MethodPut, path, `{"content":"Buy cow milk"}`, ifMatch(etag))
+	expectStatus(t, res, data, http.StatusPreconditionFailed)
+
+	res, data = s.do(t, alice, http.MethodDelete, path, "", ifMatch(newEtag))
+	expectStatus(t, res, data, http.StatusNoContent)
+
+	// Deleted notes go to the trash
+	res, data = s.do(t, alice, http.MethodGet, "/1/my/notes.json", "", nil)
+	expectStatus(t, res, data, http.StatusOK)
+	if ids := noteIds(decode[notesBody](t, data).Notes); len(ids) != 0 {
+		t.Fatalf("expected no notes after deleting, got %v", ids)
+	}
+	res, data = s.do(t, alice, http.MethodGet, "/1/my/trash.json", "", nil)
+	expectStatus(t, res, data, http.StatusOK)
+	trash := decode[notesBody](t, data).Notes
+	if len(trash) != 1 || trash[0].Id != created.Id || trash[0].Deleted == nil {
+		t.Fatalf("expected the note in the trash, got %+v", trash)
+	}
+}
+
+func TestNotesAreOnlyTheOwners(t *testing.T) {
+	s := requireStack(t)
+	alice, bob := s.newAPIUser(t), s.newAPIUser(t)
+
+	secret, etag := s.createNote(t, alice, "Alice's secret")
+	mine, _ := s.createNote(t, bob, "Bob's note")
+	path := "/1/my/note/" + secret.Id + ".json"
+
+	res, data := s.do(t, bob, http.MethodGet, "/1/my/notes.json", "", nil)
+	expectStatus(t, res, data, http.StatusOK)
+	if ids := noteIds(decode[notesBody](t, data).Notes); !reflect.DeepEqual(ids, []string{mine.Id}) {
+		t.Fatalf("expected bob to list only %s, got %v", mine.Id, ids)
+	}
+
+	res, data = s.do(t, bob, http.MethodGet, path, "", nil)
+	if res.StatusCode == http.StatusOK || strings.Contains(string(data), "secret") {
+		t.Fatalf("bob could read alice's note: %d %s", res.StatusCode, data)
+	}
+
+	res, data = s.do(t, bob, http.MethodPut, path, `{"content":"Bob was here"}`, ifMatch(etag))
+	expectStatus(t, res, data, http.StatusNotFound)
+	res, data = s.do(t, bob, http.MethodDelete, path, "", ifMatch(etag))
+	expectStatus(t, res, data, http.StatusNotFound)
+
+	res, data = s.do(t, bob, http.MethodGet, "/1/my/search.json?q=secret", "", nil)
+	expectStatus(t, res, data, http.StatusOK)
+	if notes := decode[notesBody](t, data).Notes; len(notes) != 0 {
+		t.Fatalf("bob found alice's notes by searching: %v", noteIds(notes))
+	}
+
+	// Alice's note is as she left it
+	res, data = s.do(t, alice, http.MethodGet, path, "", nil)
+	expectStatus(t, res, data, http.StatusOK)
+	if got := decode[noteBody](t, data).Note; got.Content != "Alice's secret" {
+		t.Fatalf("alice's note changed: %q", got.Content)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := requireStack(t)
+	alice := s.newAPIUser(t)
+
+	work, _ := s.createNote(t, alice, "Finish the report #work")
+	home, _ := s.createNote(t, alice, "Fix the tap #home")
+	both, _ := s.createNote(t, alice, "Call the plumber about the report #home #work/admin")
+
+	tests := []struct {
+		query string
+		want  []model.Note
+	}{
+		{"tag=work", []model.Note{work, both}},
+		{"tag=home", []model.Note{home, both}},
+		{"q=report", []model.Note{work, both}},
+		{"q=report&tag=home", []model.Note{both}},
+		{"tag=garden", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			res, data := s.do(t, alice, http.MethodGet, "/1/my/search.json?"+tt.query, "", nil)
+			expectStatus(t, res, data, http.StatusOK)
+			if got, want := noteIds(decode[notesBody](t, data).Notes), noteIds(tt.want); !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		})
+	}
+}
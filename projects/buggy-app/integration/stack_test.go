@@ -0,0 +1,406 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/blob"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/migrations"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+// The stack is started once, by TestMain, and shared by the tests. Each test makes its own users,
+// so they don't see each other's notes.
+var (
+	stack *services
+	// Why there's no stack: either there's no Postgres to run it on (skip), or it didn't start (fail)
+	skipReason string
+	setupErr   error
+)
+
+// How long the stack has to start, including Postgres, but not downloading it
+const startTimeout = time.Minute
+
+// The services' logs, and Postgres's, are only shown if a test fails
+var logs bytes.Buffer
+
+type services struct {
+	// Base URL of the API, e.g. http://localhost:54321
+	apiUrl string
+	// A client for the auth service
+	auth *auth.GrpcClient
+	// The test database, as postgres, for setting things up behind the services' backs
+	db *pgxpool.Pool
+
+	stop func()
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Asking for a server means the tests have to run (as in CI), so they're never skipped: if
+	// the stack doesn't start, they fail
+	required := os.Getenv("INTEGRATION_DATABASE_URL") != ""
+	if testing.Short() && !required {
+		skipReason = "integration tests don't run with -short"
+	} else {
+		stack, skipReason, setupErr = start()
+	}
+
+	code := m.Run()
+	if stack != nil {
+		stack.stop()
+	}
+	if code != 0 && logs.Len() > 0 {
+		fmt.Fprintf(os.Stderr, "\nlogs:\n%s", logs.String())
+	}
+	os.Exit(code)
+}
+
+// requireStack skips or fails the test if the stack isn't running
+func requireStack(t *testing.T) *services {
+	t.Helper()
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+	if setupErr != nil {
+		t.Fatalf("the services didn't start: %v", setupErr)
+	}
+	return stack
+}
+
+// start runs the services against a database of their own. If there's no Postgres, it says why
+// the tests should be skipped instead.
+func start() (*services, string, error) {
+	logger := log.New(&logs, "", log.LstdFlags)
+	var cleanup []func()
+	stop := func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+
+	serverUrl, stopServer, err := postgres()
+	if err != nil {
+		return nil, fmt.Sprintf("no Postgres for the integration tests (set INTEGRATION_DATABASE_URL to use one): %v", err), nil
+	}
+	cleanup = append(cleanup, stopServer)
+
+	s, err := startServices(serverUrl, logger, &cleanup)
+	if err != nil {
+		stop()
+		return nil, "", err
+	}
+	s.stop = stop
+	return s, "", nil
+}
+
+// postgres returns the URL of a Postgres server to connect to as a superuser. That's the one
+// INTEGRATION_DATABASE_URL says, or one started for the tests, or failing that (as in the
+// docker-compose test profile, which runs as root) the docker-compose one.
+func postgres() (string, func(), error) {
+	if serverUrl := os.Getenv("INTEGRATION_DATABASE_URL"); serverUrl != "" {
+		return serverUrl, func() {}, nil
+	}
+	serverUrl, stop, err := embedded()
+	if err != nil {
+		if databaseUrl, defaultErr := util.DefaultDatabaseUrl(); defaultErr == nil {
+			return databaseUrl, func() {}, nil
+		}
+		return "", nil, err
+	}
+	return serverUrl, stop, nil
+}
+
+// embedded starts a Postgres server of our own
+func embedded() (string, func(), error) {
+	port, err := freePort()
+	if err != nil {
+		return "", nil, err
+	}
+	runtime, err := os.MkdirTemp("", "buggy-app-integration-")
+	if err != nil {
+		return "", nil, err
+	}
+	config := embeddedpostgres.DefaultConfig().
+		Port(uint32(port)).
+		RuntimePath(runtime).
+		DataPath(filepath.Join(runtime, "data")).
+		StartTimeout(startTimeout).
+		Logger(&logs)
+	server := embeddedpostgres.NewDatabase(config)
+	if err := server.Start(); err != nil {
+		os.RemoveAll(runtime)
+		return "", nil, err
+	}
+	return config.GetConnectionURL() + "?sslmode=disable", func() {
+		if err := server.Stop(); err != nil {
+			log.Printf("integration: stopping postgres: %v", err)
+		}
+		os.RemoveAll(runtime)
+	}, nil
+}
+
+func startServices(serverUrl string, logger *log.Logger, cleanup *[]func()) (*services, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+
+	admin, err := util.Connect(ctx, serverUrl, util.Backoff{}, logger.Printf)
+	if err != nil {
+		return nil, err
+	}
+	*cleanup = append(*cleanup, func() { admin.Close(context.Background()) })
+
+	// A database of our own, so that the tests don't disturb anything else on the server
+	name := "integration_" + randomHex(4)
+	if _, err := admin.Exec(ctx, "CREATE DATABASE "+name); err != nil {
+		return nil, err
+	}
+	*cleanup = append(*cleanup, func() {
+		if _, err := admin.Exec(context.Background(), "DROP DATABASE "+name+" WITH (FORCE)"); err != nil {
+			log.Printf("integration: dropping %s: %v", name, err)
+		}
+	})
+	databaseUrl, err := withDatabase(serverUrl, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateUp(databaseUrl); err != nil {
+		return nil, err
+	}
+
+	// The API connects as a member of the app role, as it does in docker-compose, so that
+	// row-level security applies to it. The app role's password (if it has one) isn't ours to
+	// know, so make a role of our own.
+	password := randomHex(16)
+	if _, err := admin.Exec(ctx, fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD '%s' IN ROLE app", name, password)); err != nil {
+		return nil, err
+	}
+	*cleanup = append(*cleanup, func() {
+		if _, err := admin.Exec(context.Background(), "DROP ROLE "+name); err != nil {
+			log.Printf("integration: dropping role %s: %v", name, err)
+		}
+	})
+	appUrl, err := url.Parse(databaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	appUrl.User = url.UserPassword(name, password)
+
+	db, err := util.NewPool(ctx, databaseUrl, util.PoolConfig{})
+	if err != nil {
+		return nil, err
+	}
+	*cleanup = append(*cleanup, db.Close)
+
+	authPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	apiPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := os.MkdirTemp("", "buggy-app-integration-attachments-")
+	if err != nil {
+		return nil, err
+	}
+	*cleanup = append(*cleanup, func() { os.RemoveAll(attachments) })
+
+	// The services run until the tests are done
+	runCtx, stopServices := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	*cleanup = append(*cleanup, func() {
+		stopServices()
+		wg.Wait()
+	})
+	run := func(name string, fn func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(runCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Printf("integration: %s stopped: %v", name, err)
+			}
+		}()
+	}
+	run("auth", auth.New(auth.Config{
+		Port:        authPort,
+		DatabaseUrl: databaseUrl,
+		Log:         logger,
+	}).Run)
+	run("api", api.New(api.Config{
+		Port:           apiPort,
+		Log:            logger,
+		AuthServiceUrl: fmt.Sprintf("localhost:%d", authPort),
+		DatabaseUrl:    appUrl.String(),
+		Attachments: api.AttachmentConfig{
+			Store: blob.NewFileStore(attachments),
+		},
+	}).Run)
+
+	client, err := auth.NewClient(runCtx, fmt.Sprintf("localhost:%d", authPort))
+	if err != nil {
+		return nil, err
+	}
+	*cleanup = append(*cleanup, func() { client.Close() })
+
+	s := &services{
+		apiUrl: fmt.Sprintf("http://localhost:%d", apiPort),
+		auth:   client,
+		db:     db,
+	}
+	// Ready means the API can reach the database and the auth service, and the auth service says
+	// it's serving, which means it can reach the database too
+	if err := s.waitUntilReady(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func migrateUp(databaseUrl string) error {
+	src, err := iofs.New(migrations.FS, "app")
+	if err != nil {
+		return err
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", src, databaseUrl)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := m.Up(); err != nil {
+		return fmt.Errorf("migrating failed: %w", err)
+	}
+	return nil
+}
+
+func (s *services) waitUntilReady(ctx context.Context) error {
+	for {
+		res, err := http.Get(s.apiUrl + "/readyz")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the API wasn't ready in time: last status %v, error %v", statusOf(res), err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func statusOf(res *http.Response) string {
+	if res == nil {
+		return "none"
+	}
+	return res.Status
+}
+
+// newUser adds an active user to the database, as cmd/test does, and returns their id
+func (s *services) newUser(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	err = s.db.QueryRow(context.Background(),
+		"INSERT INTO public.user (status, password) VALUES ('active', $1) RETURNING id", hash,
+	).Scan(&id)
+	if err != nil {
+		t.Fatalf("creating a user: %v", err)
+	}
+	return id
+}
+
+// A user of the API
+type user struct {
+	id       string
+	password string
+}
+
+func (s *services) newAPIUser(t *testing.T) user {
+	t.Helper()
+	password := randomHex(8)
+	return user{id: s.newUser(t, password), password: password}
+}
+
+// do makes a request to the API as the user (or nobody, if the user is empty) and returns the
+// response, with its body read
+func (s *services) do(t *testing.T, as user, method string, path string, body string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, s.apiUrl+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if as.id != "" {
+		req.Header.Set("Authorization", util.BasicAuthHeaderValue(as.id, as.password))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the body: %v", method, path, err)
+	}
+	return res, data
+}
+
+func freePort() (int, error) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+func withDatabase(serverUrl string, name string) (string, error) {
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/" + name
+	return u.String(), nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -2,4 +2,8 @@ DROP TABLE IF EXISTS public.user;
 
 DROP FUNCTION IF EXISTS update_modified_column;
 
-DROP TRIGGER IF EXISTS update_user_modified ON public.user;
\ No newline at end of file
+DROP TRIGGER IF EXISTS update_user_modified ON public.user;
+
+DROP FUNCTION IF EXISTS gen_id;
+
+DROP EXTENSION IF EXISTS "pgcrypto";
\ No newline at end of file
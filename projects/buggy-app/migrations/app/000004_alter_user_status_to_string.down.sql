@@ -1,7 +1,12 @@
 ALTER TABLE public.user ADD status_int int NOT NULL default 0;
 
+-- lint:ignore update-all-rows: undoing a migration that has already run
 UPDATE public.user SET status_int = CASE WHEN status = 'active' THEN 1 ELSE 0 END;
 
 ALTER TABLE public.user DROP COLUMN status;
 
-ALTER TABLE public.user RENAME COLUMN status_int TO status;
\ No newline at end of file
+-- lint:ignore rename: undoing a migration that has already run
+ALTER TABLE public.user RENAME COLUMN status_int TO status;
+
+-- The default was only there to fill in existing rows: the original column didn't have one
+ALTER TABLE public.user ALTER COLUMN status DROP DEFAULT;
@@ -1,7 +1,11 @@
 ALTER TABLE public.user ADD status_str VARCHAR(20) NOT NULL DEFAULT 'inactive';
 
+-- This has already run everywhere, so it is left as it was. New migrations shouldn't do this:
+-- see `migrate lint`.
+-- lint:ignore update-all-rows: already run
 UPDATE public.user SET status_str = CASE WHEN "status" = 1 THEN 'active' ELSE 'inactive' END;
 
 ALTER TABLE public.user DROP COLUMN status;
 
+-- lint:ignore rename: already run
 ALTER TABLE public.user RENAME COLUMN status_str TO status;
\ No newline at end of file
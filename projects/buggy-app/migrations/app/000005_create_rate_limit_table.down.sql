@@ -0,0 +1,3 @@
+DROP FUNCTION IF EXISTS rate_limit_take;
+
+DROP TABLE IF EXISTS public.rate_limit;
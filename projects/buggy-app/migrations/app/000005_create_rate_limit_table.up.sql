@@ -0,0 +1,41 @@
+-- Token buckets for rate limiting, shared by every API replica
+CREATE TABLE IF NOT EXISTS public.rate_limit(
+   key VARCHAR (200) PRIMARY KEY,
+   tokens double precision NOT NULL,
+   updated timestamp NOT NULL default clock_timestamp(),
+   -- When the bucket will have refilled, after which it's the same as no bucket and can be
+   -- deleted (see ratelimit.PostgresStore.Sweep)
+   full_at timestamp NOT NULL default clock_timestamp()
+);
+
+-- Take a token from a bucket, creating the bucket if it doesn't exist yet.
+-- Buckets refill at "rate" tokens per second, up to "burst" tokens.
+-- The upsert locks the row, which makes this safe when several replicas take from
+-- the same bucket at once, or one deletes it because it's full.
+CREATE OR REPLACE FUNCTION rate_limit_take(bucket_key TEXT, rate double precision, burst double precision)
+RETURNS TABLE (allowed boolean, remaining double precision) AS $$
+DECLARE
+  available double precision;
+  last_updated timestamp;
+BEGIN
+  INSERT INTO public.rate_limit AS r (key, tokens) VALUES (bucket_key, burst)
+  ON CONFLICT (key) DO UPDATE SET key = r.key
+  RETURNING r.tokens, r.updated INTO available, last_updated;
+
+  -- Refill for the time that has passed since we last looked
+  available := LEAST(burst, available + EXTRACT(EPOCH FROM (clock_timestamp() - last_updated)) * rate);
+
+  allowed := available >= 1;
+  IF allowed THEN
+    available := available - 1;
+  END IF;
+
+  UPDATE public.rate_limit
+  SET tokens = available, updated = clock_timestamp(),
+    full_at = clock_timestamp() + (burst - available) / rate * interval '1 second'
+  WHERE key = bucket_key;
+
+  remaining := available;
+  RETURN NEXT;
+END;
+$$ language 'plpgsql';
@@ -0,0 +1,5 @@
+-- Notes in the trash would reappear, so remove them first
+DELETE FROM public.note WHERE deleted_at IS NOT NULL;
+
+-- lint:ignore drop-column: undoing this migration, and the trash has been emptied
+ALTER TABLE public.note DROP COLUMN IF EXISTS deleted_at;
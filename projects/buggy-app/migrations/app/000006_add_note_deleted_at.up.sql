@@ -0,0 +1,2 @@
+-- Deleted notes go to the trash, and are purged after a while
+ALTER TABLE public.note ADD COLUMN IF NOT EXISTS deleted_at timestamp;
@@ -0,0 +1,2 @@
+-- This leaves the blobs behind, so empty the blob store too
+DROP TABLE IF EXISTS public.attachment;
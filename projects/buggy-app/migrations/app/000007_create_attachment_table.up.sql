@@ -0,0 +1,18 @@
+-- Files attached to notes. The bytes are kept in a blob store, under blob_key.
+CREATE TABLE IF NOT EXISTS public.attachment(
+   id VARCHAR (20) PRIMARY KEY,
+   note VARCHAR (20) NOT NULL REFERENCES public.note (id) ON DELETE CASCADE,
+   owner VARCHAR (20) NOT NULL REFERENCES public.user (id),
+   filename TEXT NOT NULL,
+   content_type TEXT NOT NULL,
+   size BIGINT NOT NULL,
+   blob_key TEXT NOT NULL,
+   created timestamp default current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS attachment_note_idx ON public.attachment (note);
+
+-- Add short ID trigger to attachment
+CREATE TRIGGER attachment_gen_id
+BEFORE INSERT ON public.attachment
+FOR EACH ROW EXECUTE PROCEDURE gen_id();
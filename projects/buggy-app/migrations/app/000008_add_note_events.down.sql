@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS note_notify_event ON public.note;
+
+DROP FUNCTION IF EXISTS notify_note_event;
@@ -0,0 +1,32 @@
+-- Tell anyone LISTENing on note_events when a note is created, updated or moved to the trash.
+-- The payload is small (notifications are limited to 8000 bytes), so listeners read the note
+-- itself if they need it. Notifications are only sent when the transaction commits.
+CREATE OR REPLACE FUNCTION notify_note_event()
+RETURNS TRIGGER AS $$
+DECLARE
+  event TEXT;
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    event := 'created';
+  ELSIF NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN
+    event := 'deleted';
+  ELSIF NEW.deleted_at IS NOT NULL THEN
+    -- Nothing else happens to notes in the trash that anyone needs to hear about
+    RETURN NULL;
+  ELSE
+    event := 'updated';
+  END IF;
+
+  PERFORM pg_notify('note_events', json_build_object(
+    'id', NEW.id,
+    'owner', NEW.owner,
+    'type', event,
+    'modified', NEW.modified
+  )::text);
+  RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER note_notify_event
+AFTER INSERT OR UPDATE ON public.note
+FOR EACH ROW EXECUTE PROCEDURE notify_note_event();
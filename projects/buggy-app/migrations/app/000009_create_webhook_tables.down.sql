@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS note_enqueue_webhooks ON public.note;
+
+DROP FUNCTION IF EXISTS enqueue_note_webhooks;
+
+DROP TABLE IF EXISTS public.webhook_delivery;
+
+DROP TABLE IF EXISTS public.webhook;
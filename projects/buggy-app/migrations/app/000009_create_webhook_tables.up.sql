@@ -0,0 +1,76 @@
+-- Webhooks: URLs that are sent a signed request when one of the owner's notes changes
+CREATE TABLE IF NOT EXISTS public.webhook(
+   id VARCHAR (20) PRIMARY KEY,
+   owner VARCHAR (20) NOT NULL REFERENCES public.user (id),
+   url TEXT NOT NULL,
+   secret TEXT NOT NULL,
+   created timestamp default current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS webhook_owner_idx ON public.webhook (owner);
+
+CREATE TRIGGER webhook_gen_id
+BEFORE INSERT ON public.webhook
+FOR EACH ROW EXECUTE PROCEDURE gen_id();
+
+-- The queue of requests to send. Deliveries are pending until they are sent successfully
+-- (delivered) or have failed too many times (dead).
+CREATE TABLE IF NOT EXISTS public.webhook_delivery(
+   id VARCHAR (20) PRIMARY KEY,
+   webhook VARCHAR (20) NOT NULL REFERENCES public.webhook (id) ON DELETE CASCADE,
+   event TEXT NOT NULL,
+   payload JSONB NOT NULL,
+   status TEXT NOT NULL default 'pending',
+   attempts INT NOT NULL default 0,
+   next_attempt timestamp default current_timestamp,
+   last_status INT,
+   last_error TEXT,
+   created timestamp default current_timestamp,
+   delivered timestamp
+);
+
+-- Workers look for pending deliveries that are due
+CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON public.webhook_delivery (next_attempt) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_delivery_webhook_idx ON public.webhook_delivery (webhook, created);
+
+CREATE TRIGGER webhook_delivery_gen_id
+BEFORE INSERT ON public.webhook_delivery
+FOR EACH ROW EXECUTE PROCEDURE gen_id();
+
+-- Queue a delivery to each of the owner's webhooks when a note is created, updated or moved to
+-- the trash. Doing it here means the delivery is queued in the same transaction as the change,
+-- so neither can happen without the other.
+CREATE OR REPLACE FUNCTION enqueue_note_webhooks()
+RETURNS TRIGGER AS $$
+DECLARE
+  event TEXT;
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    event := 'note.created';
+  ELSIF NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN
+    event := 'note.deleted';
+  ELSIF NEW.deleted_at IS NOT NULL THEN
+    RETURN NULL;
+  ELSE
+    event := 'note.updated';
+  END IF;
+
+  INSERT INTO public.webhook_delivery (webhook, event, payload)
+  SELECT id, event, jsonb_build_object(
+    'event', event,
+    'note', jsonb_build_object(
+      'id', NEW.id,
+      'owner', NEW.owner,
+      'content', NEW.content,
+      'created', to_char(NEW.created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+      'modified', to_char(NEW.modified, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+    )
+  )
+  FROM public.webhook WHERE owner = NEW.owner;
+  RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER note_enqueue_webhooks
+AFTER INSERT OR UPDATE ON public.note
+FOR EACH ROW EXECUTE PROCEDURE enqueue_note_webhooks();
@@ -0,0 +1,12 @@
+DROP FUNCTION IF EXISTS public.purge_deleted_notes(bigint, integer);
+
+DROP POLICY IF EXISTS note_owner ON public.note;
+
+ALTER TABLE public.note DISABLE ROW LEVEL SECURITY;
+
+ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE USAGE, SELECT ON SEQUENCES FROM app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE SELECT, INSERT, UPDATE, DELETE ON TABLES FROM app;
+
+REVOKE ALL ON ALL SEQUENCES IN SCHEMA public FROM app;
+REVOKE ALL ON ALL TABLES IN SCHEMA public FROM app;
+REVOKE USAGE ON SCHEMA public FROM app;
@@ -0,0 +1,60 @@
+-- The API connects as the unprivileged app role (created by volumes/init), so that Postgres can
+-- hold it to the row-level security policy below. Create it if it's missing, so that this runs
+-- against databases that weren't set up that way. cmd/migrate gives it its password afterwards.
+DO $$
+BEGIN
+   IF NOT EXISTS (SELECT FROM pg_catalog.pg_roles WHERE rolname = 'app') THEN
+      CREATE ROLE app LOGIN;
+   END IF;
+END
+$$;
+
+-- The app role can use the tables, but doesn't own them, so row-level security applies to it.
+-- It doesn't need public.user, which has password hashes in it: the auth service checks them.
+GRANT USAGE ON SCHEMA public TO app;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO app;
+REVOKE ALL ON public.user FROM app;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO app;
+
+-- Tables created by later migrations can be used by the app role too
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO app;
+
+-- A connection can only see and change the notes of the user in its app.current_user setting,
+-- which the API sets for each transaction. When it isn't set, current_setting(..., true) is NULL
+-- and no notes match.
+ALTER TABLE public.note ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY note_owner ON public.note
+   USING (owner = current_setting('app.current_user', true))
+   WITH CHECK (owner = current_setting('app.current_user', true));
+
+-- Purging the trash works on everyone's notes. The app role mustn't be able to get past the
+-- policy itself, or anything the API runs could, so instead it calls this function, which runs as
+-- its owner (postgres, which row-level security doesn't apply to) and only deletes notes that have
+-- been in the trash for longer than retention_us microseconds, batch_size at a time. It returns
+-- how many it deleted, and the blob keys of their attachments, which the cascade deletes.
+CREATE OR REPLACE FUNCTION public.purge_deleted_notes(retention_us bigint, batch_size integer)
+RETURNS TABLE (purged_count bigint, blob_keys text[])
+LANGUAGE sql
+SECURITY DEFINER
+SET search_path = pg_catalog, pg_temp
+AS $$
+   WITH purged AS (
+      DELETE FROM public.note WHERE id IN (
+         SELECT id FROM public.note
+         WHERE deleted_at < current_timestamp - retention_us * interval '1 microsecond'
+         LIMIT batch_size
+      ) RETURNING id
+   )
+   SELECT
+      (SELECT count(*) FROM purged),
+      ARRAY(SELECT blob_key FROM public.attachment WHERE note IN (SELECT id FROM purged))
+$$;
+
+REVOKE ALL ON FUNCTION public.purge_deleted_notes(bigint, integer) FROM PUBLIC;
+GRANT EXECUTE ON FUNCTION public.purge_deleted_notes(bigint, integer) TO app;
+
+-- gen_id() checks that a new id isn't taken by looking for it, and now only sees the user's own
+-- notes. A clash with someone else's note is still caught by the primary key, and ids are random
+-- enough that it shouldn't happen.
@@ -0,0 +1 @@
+DROP INDEX CONCURRENTLY IF EXISTS note_deleted_at_idx;
@@ -0,0 +1,4 @@
+-- The purger looks for old deleted notes, which are a small fraction of all notes. The index is
+-- built without blocking writes to note, which can't be done in a transaction, so it has a
+-- migration of its own.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS note_deleted_at_idx ON public.note (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1 @@
+DROP INDEX CONCURRENTLY IF EXISTS note_owner_modified_idx;
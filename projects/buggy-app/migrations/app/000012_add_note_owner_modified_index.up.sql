@@ -0,0 +1,4 @@
+-- Clients that reconnect to the events stream ask for the owner's notes modified since the last
+-- event they saw. The index is built without blocking writes to note, which can't be done in a
+-- transaction, so it has a migration of its own.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS note_owner_modified_idx ON public.note (owner, modified, id);
@@ -0,0 +1,10 @@
+// Package migrations has the SQL migrations for each database, in a directory named after the
+// database. They are embedded in the binary, so the migrate command doesn't need them on disk.
+package migrations
+
+import "embed"
+
+// FS holds the migrations, e.g. app/000001_create_users_table.up.sql migrates the app database
+//
+//go:embed */*.sql
+var FS embed.FS
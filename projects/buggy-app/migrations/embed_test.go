@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/migrations/lint"
+)
+
+// Every migration has to be undoable, or "down" and "goto" get stuck on it
+func TestMigrationsHaveUpAndDown(t *testing.T) {
+	dirs, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for _, dir := range dirs {
+		src, err := iofs.New(FS, dir.Name())
+		if err != nil {
+			t.Fatalf("%s: %v", dir.Name(), err)
+		}
+		for version, err := src.First(); err == nil; version, err = src.Next(version) {
+			if r, _, err := src.ReadUp(version); err != nil {
+				t.Errorf("%s: %v", dir.Name(), err)
+			} else {
+				r.Close()
+			}
+			if r, _, err := src.ReadDown(version); err != nil {
+				t.Errorf("%s: %v", dir.Name(), err)
+			} else {
+				r.Close()
+			}
+		}
+	}
+}
+
+// Risky migrations have to be changed, or marked as fine with a lint:ignore comment
+func TestLint(t *testing.T) {
+	dirs, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		findings, err := lint.Dir(FS, dir.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range findings {
+			t.Error(f)
+		}
+	}
+}
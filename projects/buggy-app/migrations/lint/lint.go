@@ -0,0 +1,183 @@
+// Package lint looks for risky operations in migrations: ones that lose data, that hold locks
+// on a busy table for a long time, or that break code that's still running while they're
+// applied. It reads the SQL, so it can't know how big a table is; anything it flags should be
+// thought about, and then either changed or marked as fine.
+//
+// A statement is marked as fine with a comment before it, giving the rule and why:
+//
+//	-- lint:ignore update-all-rows: the user table only has a handful of rows
+//	UPDATE public.user SET status_str = ...;
+package lint
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A Finding is a risky statement in a migration
+type Finding struct {
+	File string
+	Line int
+	Rule string
+	// What's risky about it, and what to do instead
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", f.File, f.Line, f.Rule, f.Message)
+}
+
+// A rule checks one statement of a migration
+type rule struct {
+	name    string
+	message string
+	// Whether the statement breaks the rule. m has what's known about the whole migration.
+	check func(s statement, m *migration) bool
+}
+
+var (
+	alterTable  = regexp.MustCompile(`(?i)^ALTER TABLE (?:IF EXISTS )?(?:ONLY )?(\S+)`)
+	createTable = regexp.MustCompile(`(?i)^CREATE (?:UNLOGGED )?TABLE (?:IF NOT EXISTS )?([^\s(]+)`)
+	createIndex = regexp.MustCompile(`(?i)^CREATE (?:UNIQUE )?INDEX (CONCURRENTLY )?(?:IF NOT EXISTS )?(?:\S+ )?ON (?:ONLY )?([^\s(]+)`)
+	update      = regexp.MustCompile(`(?i)^UPDATE (?:ONLY )?(\S+)`)
+	insertFrom  = regexp.MustCompile(`(?i)^INSERT INTO .*\bSELECT\b`)
+	dropTable   = regexp.MustCompile(`(?i)^DROP TABLE\b`)
+	dropColumn  = regexp.MustCompile(`(?i)\bDROP COLUMN\b`)
+	alterType   = regexp.MustCompile(`(?i)\bALTER (?:COLUMN )?\S+ (?:SET DATA )?TYPE\b`)
+	rename      = regexp.MustCompile(`(?i)\bRENAME\b`)
+	where       = regexp.MustCompile(`(?i)\bWHERE\b`)
+	// Adding a column with one of these defaults (or a serial type) has to fill in a different
+	// value for every row, so the table is rewritten. Other defaults are stored once.
+	volatileDefault = regexp.MustCompile(`(?i)\bADD (?:COLUMN )?.*(?:\bDEFAULT .*\b(?:random|clock_timestamp|timeofday|gen_random_uuid|gen_random_bytes|uuid_generate_v[14]|nextval)\s*\(|\b(?:SMALL|BIG)?SERIAL\b)`)
+)
+
+var rules = []rule{
+	{
+		name:    "drop-column",
+		message: "dropping a column loses its data for good; copy it somewhere first (e.g. with an UPDATE in the same migration), or drop it in a later release once nothing reads it",
+		check: func(s statement, m *migration) bool {
+			return s.alters(m) && dropColumn.MatchString(s.sql) && !m.backfills
+		},
+	},
+	{
+		name:    "drop-table",
+		message: "dropping a table loses its data for good; make sure nothing still uses it, and that it's backed up",
+		check: func(s statement, m *migration) bool {
+			return m.up && dropTable.MatchString(s.sql)
+		},
+	},
+	{
+		name:    "index-not-concurrent",
+		message: "building an index blocks writes to the table until it's done; use CREATE INDEX CONCURRENTLY, in a migration of its own (it can't run in a transaction)",
+		check: func(s statement, m *migration) bool {
+			match := createIndex.FindStringSubmatch(s.sql)
+			return match != nil && match[1] == "" && !m.creates(match[2])
+		},
+	},
+	{
+		name:    "alter-column-type",
+		message: "changing a column's type rewrites the table, with reads and writes blocked; add a new column, backfill it in batches and switch over instead",
+		check: func(s statement, m *migration) bool {
+			return s.alters(m) && alterType.MatchString(s.sql)
+		},
+	},
+	{
+		name:    "volatile-default",
+		message: "adding a column with a volatile default rewrites the table, with reads and writes blocked; add it without the default, then backfill it in batches",
+		check: func(s statement, m *migration) bool {
+			return s.alters(m) && volatileDefault.MatchString(s.sql)
+		},
+	},
+	{
+		name:    "rename",
+		message: "renaming breaks any code that's still running with the old name while the migration is applied; add the new name alongside the old one and remove the old one later",
+		check: func(s statement, m *migration) bool {
+			return s.alters(m) && rename.MatchString(s.sql)
+		},
+	},
+	{
+		name:    "update-all-rows",
+		message: "updating every row rewrites the whole table in one transaction, holding row locks until it's done; backfill in batches instead",
+		check: func(s statement, m *migration) bool {
+			match := update.FindStringSubmatch(s.sql)
+			return match != nil && !where.MatchString(s.sql) && !m.creates(match[1])
+		},
+	},
+}
+
+// What's known about a whole migration file
+type migration struct {
+	up bool
+	// Tables the migration creates, which nobody can be using yet
+	created map[string]bool
+	// Whether the migration copies data, before dropping it
+	backfills bool
+}
+
+// tableName normalises a table name, so that public.user, "user" and user are the same
+func tableName(name string) string {
+	name = strings.ToLower(strings.ReplaceAll(name, `"`, ""))
+	return strings.TrimPrefix(name, "public.")
+}
+
+func (m *migration) creates(table string) bool {
+	return m.created[tableName(table)]
+}
+
+// alters says whether the statement alters a table that the migration didn't create
+func (s statement) alters(m *migration) bool {
+	match := alterTable.FindStringSubmatch(s.sql)
+	return match != nil && !m.creates(match[1])
+}
+
+// File lints one migration. name is the file name, which says whether it's an up or down
+// migration: e.g. 000004_alter_user_status_to_string.up.sql.
+func File(name string, sql string) []Finding {
+	statements := split(sql)
+
+	m := &migration{up: !strings.HasSuffix(name, ".down.sql"), created: map[string]bool{}}
+	for _, s := range statements {
+		if match := createTable.FindStringSubmatch(s.sql); match != nil {
+			m.created[tableName(match[1])] = true
+		}
+		if update.MatchString(s.sql) || insertFrom.MatchString(s.sql) {
+			m.backfills = true
+		}
+	}
+
+	var findings []Finding
+	for _, s := range statements {
+		for _, r := range rules {
+			if s.ignores(r.name) || !r.check(s, m) {
+				continue
+			}
+			findings = append(findings, Finding{File: name, Line: s.line, Rule: r.name, Message: r.message})
+		}
+	}
+	return findings
+}
+
+// Dir lints each .sql file in a directory of fsys
+func Dir(fsys fs.FS, dir string) ([]Finding, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		name := path.Join(dir, entry.Name())
+		sql, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, File(name, string(sql))...)
+	}
+	return findings, nil
+}
@@ -0,0 +1,117 @@
+package lint
+
+import (
+	"reflect"
+	"testing"
+)
+
+func rulesOf(findings []Finding) []string {
+	var names []string
+	for _, f := range findings {
+		names = append(names, f.Rule)
+	}
+	return names
+}
+
+func TestFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		sql      string
+		expected []string
+	}{
+		{
+			name: "new table",
+			file: "000001_create.up.sql",
+			sql: `CREATE TABLE IF NOT EXISTS public.thing(id TEXT PRIMARY KEY, n serial);
+CREATE INDEX thing_idx ON public.thing (id);
+ALTER TABLE public.thing RENAME COLUMN n TO m;`,
+		},
+		{
+			name:     "drop column without backfill",
+			file:     "000002_drop.up.sql",
+			sql:      `ALTER TABLE public.note DROP COLUMN deleted_at;`,
+			expected: []string{"drop-column"},
+		},
+		{
+			name: "drop column after backfill",
+			file: "000002_drop.up.sql",
+			sql: `ALTER TABLE public.note ADD COLUMN gone_at timestamp;
+UPDATE public.note SET gone_at = deleted_at WHERE deleted_at IS NOT NULL;
+ALTER TABLE public.note DROP COLUMN deleted_at;`,
+		},
+		{
+			name:     "drop table",
+			file:     "000002_drop.up.sql",
+			sql:      `DROP TABLE public.note;`,
+			expected: []string{"drop-table"},
+		},
+		{
+			name: "drop table in down migration",
+			file: "000002_create.down.sql",
+			sql:  `DROP TABLE public.note;`,
+		},
+		{
+			name: "index",
+			file: "000003_index.up.sql",
+			sql: `CREATE INDEX IF NOT EXISTS note_idx ON public.note (owner);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS note_idx ON public.note (owner);`,
+			expected: []string{"index-not-concurrent"},
+		},
+		{
+			name: "rewrites",
+			file: "000004_alter.up.sql",
+			sql: `ALTER TABLE public.note ALTER COLUMN content TYPE varchar(100);
+ALTER TABLE public.note ADD COLUMN n bigserial;
+ALTER TABLE public.note ADD COLUMN at timestamp DEFAULT clock_timestamp();
+ALTER TABLE public.note ADD COLUMN created_at timestamp DEFAULT now();
+UPDATE public.note SET content = '';`,
+			expected: []string{"alter-column-type", "volatile-default", "volatile-default", "update-all-rows"},
+		},
+		{
+			name: "ignored",
+			file: "000004_alter.up.sql",
+			sql: `-- lint:ignore update-all-rows, rename: there are only a few users
+UPDATE public.user SET status = 'active';
+ALTER TABLE public.user RENAME COLUMN status TO state;
+ALTER TABLE public.user RENAME COLUMN state TO status;`,
+			expected: []string{"rename", "rename"},
+		},
+		{
+			name: "SQL in strings, comments and functions",
+			file: "000005_function.up.sql",
+			sql: `-- ALTER TABLE public.note DROP COLUMN content;
+/* UPDATE public.note SET content = ''; */
+INSERT INTO public.log (message) VALUES ('ALTER TABLE public.note DROP COLUMN content; it''s gone');
+CREATE OR REPLACE FUNCTION f() RETURNS void AS $body$
+BEGIN
+  UPDATE public.note SET content = '';
+END;
+$body$ language 'plpgsql';`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rulesOf(File(tt.file, tt.sql))
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestFileLines(t *testing.T) {
+	sql := `-- Make room
+ALTER TABLE public.note ADD COLUMN x int;
+
+/* a
+   comment */
+CREATE INDEX note_x_idx
+  ON public.note (x);`
+
+	findings := File("000001_x.up.sql", sql)
+	if len(findings) != 1 || findings[0].Line != 6 {
+		t.Fatalf("expected one finding on line 6, got %v", findings)
+	}
+}
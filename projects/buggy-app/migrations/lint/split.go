@@ -0,0 +1,126 @@
+package lint
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A statement of a migration, ready to match rules against: comments are taken out, the
+// contents of strings and function bodies are emptied (so that SQL inside them doesn't match),
+// and whitespace is collapsed to single spaces.
+type statement struct {
+	sql string
+	// Line of the file it starts on
+	line int
+	// Rules that a lint:ignore comment before it says are fine
+	ignored []string
+}
+
+func (s statement) ignores(rule string) bool {
+	for _, r := range s.ignored {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// e.g. -- lint:ignore drop-column, rename: why it's fine
+var ignoreComment = regexp.MustCompile(`^--\s*lint:ignore\s+([a-z-]+(?:\s*,\s*[a-z-]+)*)`)
+
+// A dollar quote starts a function body: $$ or $tag$
+var dollarQuote = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// split splits a migration into statements at the semicolons that aren't in a string, quoted
+// name, comment or function body
+func split(sql string) []statement {
+	var statements []statement
+	var b strings.Builder
+	var ignored []string
+	line, start := 1, 0
+
+	finish := func() {
+		text := strings.TrimSpace(spaces.ReplaceAllString(b.String(), " "))
+		if text != "" {
+			statements = append(statements, statement{sql: text, line: start, ignored: ignored})
+			ignored = nil
+		}
+		b.Reset()
+		start = 0
+	}
+	// skip moves past text that doesn't go in the statement, counting its lines
+	skip := func(text string) {
+		line += strings.Count(text, "\n")
+	}
+
+	for i := 0; i < len(sql); {
+		rest := sql[i:]
+		if start == 0 && !strings.ContainsRune(" \t\r\n;", rune(rest[0])) && !strings.HasPrefix(rest, "--") && !strings.HasPrefix(rest, "/*") {
+			start = line
+		}
+
+		switch {
+		case strings.HasPrefix(rest, "--"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			if match := ignoreComment.FindStringSubmatch(rest[:end]); match != nil {
+				for _, r := range strings.Split(match[1], ",") {
+					ignored = append(ignored, strings.TrimSpace(r))
+				}
+			}
+			b.WriteByte(' ')
+			i += end
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest, "*/")
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += 2
+			}
+			skip(rest[:end])
+			b.WriteByte(' ')
+			i += end
+		case rest[0] == '\'' || rest[0] == '"':
+			// Quotes inside are doubled, which reads as two strings next to each other
+			end := closing(rest, rest[:1])
+			skip(rest[:end])
+			if rest[0] == '"' {
+				// Keep quoted names, e.g. "user", for rules that look at them
+				b.WriteString(rest[:end])
+			} else {
+				b.WriteString("''")
+			}
+			i += end
+		case dollarQuote.MatchString(rest):
+			end := closing(rest, dollarQuote.FindString(rest))
+			skip(rest[:end])
+			b.WriteString("$$ $$")
+			i += end
+		case rest[0] == ';':
+			finish()
+			i++
+		default:
+			if rest[0] == '\n' {
+				line++
+			}
+			b.WriteByte(rest[0])
+			i++
+		}
+	}
+	finish()
+	return statements
+}
+
+// closing finds the end of text that starts with the quote open, just after where it's closed
+// again (or the end of sql, if it isn't)
+func closing(sql, open string) int {
+	end := strings.Index(sql[len(open):], open)
+	if end < 0 {
+		return len(sql)
+	}
+	return len(open) + end + len(open)
+}
@@ -0,0 +1,197 @@
+package migrations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+// The round trip test applies each migration, undoes it and applies it again, in a throwaway
+// database, checking that undoing it puts the schema back the way it was and that applying it
+// again gets the same schema as the first time. It needs a Postgres server to create the
+// database on: $MIGRATIONS_TEST_DATABASE_URL, or the docker-compose one if the postgres password
+// is available (see util.ReadPasswd). Otherwise it's skipped.
+
+// Queries that describe the schema, one row per thing in it. Anything owned by an extension is
+// left out: it's the extension's business.
+var schemaQueries = map[string]string{
+	"extension": `SELECT extname FROM pg_extension WHERE extname <> 'plpgsql'`,
+	"column": `SELECT table_name, column_name, data_type, character_maximum_length, is_nullable, column_default
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name <> 'schema_migrations'`,
+	"constraint": `SELECT conrelid::regclass::text, conname, pg_get_constraintdef(oid)
+		FROM pg_constraint WHERE connamespace = 'public'::regnamespace AND conrelid <> 'public.schema_migrations'::regclass`,
+	"index": `SELECT tablename, indexname, indexdef FROM pg_indexes
+		WHERE schemaname = 'public' AND tablename <> 'schema_migrations'`,
+	"trigger": `SELECT tgrelid::regclass::text, tgname, pg_get_triggerdef(oid) FROM pg_trigger WHERE NOT tgisinternal`,
+	"function": `SELECT p.proname, pg_get_function_identity_arguments(p.oid), md5(p.prosrc)
+		FROM pg_proc p
+		WHERE p.pronamespace = 'public'::regnamespace
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = p.oid AND d.deptype = 'e')`,
+	"row security": `SELECT relname, relrowsecurity FROM pg_class
+		WHERE relnamespace = 'public'::regnamespace AND relkind = 'r'`,
+	"policy": `SELECT tablename, policyname, cmd, qual, with_check FROM pg_policies WHERE schemaname = 'public'`,
+	"grant": `SELECT grantee, table_name, privilege_type FROM information_schema.role_table_grants
+		WHERE table_schema = 'public' AND table_name <> 'schema_migrations'`,
+}
+
+// schema describes the database's schema as sorted lines, so that two can be compared
+func schema(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	var lines []string
+	for kind, query := range schemaQueries {
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+		for rows.Next() {
+			values, err := rows.Values()
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			fields := []string{kind}
+			for _, v := range values {
+				fields = append(fields, fmt.Sprint(v))
+			}
+			lines = append(lines, strings.Join(fields, " | "))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// diff lists the lines that are only in a (-) or only in b (+)
+func diff(a, b []string) []string {
+	count := map[string]int{}
+	for _, line := range a {
+		count[line]--
+	}
+	for _, line := range b {
+		count[line]++
+	}
+	var lines []string
+	for line, n := range count {
+		switch {
+		case n < 0:
+			lines = append(lines, "- "+line)
+		case n > 0:
+			lines = append(lines, "+ "+line)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func serverUrl(t *testing.T) string {
+	if databaseUrl := os.Getenv("MIGRATIONS_TEST_DATABASE_URL"); databaseUrl != "" {
+		return databaseUrl
+	}
+	databaseUrl, err := util.DefaultDatabaseUrl()
+	if err != nil {
+		t.Skip("no Postgres to test migrations against: set MIGRATIONS_TEST_DATABASE_URL")
+	}
+	return databaseUrl
+}
+
+// throwawayDatabase creates an empty database, which is dropped when the test is done
+func throwawayDatabase(t *testing.T, ctx context.Context) string {
+	u, err := url.Parse(serverUrl(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := util.Connect(ctx, u.String(), util.Backoff{}, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close(context.Background()) })
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := "migrations_roundtrip_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec(ctx, "CREATE DATABASE "+name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(context.Background(), "DROP DATABASE "+name+" WITH (FORCE)"); err != nil {
+			t.Logf("dropping %s: %v", name, err)
+		}
+	})
+
+	u.Path = "/" + name
+	return u.String()
+}
+
+func TestRoundTrip(t *testing.T) {
+	dirs, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range dirs {
+		t.Run(dir.Name(), func(t *testing.T) {
+			ctx := context.Background()
+			databaseUrl := throwawayDatabase(t, ctx)
+
+			src, err := iofs.New(FS, dir.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := migrate.NewWithSourceInstance("iofs", src, databaseUrl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			conn, err := pgx.Connect(ctx, databaseUrl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(ctx)
+
+			step := func(n int) []string {
+				t.Helper()
+				if err := m.Steps(n); err != nil {
+					t.Fatalf("steps %d: %v", n, err)
+				}
+				s, err := schema(ctx, conn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+
+			before, err := schema(ctx, conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for version, err := src.First(); err == nil; version, err = src.Next(version) {
+				up := step(1)
+				if d := diff(before, step(-1)); len(d) > 0 {
+					t.Errorf("undoing version %d doesn't put the schema back:\n%s", version, strings.Join(d, "\n"))
+				}
+				if d := diff(up, step(1)); len(d) > 0 {
+					t.Errorf("applying version %d again gives a different schema:\n%s", version, strings.Join(d, "\n"))
+				}
+				before = up
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// This package loads a binary's configuration from (in order of precedence, highest first):
+//
+//  1. command line flags
+//  2. environment variables
+//  3. a YAML or TOML file, given with -config or $CONFIG_FILE
+//  4. the defaults: whatever the struct holds before it's loaded
+//
+// A configuration is a struct whose fields are tagged with their name:
+//
+//	type Config struct {
+//		Port        int    `config:"port" usage:"port the server will listen on"`
+//		DatabaseUrl string `config:"database-url" usage:"Postgres connection URL"`
+//		ApiKey      string `config:"api-key" flag:"-" secret:"true"`
+//	}
+//
+// The name is the flag (-database-url), the key in the file (database-url or database_url) and,
+// in upper case with underscores, the environment variable (DATABASE_URL), unless it's tagged
+// with a different env. flag:"-" means that a setting can't be given as a flag, which is for
+// secrets that shouldn't show up in ps. Secrets are redacted by -print-config, as are passwords
+// in URLs, including lists of them.
+//
+// Fields can be strings, bools, ints, int64s, float64s or time.Durations, or embedded structs
+// of settings, like Database. If the struct has a Validate method, it's called once everything is
+// loaded.
+
+// Validator is implemented by configurations that can check themselves. Validate can also fill in
+// settings that depend on others.
+type Validator interface {
+	Validate() error
+}
+
+// Load loads the configuration into cfg, which must be a pointer to a struct, from os.Args,
+// the environment and the config file. If -print-config is given, it prints the configuration and
+// exits.
+func Load(cfg interface{}) error {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	printConfig, err := load(fs, os.Args[1:], os.LookupEnv, cfg)
+	if err != nil {
+		return err
+	}
+	if printConfig {
+		Print(os.Stdout, cfg)
+		os.Exit(0)
+	}
+	return nil
+}
+
+// A setting is a field of the configuration struct. It's a flag.Value, so that it can be set by
+// flags, and everything else sets it the same way.
+type setting struct {
+	name   string
+	env    string
+	usage  string
+	flag   bool
+	secret bool
+	value  reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (s *setting) String() string {
+	if !s.value.IsValid() {
+		return ""
+	}
+	if s.value.Type() == durationType {
+		return time.Duration(s.value.Int()).String()
+	}
+	return fmt.Sprint(s.value.Interface())
+}
+
+func (s *setting) Set(v string) error {
+	switch {
+	case s.value.Type() == durationType:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(d))
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(v)
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	case s.value.Kind() == reflect.Int, s.value.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(n)
+	case s.value.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetFloat(f)
+	}
+	return nil
+}
+
+// IsBoolFlag lets bool settings be given as just -name
+func (s *setting) IsBoolFlag() bool {
+	return s.value.Kind() == reflect.Bool
+}
+
+// Find the settings in a configuration struct
+func settingsOf(cfg interface{}) ([]*setting, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config: %T is not a pointer to a struct", cfg)
+	}
+	v = v.Elem()
+
+	settings := []*setting{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		// Settings shared by several binaries are in structs that are embedded in each
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embedded, err := settingsOf(v.Field(i).Addr().Interface())
+			if err != nil {
+				return nil, err
+			}
+			settings = append(settings, embedded...)
+			continue
+		}
+		name := field.Tag.Get("config")
+		if name == "" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		default:
+			return nil, fmt.Errorf("config: %s has unsupported type %s", field.Name, field.Type)
+		}
+
+		env := field.Tag.Get("env")
+		if env == "" {
+			env = strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		}
+		settings = append(settings, &setting{
+			name:   name,
+			env:    env,
+			usage:  field.Tag.Get("usage"),
+			flag:   field.Tag.Get("flag") != "-",
+			secret: field.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return settings, nil
+}
+
+// load does the work of Load, reading flags from args with fs and environment variables with
+// lookupEnv. It returns whether -print-config was given.
+func load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool), cfg interface{}) (bool, error) {
+	settings, err := settingsOf(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range settings {
+		if s.flag {
+			fs.Var(s, s.name, s.usage)
+		}
+	}
+	configFile := fs.String("config", "", "YAML or TOML file to read settings from (or $CONFIG_FILE)")
+	printConfig := fs.Bool("print-config", false, "print the configuration, with secrets redacted, and exit")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+
+	// Flags win over everything else, so remember what they were set to, and set them again at
+	// the end
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := loadFile(path, settings); err != nil {
+			return false, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := s.Set(v); err != nil {
+				return false, fmt.Errorf("config: invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := flags[s.name]; ok {
+			s.Set(v)
+		}
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return false, fmt.Errorf("config: %w", err)
+		}
+	}
+	return *printConfig, nil
+}
+
+// Read settings from a YAML or TOML file, depending on its extension. Keys that aren't
+// settings are an error, so that typos don't go unnoticed.
+func loadFile(path string, settings []*setting) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &values)
+	case ".toml":
+		err = toml.Unmarshal(b, &values)
+	default:
+		return fmt.Errorf("config: %s is not a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config: could not read %s: %w", path, err)
+	}
+
+	byName := map[string]*setting{}
+	for _, s := range settings {
+		byName[s.name] = s
+	}
+	for key, value := range values {
+		s, ok := byName[strings.ReplaceAll(key, "_", "-")]
+		if !ok {
+			return fmt.Errorf("config: unknown setting %q in %s", key, path)
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return fmt.Errorf("config: %q in %s must be a single value", key, path)
+		}
+		if err := s.Set(fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("config: invalid %q in %s: %w", key, path, err)
+		}
+	}
+	return nil
+}
+
+const redacted = "[redacted]"
+
+// Print writes the configuration as name=value lines, sorted by name, with secrets redacted
+func Print(w io.Writer, cfg interface{}) error {
+	settings, err := settingsOf(cfg)
+	if err != nil {
+		return err
+	}
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].name < settings[j].name
+	})
+
+	for _, s := range settings {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", s.name, s.redacted()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The value to show for a setting
+func (s *setting) redacted() string {
+	v := s.String()
+	if v == "" {
+		return v
+	}
+	if s.secret {
+		return redacted
+	}
+	// Settings can be lists of URLs
+	values := strings.Split(v, ",")
+	for i, value := range values {
+		if u, err := url.Parse(strings.TrimSpace(value)); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				values[i] = u.Redacted()
+			}
+		}
+	}
+	return strings.Join(values, ",")
+}
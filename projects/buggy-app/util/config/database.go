@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+// Database is the settings for connecting to Postgres, for binaries to embed in their
+// configuration
+type Database struct {
+	DatabaseUrl       string        `config:"database-url" usage:"Postgres connection URL (defaults to the docker-compose database)"`
+	MaxConns          int           `config:"db-max-conns" usage:"most database connections to open at once"`
+	MinConns          int           `config:"db-min-conns" usage:"database connections to keep open when idle"`
+	MaxConnLifetime   time.Duration `config:"db-max-conn-lifetime" usage:"replace database connections after this long"`
+	MaxConnIdleTime   time.Duration `config:"db-max-conn-idle-time" usage:"close idle database connections after this long"`
+	HealthCheckPeriod time.Duration `config:"db-health-check-period" usage:"how often to check idle database connections"`
+	StatementTimeout  time.Duration `config:"db-statement-timeout" usage:"cancel any query that runs for longer than this (0 for no limit)"`
+	ConnectTimeout    time.Duration `config:"db-connect-timeout" usage:"how long to wait for the database to be ready when starting"`
+}
+
+// DefaultDatabase is the Database settings to start from
+func DefaultDatabase() Database {
+	return Database{
+		MaxConns:          10,
+		MinConns:          1,
+		MaxConnLifetime:   time.Hour,
+		MaxConnIdleTime:   30 * time.Minute,
+		HealthCheckPeriod: time.Minute,
+		StatementTimeout:  30 * time.Second,
+		ConnectTimeout:    util.DefaultBackoff.Timeout,
+	}
+}
+
+// Validate checks the settings, and fills in the docker-compose database if no URL was given
+func (d *Database) Validate() error {
+	if d.DatabaseUrl == "" {
+		databaseUrl, err := util.DefaultDatabaseUrl()
+		if err != nil {
+			return fmt.Errorf("no database-url: %w", err)
+		}
+		d.DatabaseUrl = databaseUrl
+	}
+	if _, err := url.Parse(d.DatabaseUrl); err != nil {
+		return errors.New("database-url is not a valid URL")
+	}
+
+	switch {
+	case d.MaxConns < 1:
+		return errors.New("db-max-conns must be at least 1")
+	case d.MinConns < 0 || d.MinConns > d.MaxConns:
+		return errors.New("db-min-conns must be between 0 and db-max-conns")
+	case d.MaxConnLifetime < 0, d.MaxConnIdleTime < 0, d.HealthCheckPeriod < 0:
+		return errors.New("database connection times can't be negative")
+	case d.StatementTimeout < 0:
+		return errors.New("db-statement-timeout can't be negative")
+	case d.ConnectTimeout <= 0:
+		return errors.New("db-connect-timeout must be positive")
+	}
+	return nil
+}
+
+// Pool is the settings for util.NewPool
+func (d Database) Pool() util.PoolConfig {
+	return util.PoolConfig{
+		MaxConns:          int32(d.MaxConns),
+		MinConns:          int32(d.MinConns),
+		MaxConnLifetime:   d.MaxConnLifetime,
+		MaxConnIdleTime:   d.MaxConnIdleTime,
+		HealthCheckPeriod: d.HealthCheckPeriod,
+		StatementTimeout:  d.StatementTimeout,
+	}
+}
+
+// Backoff is how util.ConnectPool should wait for the database
+func (d Database) Backoff() util.Backoff {
+	backoff := util.DefaultBackoff
+	backoff.Timeout = d.ConnectTimeout
+	return backoff
+}
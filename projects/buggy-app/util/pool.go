@@ -0,0 +1,123 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PoolConfig tunes a pool of database connections. Zero values leave pgx's defaults.
+type PoolConfig struct {
+	// Most connections to open at once. Queries wait for a connection when they're all busy.
+	MaxConns int32
+	// Connections to keep open even when they're idle
+	MinConns int32
+	// Connections are closed and replaced after this long, so that load is spread again when
+	// a database is added or restarted
+	MaxConnLifetime time.Duration
+	// Idle connections are closed after this long, down to MinConns
+	MaxConnIdleTime time.Duration
+	// How often idle connections are checked
+	HealthCheckPeriod time.Duration
+	// Postgres cancels any statement that runs for longer than this, so that one slow query
+	// can't hold on to a connection for good
+	StatementTimeout time.Duration
+}
+
+// NewPool connects to the database at databaseUrl with a pool of connections tuned by config
+func NewPool(ctx context.Context, databaseUrl string, config PoolConfig) (*pgxpool.Pool, error) {
+	poolConfig, err := parsePoolConfig(databaseUrl, config)
+	if err != nil {
+		return nil, err
+	}
+	return pgxpool.NewWithConfig(ctx, poolConfig)
+}
+
+func parsePoolConfig(databaseUrl string, config PoolConfig) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(databaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database url: %w", err)
+	}
+
+	if config.MaxConns > 0 {
+		poolConfig.MaxConns = config.MaxConns
+	}
+	if config.MinConns > 0 {
+		poolConfig.MinConns = config.MinConns
+	}
+	if config.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = config.MaxConnLifetime
+	}
+	if config.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = config.MaxConnIdleTime
+	}
+	if config.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = config.HealthCheckPeriod
+	}
+	if config.StatementTimeout > 0 {
+		// Set for every connection when it's opened. It can still be changed for a transaction
+		// with SET LOCAL.
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(config.StatementTimeout.Milliseconds(), 10)
+	}
+
+	return poolConfig, nil
+}
+
+// PoolStats is a snapshot of what a pool of connections is doing, for monitoring
+type PoolStats struct {
+	MaxConns      int32 `json:"max_conns"`
+	TotalConns    int32 `json:"total_conns"`
+	IdleConns     int32 `json:"idle_conns"`
+	AcquiredConns int32 `json:"acquired_conns"`
+	// Connections being opened
+	ConstructingConns int32 `json:"constructing_conns"`
+	// The following count since the pool was created
+	AcquireCount int64 `json:"acquire_count"`
+	// Acquires that had to wait for a connection to be free or opened, and how long they waited
+	// in total. If this grows quickly, the pool is too small.
+	EmptyAcquireCount       int64 `json:"empty_acquire_count"`
+	AcquireDurationMs       int64 `json:"acquire_duration_ms"`
+	CanceledAcquireCount    int64 `json:"canceled_acquire_count"`
+	NewConnsCount           int64 `json:"new_conns_count"`
+	MaxLifetimeDestroyCount int64 `json:"max_lifetime_destroy_count"`
+	MaxIdleDestroyCount     int64 `json:"max_idle_destroy_count"`
+}
+
+// StatsOf reports on a pool
+func StatsOf(pool *pgxpool.Pool) PoolStats {
+	stat := pool.Stat()
+	return PoolStats{
+		MaxConns:                stat.MaxConns(),
+		TotalConns:              stat.TotalConns(),
+		IdleConns:               stat.IdleConns(),
+		AcquiredConns:           stat.AcquiredConns(),
+		ConstructingConns:       stat.ConstructingConns(),
+		AcquireCount:            stat.AcquireCount(),
+		EmptyAcquireCount:       stat.EmptyAcquireCount(),
+		AcquireDurationMs:       stat.AcquireDuration().Milliseconds(),
+		CanceledAcquireCount:    stat.CanceledAcquireCount(),
+		NewConnsCount:           stat.NewConnsCount(),
+		MaxLifetimeDestroyCount: stat.MaxLifetimeDestroyCount(),
+		MaxIdleDestroyCount:     stat.MaxIdleDestroyCount(),
+	}
+}
+
+// LogPoolStats logs the pool's stats every interval until ctx is done
+func LogPoolStats(ctx context.Context, logger *log.Logger, name string, pool *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s := StatsOf(pool)
+			logger.Printf("%s: pool: total %d/%d, idle %d, acquired %d, waited %d of %d acquires (%dms)",
+				name, s.TotalConns, s.MaxConns, s.IdleConns, s.AcquiredConns, s.EmptyAcquireCount, s.AcquireCount, s.AcquireDurationMs)
+		}
+	}
+}
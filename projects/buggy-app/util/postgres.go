@@ -2,6 +2,7 @@ package util
 
 import (
 	"errors"
+	"net/url"
 	"os"
 )
 
@@ -23,3 +24,52 @@ func ReadPasswd() (string, error) {
 	}
 	return string(pwdFile), nil
 }
+
+// The URL of the app database in docker-compose, as the postgres user with the password from
+// ReadPasswd. This is used when a binary isn't given a DATABASE_URL.
+func DefaultDatabaseUrl() (string, error) {
+	passwd, err := ReadPasswd()
+	if err != nil {
+		return "", err
+	}
+	return appDatabaseUrl("postgres", passwd), nil
+}
+
+// Get the app role's password from the environment, either via $APP_PASSWORD or
+// $APP_PASSWORD_FILE
+func ReadAppPasswd() (string, error) {
+	if os.Getenv("APP_PASSWORD") != "" {
+		return os.Getenv("APP_PASSWORD"), nil
+	}
+
+	passwordFile := os.Getenv("APP_PASSWORD_FILE")
+	if passwordFile == "" {
+		return "", errors.New("please set APP_PASSWORD_FILE environment variable")
+	}
+
+	pwdFile, err := os.ReadFile(passwordFile)
+	if err != nil {
+		return "", err
+	}
+	return string(pwdFile), nil
+}
+
+// The URL of the app database in docker-compose, as the unprivileged app role with the password
+// from ReadAppPasswd
+func DefaultAppDatabaseUrl() (string, error) {
+	passwd, err := ReadAppPasswd()
+	if err != nil {
+		return "", err
+	}
+	return appDatabaseUrl("app", passwd), nil
+}
+
+func appDatabaseUrl(user, passwd string) string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(user, passwd),
+		Host:   "postgres:5432",
+		Path:   "/app",
+	}
+	return u.String()
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// Postgres isn't always ready when the binaries that use it start: in docker-compose they all
+// start together, and Postgres refuses connections while it starts up or restarts. Rather than
+// waiting for the port to open before starting (which isn't enough: Postgres opens it before it
+// accepts connections), connecting is retried for a while when the error says it's worth it.
+
+// Backoff is how long to keep retrying, and how long to wait between tries. Zero fields take
+// DefaultBackoff's values.
+type Backoff struct {
+	// Wait before the first retry. Each retry waits twice as long as the one before, up to Max.
+	Initial time.Duration
+	Max     time.Duration
+	// Give up after this long
+	Timeout time.Duration
+}
+
+// DefaultBackoff retries for a minute, which is plenty for Postgres to start
+var DefaultBackoff = Backoff{
+	Initial: 100 * time.Millisecond,
+	Max:     5 * time.Second,
+	Timeout: time.Minute,
+}
+
+// Postgres error codes that mean "try again soon"
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+var retryableCodes = map[string]bool{
+	"57P03": true, // cannot_connect_now: the database system is starting up
+	"57P01": true, // admin_shutdown: restarting
+	"53300": true, // too_many_connections
+}
+
+// IsRetryable says whether err is from a database that isn't ready yet, rather than one that
+// will never work (e.g. a wrong password or missing database)
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return retryableCodes[pgErr.Code] || strings.HasPrefix(pgErr.Code, "08")
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		code := string(pqErr.Code)
+		return retryableCodes[code] || strings.HasPrefix(code, "08")
+	}
+
+	// The server isn't listening yet, dropped the connection, or (in docker-compose) its name
+	// doesn't resolve yet
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &dnsErr), errors.As(err, &opErr):
+		return true
+	}
+	return false
+}
+
+// Retry calls try until it succeeds, it returns an error that isn't retryable, or the backoff
+// times out. Waits between tries are jittered, so that binaries that start together don't
+// retry together. logf, if given, is told about each retry.
+func Retry(ctx context.Context, backoff Backoff, logf func(format string, v ...interface{}), try func(ctx context.Context) error) error {
+	if backoff.Initial <= 0 {
+		backoff.Initial = DefaultBackoff.Initial
+	}
+	if backoff.Max <= 0 {
+		backoff.Max = DefaultBackoff.Max
+	}
+	if backoff.Timeout <= 0 {
+		backoff.Timeout = DefaultBackoff.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, backoff.Timeout)
+	defer cancel()
+
+	wait := backoff.Initial
+	for attempt := 1; ; attempt++ {
+		err := try(ctx)
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+
+		// Wait somewhere between half and all of the backoff
+		sleep := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+		if logf != nil {
+			logf("database not ready (attempt %d), retrying in %v: %v", attempt, sleep.Round(time.Millisecond), err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for the database after %d attempts: %w", attempt, err)
+		case <-time.After(sleep):
+		}
+
+		wait *= 2
+		if wait > backoff.Max {
+			wait = backoff.Max
+		}
+	}
+}
+
+// WaitForDatabase pings db until the database is ready, retrying with backoff. A pool doesn't
+// connect until it's first used, so this is how a service finds out early whether it can.
+func WaitForDatabase(ctx context.Context, db interface{ Ping(context.Context) error }, backoff Backoff, logf func(format string, v ...interface{})) error {
+	return Retry(ctx, backoff, logf, db.Ping)
+}
+
+// Connect opens a single connection to the database, retrying with backoff until it's ready
+func Connect(ctx context.Context, databaseUrl string, backoff Backoff, logf func(format string, v ...interface{})) (*pgx.Conn, error) {
+	var conn *pgx.Conn
+	err := Retry(ctx, backoff, logf, func(ctx context.Context) error {
+		var err error
+		conn, err = pgx.Connect(ctx, databaseUrl)
+		return err
+	})
+	return conn, err
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pgconn.PgError{Code: "57P03", Message: "the database system is starting up"}, true},
+		{fmt.Errorf("failed to connect: %w", &pgconn.PgError{Code: "08006"}), true},
+		{&pq.Error{Code: "57P03"}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{&net.DNSError{Err: "no such host", Name: "postgres", IsNotFound: true}, true},
+		// Retrying won't help these
+		{&pgconn.PgError{Code: "28P01", Message: "password authentication failed"}, false},
+		{&pq.Error{Code: "3D000"}, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+var fastBackoff = Backoff{Initial: time.Millisecond, Max: 4 * time.Millisecond, Timeout: time.Second}
+
+func TestRetryUntilReady(t *testing.T) {
+	tries := 0
+	err := Retry(context.Background(), fastBackoff, t.Logf, func(ctx context.Context) error {
+		tries++
+		if tries < 3 {
+			return &pgconn.PgError{Code: "57P03"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tries != 3 {
+		t.Fatalf("expected 3 tries, got %d", tries)
+	}
+}
+
+func TestRetryGivesUpOnPermanentError(t *testing.T) {
+	tries := 0
+	permanent := &pgconn.PgError{Code: "28P01"}
+	err := Retry(context.Background(), fastBackoff, t.Logf, func(ctx context.Context) error {
+		tries++
+		return permanent
+	})
+	if !errors.Is(err, permanent) || tries != 1 {
+		t.Fatalf("expected one try and the error back, got %d tries and %v", tries, err)
+	}
+}
+
+func TestRetryTimesOut(t *testing.T) {
+	backoff := Backoff{Initial: time.Millisecond, Max: 2 * time.Millisecond, Timeout: 20 * time.Millisecond}
+	starting := &pgconn.PgError{Code: "57P03"}
+	err := Retry(context.Background(), backoff, nil, func(ctx context.Context) error {
+		return starting
+	})
+	if !errors.Is(err, starting) {
+		t.Fatalf("expected the last error to be wrapped, got %v", err)
+	}
+}
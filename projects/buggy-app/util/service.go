@@ -13,9 +13,8 @@ func MarshalWithIndent(data interface{}, indent string) ([]byte, error) {
 	// Convert images to a byte-array for writing back in a response
 	var b []byte
 	var marshalErr error
-	// Allow up to 10 characters of indent
-	if i, err := strconv.Atoi(indent); err == nil && i > 0 && i <= 10 {
-		b, marshalErr = json.MarshalIndent(data, "", strings.Repeat(" ", i))
+	if spaces := Indent(indent); spaces != "" {
+		b, marshalErr = json.MarshalIndent(data, "", spaces)
 	} else {
 		b, marshalErr = json.Marshal(data)
 	}
@@ -24,3 +23,13 @@ func MarshalWithIndent(data interface{}, indent string) ([]byte, error) {
 	}
 	return b, nil
 }
+
+// Turn an indent value (like the ?indent=2 query parameter) into the string of spaces to indent
+// by. Anything that isn't a number from 1 to 10 means no indent.
+func Indent(indent string) string {
+	// Allow up to 10 characters of indent
+	if i, err := strconv.Atoi(indent); err == nil && i > 0 && i <= 10 {
+		return strings.Repeat(" ", i)
+	}
+	return ""
+}
@@ -0,0 +1,12 @@
+#!/bin/bash
+set -e
+
+# The API connects as app, which can't bypass row-level security. Its password is made by
+# `make volumes`, like the postgres one.
+APP_PASSWORD="$(cat /run/secrets/app-passwd)"
+
+psql -v ON_ERROR_STOP=1 -v app_password="$APP_PASSWORD" --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-EOSQL
+	CREATE USER app PASSWORD :'app_password';
+	CREATE DATABASE app;
+	GRANT ALL PRIVILEGES ON DATABASE app TO app;
+EOSQL